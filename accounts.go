@@ -0,0 +1,422 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// http://dev.mysql.com/doc/refman/5.6/en/privileges-provided.html
+type privilege uint32
+
+const (
+	privSelect privilege = 1 << iota
+	privInsert
+	privUpdate
+	privDelete
+	privCreate
+	privDrop
+	privReload
+	privShutdown
+	privProcess
+	privFile
+	privGrant
+	privReferences
+	privIndex
+	privAlter
+	privShowDB
+	privSuper
+	privCreateTmpTable
+	privLockTables
+	privExecute
+	privReplSlave
+	privReplClient
+	privCreateView
+	privShowView
+	privCreateRoutine
+	privAlterRoutine
+	privCreateUser
+	privEvent
+	privTrigger
+
+	// MySQL 8.0 dynamic privilege, allows connecting past max_connections and
+	// through admin-only listeners
+	privConnectionAdmin
+
+	privAll = privConnectionAdmin<<1 - 1
+
+	// Privileges that apply to the objects in databases. Having any of them globally
+	// gives access to every database.
+	privDBLevel = privSelect | privInsert | privUpdate | privDelete | privCreate | privDrop |
+		privGrant | privReferences | privIndex | privAlter | privCreateTmpTable | privLockTables |
+		privExecute | privCreateView | privShowView | privCreateRoutine | privAlterRoutine |
+		privEvent | privTrigger
+)
+
+var privilegeNames map[string]privilege = map[string]privilege{
+	"SELECT":                   privSelect,
+	"INSERT":                   privInsert,
+	"UPDATE":                   privUpdate,
+	"DELETE":                   privDelete,
+	"CREATE":                   privCreate,
+	"DROP":                     privDrop,
+	"RELOAD":                   privReload,
+	"SHUTDOWN":                 privShutdown,
+	"PROCESS":                  privProcess,
+	"FILE":                     privFile,
+	"GRANT OPTION":             privGrant,
+	"REFERENCES":               privReferences,
+	"INDEX":                    privIndex,
+	"ALTER":                    privAlter,
+	"SHOW DATABASES":           privShowDB,
+	"SUPER":                    privSuper,
+	"CREATE TEMPORARY TABLES":  privCreateTmpTable,
+	"LOCK TABLES":              privLockTables,
+	"EXECUTE":                  privExecute,
+	"REPLICATION SLAVE":        privReplSlave,
+	"REPLICATION CLIENT":       privReplClient,
+	"CREATE VIEW":              privCreateView,
+	"SHOW VIEW":                privShowView,
+	"CREATE ROUTINE":           privCreateRoutine,
+	"ALTER ROUTINE":            privAlterRoutine,
+	"CREATE USER":              privCreateUser,
+	"EVENT":                    privEvent,
+	"TRIGGER":                  privTrigger,
+	"CONNECTION_ADMIN":         privConnectionAdmin,
+	"SERVICE_CONNECTION_ADMIN": privConnectionAdmin,
+	"ALL":                      privAll,
+	"ALL PRIVILEGES":           privAll,
+}
+
+func parsePrivileges(names []string) (privilege, error) {
+	var privs privilege
+
+	for _, name := range names {
+		p, ok := privilegeNames[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("Accounts/parsePrivileges: Unknown privilege %q", name)
+		}
+		privs |= p
+	}
+
+	return privs, nil
+}
+
+type AccountConfig struct {
+	User string
+
+	// Host the account may connect from. Can use the % and _ wildcards, and
+	// defaults to "%", any host.
+	Host string
+
+	// Either the password in clear text, or the mysql_native_password hash as shown
+	// by PASSWORD(), "*" followed by 40 hex digits. No password if both are empty.
+	Password     string
+	PasswordHash string
+
+	// Global privileges, such as "SELECT", "PROCESS" or "ALL"
+	Privileges []string
+
+	// Databases the account may use without any global database privileges. Can use
+	// the % and _ wildcards.
+	Databases []string
+
+	// Limit on simultaneous connections for the account. 0 means the global
+	// max_user_connections applies.
+	MaxUserConnections uint64
+
+	// Limits on statements, statements that change data, and logins per hour.
+	// 0 means no limit.
+	MaxQueriesPerHour     uint64
+	MaxUpdatesPerHour     uint64
+	MaxConnectionsPerHour uint64
+}
+
+type account struct {
+	user string
+	host string
+
+	// SHA1(SHA1(password)), or nil for accounts without a password
+	authString []byte
+
+	privs privilege
+
+	// Database name patterns the account has been granted access to
+	databases []string
+
+	// http://dev.mysql.com/doc/refman/5.6/en/user-resources.html
+	maxUserConnections    uint64
+	maxQueriesPerHour     uint64
+	maxUpdatesPerHour     uint64
+	maxConnectionsPerHour uint64
+}
+
+func newAccount(ac *AccountConfig) (*account, error) {
+	a := &account{
+		user:                  ac.User,
+		host:                  ac.Host,
+		maxUserConnections:    ac.MaxUserConnections,
+		maxQueriesPerHour:     ac.MaxQueriesPerHour,
+		maxUpdatesPerHour:     ac.MaxUpdatesPerHour,
+		maxConnectionsPerHour: ac.MaxConnectionsPerHour,
+		databases:             ac.Databases,
+	}
+
+	if a.host == "" {
+		a.host = "%"
+	}
+
+	var err error
+	if a.privs, err = parsePrivileges(ac.Privileges); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ac.PasswordHash != "":
+		if a.authString, err = parsePasswordHash(ac.PasswordHash); err != nil {
+			return nil, fmt.Errorf("Accounts/newAccount: Invalid password hash for %s", a)
+		}
+
+	case ac.Password != "":
+		a.authString = nativePasswordHash(ac.Password)
+	}
+
+	return a, nil
+}
+
+// parsePasswordHash decodes a mysql_native_password hash as shown by PASSWORD(),
+// "*" followed by 40 hex digits
+func parsePasswordHash(hash string) ([]byte, error) {
+	if len(hash) != 41 || hash[0] != '*' {
+		return nil, fmt.Errorf("Accounts/parsePasswordHash: Invalid password hash")
+	}
+	return hex.DecodeString(hash[1:])
+}
+
+// hasHourlyLimits returns true if any of the per hour resource limits is set
+func (this *account) hasHourlyLimits() bool {
+	return this.maxQueriesPerHour != 0 || this.maxUpdatesPerHour != 0 || this.maxConnectionsPerHour != 0
+}
+
+// String returns the account as 'user'@'host'
+func (this *account) String() string {
+	return fmt.Sprintf("'%s'@'%s'", this.user, this.host)
+}
+
+func (this *account) has(p privilege) bool {
+	return this.privs&p == p
+}
+
+// isAdmin returns true for accounts that may use the extra connection past
+// max_connections and admin-only listeners
+func (this *account) isAdmin() bool {
+	return this.has(privConnectionAdmin) || this.has(privSuper)
+}
+
+// canSelectFrom returns true if the account may read the tables of db, with either
+// the global SELECT privilege or access to db
+func (this *account) canSelectFrom(db string) bool {
+	if this.has(privSelect) {
+		return true
+	}
+
+	for _, pattern := range this.databases {
+		if likeMatch(pattern, db) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canUseDatabase returns true if the account may select db as its default database.
+// Everyone may use INFORMATION_SCHEMA.
+func (this *account) canUseDatabase(db string) bool {
+	if this.privs&privDBLevel != 0 || strings.EqualFold(db, "information_schema") {
+		return true
+	}
+
+	for _, pattern := range this.databases {
+		if likeMatch(pattern, db) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// http://dev.mysql.com/doc/internals/en/secure-password-authentication.html
+// The server stores SHA1(SHA1(password))
+func nativePasswordHash(password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	return stage2[:]
+}
+
+// checkNativePassword verifies the auth response of mysql_native_password, which
+// is SHA1(password) XOR SHA1(challenge + SHA1(SHA1(password)))
+func checkNativePassword(authString, challenge, authResp []byte) bool {
+	if authString == nil {
+		return len(authResp) == 0
+	}
+
+	if len(authResp) != sha1.Size {
+		return false
+	}
+
+	h := sha1.New()
+	h.Write(challenge)
+	h.Write(authString)
+	stage1 := h.Sum(nil)
+
+	for i := range stage1 {
+		stage1[i] ^= authResp[i]
+	}
+
+	stage2 := sha1.Sum(stage1)
+	return bytes.Equal(stage2[:], authString)
+}
+
+type accountStore struct {
+	mu sync.RWMutex
+
+	// Set when no accounts are configured. Every user is then let in without a
+	// password check and with all privileges, like mysqld --skip-grant-tables.
+	skipGrants bool
+
+	// Sorted with the most specific host patterns first, the order MySQL uses to
+	// pick the account for a connection
+	accounts []*account
+}
+
+func newAccountStore(configs []AccountConfig) (*accountStore, error) {
+	store := &accountStore{skipGrants: len(configs) == 0}
+
+	for i := range configs {
+		a, err := newAccount(&configs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := store.add(a); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (this *accountStore) add(a *account) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, b := this.find(a.user, a.host); b != nil {
+		return fmt.Errorf("Accounts/add: Duplicate account %s", a)
+	}
+
+	this.accounts = append(this.accounts, a)
+	sort.SliceStable(this.accounts, func(i, j int) bool {
+		return hostSpecificity(this.accounts[i].host) > hostSpecificity(this.accounts[j].host)
+	})
+
+	return nil
+}
+
+// find returns the account with exactly this user and host, if any. Must be called
+// with mu held.
+func (this *accountStore) find(user, host string) (int, *account) {
+	for i, a := range this.accounts {
+		if a.user == user && strings.EqualFold(a.host, host) {
+			return i, a
+		}
+	}
+	return -1, nil
+}
+
+// replace swaps in a new version of an existing account. Accounts are never
+// changed in place, since connections keep using the account they logged in with.
+func (this *accountStore) replace(a *account) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	i, _ := this.find(a.user, a.host)
+	if i < 0 {
+		return false
+	}
+
+	this.accounts[i] = a
+	return true
+}
+
+// get returns the account with exactly this user and host, or nil
+func (this *accountStore) get(user, host string) *account {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	_, a := this.find(user, host)
+	return a
+}
+
+// latest returns the current version of a, which may have been changed by ALTER
+// USER since a connection logged in with it
+func (this *accountStore) latest(a *account) *account {
+	if b := this.get(a.user, a.host); b != nil {
+		return b
+	}
+	return a
+}
+
+// hostSpecificity ranks literal hosts above patterns, and patterns with a longer
+// literal prefix above shorter ones. '%' on its own comes last.
+func hostSpecificity(host string) int {
+	i := strings.IndexAny(host, "%_")
+	if i < 0 {
+		return 1 << 16
+	}
+	return i
+}
+
+// lookup returns the account matching user connecting from host, where host is an
+// IP address or "localhost"
+func (this *accountStore) lookup(user, host string) *account {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for _, a := range this.accounts {
+		if a.user == user && likeMatch(a.host, host) {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// authenticate returns the account for user at host if authResp is the right
+// response to the challenge. It fails with ER_ACCESS_DENIED_ERROR the same way for
+// unknown users and wrong passwords.
+func (this *accountStore) authenticate(user, host string, challenge, authResp []byte) (*account, error) {
+	if this.skipGrants {
+		return &account{user: user, host: "%", privs: privAll}, nil
+	}
+
+	if a := this.lookup(user, host); a != nil && checkNativePassword(a.authString, challenge, authResp) {
+		return a, nil
+	}
+
+	using := "NO"
+	if len(authResp) > 0 {
+		using = "YES"
+	}
+
+	return nil, newSQLError(1045, "Access denied for user '%s'@'%s' (using password: %s)", user, host, using)
+}
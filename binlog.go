@@ -0,0 +1,907 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RowChange is a change to one row of a table, as recorded in the binary log.
+// Inserts only have After, deletes only Before, and updates both.
+type RowChange struct {
+	Schema string
+	Table  string
+
+	// All columns of the table, in order. Each image has a value per column, nil
+	// for NULL. Values take the same Go types as in Rows, and time.Duration for
+	// TypeTime. TypeBit, TypeEnum and TypeSet columns can't be logged.
+	Columns []Column
+
+	Before []interface{}
+	After  []interface{}
+}
+
+// LogRows writes the changes of one transaction to the binary log, for replicas to
+// pick up. Consecutive changes of the same kind to the same table go into one rows
+// event. It does nothing if binary logging is off, and fails once the server has
+// stopped.
+func (this *Server) LogRows(changes ...RowChange) error {
+	if this.binlog == nil || len(changes) == 0 {
+		return nil
+	}
+	return this.binlog.logRows(changes)
+}
+
+// LogStatement writes a statement that replicas run as it is, such as DDL, to the
+// binary log. schema is the default database to run it in. It does nothing if
+// binary logging is off, and fails once the server has stopped.
+func (this *Server) LogStatement(schema, sql string) error {
+	if this.binlog == nil {
+		return nil
+	}
+	return this.binlog.logStatement(schema, sql)
+}
+
+// binlogEvent is an event to be added to the log
+type binlogEvent struct {
+	typ   binlogEventType
+	flags uint16
+	body  []byte
+}
+
+type binlogFile struct {
+	// The name replicas and SHOW statements know the file by, and where it is
+	name string
+	path string
+
+	// Bytes written so far, which are all whole events
+	size uint64
+
+	// Whether the events of the file end with a CRC32
+	checksum bool
+
+	// Transactions 1 to prevGno were written to earlier files
+	prevGno uint64
+
+	// Logical clock of the transactions in the file, restarting with each file
+	sequence uint64
+
+	// Set once the file ends with a ROTATE event. Nothing more is written to it.
+	closed bool
+}
+
+// binlog is the server's binary log, a sequence of files of events of which only
+// the last one is written to. The files in use are listed in the index file, one
+// per line.
+// http://dev.mysql.com/doc/internals/en/binary-log.html
+type binlog struct {
+	base     string
+	serverID uint32
+	sid      [16]byte
+	checksum bool
+
+	// The global variables, for max_binlog_size and binlog_expire_logs_seconds
+	vars *variables
+
+	mu    sync.Mutex
+	files []*binlogFile
+
+	// The file being written, nil once the log is closed
+	out *os.File
+
+	// Set while the file that the ROTATE event at the end of the current one points
+	// to hasn't been started, because that failed. It's tried again on each write.
+	rotated bool
+
+	// Number of the last file, and the last GTID and XID assigned
+	index uint64
+	gno   uint64
+	xid   uint64
+
+	// Ids of the tables in TABLE_MAP events, by schema.table
+	tableIDs map[string]uint64
+
+	// Closed and replaced whenever events are added, to wake up the dumps waiting
+	// for them
+	appended chan struct{}
+
+	// Number of dumps reading each file, by name
+	readers map[string]int
+}
+
+// Most a dump reads from a file at once, unless a single event is larger
+const binlogReadSize = 1 << 20
+
+// newBinlog opens the log with base name cfg.LogBin. The files of an earlier run
+// that are in the index are kept, and logging carries on in a new file.
+func newBinlog(cfg *Config, vars *variables) (*binlog, error) {
+	b := &binlog{
+		base:     cfg.LogBin,
+		serverID: cfg.ServerID,
+		vars:     vars,
+		tableIDs: make(map[string]uint64),
+		appended: make(chan struct{}),
+		readers:  make(map[string]int),
+	}
+
+	switch strings.ToUpper(cfg.BinlogChecksum) {
+	case "CRC32":
+		b.checksum = true
+	case "NONE":
+	default:
+		return nil, fmt.Errorf("Binlog/newBinlog: Unknown checksum algorithm %q", cfg.BinlogChecksum)
+	}
+
+	var err error
+	if b.sid, err = parseServerUUID(cfg.ServerUUID, cfg.ServerID); err != nil {
+		return nil, err
+	}
+
+	if err := b.recover(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := b.openFile(now, true); err != nil {
+		return nil, err
+	}
+	if err := b.purgeExpired(now); err != nil {
+		b.close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (this *binlog) indexPath() string {
+	return this.base + ".index"
+}
+
+// recover picks up the files listed in the index. The last one may not have been
+// closed properly: whatever follows its last whole event is cut off, and it gets
+// the ROTATE event it's missing.
+func (this *binlog) recover() error {
+	data, err := os.ReadFile(this.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Binlog/recover: %v", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		path := strings.TrimSpace(line)
+		if path == "" {
+			continue
+		}
+
+		// New files are numbered after all the ones listed, even those that are gone
+		if ext := filepath.Ext(path); ext != "" {
+			if n, err := strconv.ParseUint(ext[1:], 10, 64); err == nil && n > this.index {
+				this.index = n
+			}
+		}
+
+		f, err := this.recoverFile(path)
+		if err != nil {
+			glog.Warningf("Binlog/recover: Leaving out %s: %v", path, err)
+			continue
+		}
+		this.files = append(this.files, f)
+	}
+
+	if len(this.files) == 0 {
+		return nil
+	}
+
+	f := this.current()
+	this.gno = f.prevGno
+
+	// The last file has the most recent GTIDs, and may end with a partial event
+	end, err := scanBinlog(f.path, uint64(len(binlogMagic)), f.size, func(pos uint64, ev []byte) error {
+		switch binlogEventType(ev[4]) {
+		case binlogGTIDEvent:
+			this.gno = binary.LittleEndian.Uint64(ev[binlogHeaderSize+17:])
+		case binlogRotateEvent:
+			f.closed = true
+		default:
+			f.closed = false
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Binlog/recover: %s: %v", f.path, err)
+	}
+
+	if end < f.size {
+		glog.Warningf("Binlog/recover: Truncating %s from %d to %d bytes", f.path, f.size, end)
+		if err := os.Truncate(f.path, int64(end)); err != nil {
+			return fmt.Errorf("Binlog/recover: %v", err)
+		}
+		f.size = end
+	}
+
+	if !f.closed {
+		out, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return fmt.Errorf("Binlog/recover: %v", err)
+		}
+		defer out.Close()
+
+		if err := this.write(out, f, time.Now(), []binlogEvent{this.rotateEvent()}); err != nil {
+			return err
+		}
+		f.closed = true
+	}
+
+	return nil
+}
+
+// recoverFile checks that the file at path starts like a binary log, and reads its
+// checksum setting and previous GTIDs
+func (this *binlog) recoverFile(path string) (*binlogFile, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &binlogFile{
+		name:   filepath.Base(path),
+		path:   path,
+		size:   uint64(fi.Size()),
+		closed: true,
+	}
+
+	magic := make([]byte, len(binlogMagic))
+	if r, err := os.Open(path); err != nil {
+		return nil, err
+	} else {
+		_, err = io.ReadFull(r, magic)
+		r.Close()
+		if err != nil || string(magic) != binlogMagic {
+			return nil, fmt.Errorf("Not a binary log file")
+		}
+	}
+
+	var fde, previous []byte
+	_, err = scanBinlog(path, uint64(len(binlogMagic)), f.size, func(pos uint64, ev []byte) error {
+		if fde == nil {
+			fde = ev
+			return nil
+		}
+		previous = ev
+		return io.EOF
+	})
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil || binlogEventType(fde[4]) != binlogFormatDescriptionEvent || binlogEventType(previous[4]) != binlogPreviousGTIDsEvent {
+		return nil, fmt.Errorf("No format description and previous GTIDs")
+	}
+
+	f.checksum = binlogFileChecksum(fde)
+	set, err := parseGTIDSet(binlogEventBody(previous, f.checksum))
+	if err != nil {
+		return nil, err
+	}
+	f.prevGno = set.upTo(this.sid)
+
+	return f, nil
+}
+
+// openFile starts the next file with a format description and the GTIDs logged so
+// far. Only the first file after startup has a creation time. The file is added to
+// the index before it's created, so it can't be left out of it. If the file can't
+// be started, it's taken out again so the same one can be tried later.
+func (this *binlog) openFile(now time.Time, first bool) error {
+	path := fmt.Sprintf("%s.%06d", this.base, this.index+1)
+	f := &binlogFile{
+		name:     filepath.Base(path),
+		path:     path,
+		checksum: this.checksum,
+		prevGno:  this.gno,
+	}
+
+	this.files = append(this.files, f)
+	if err := this.writeIndex(); err != nil {
+		this.files = this.files[:len(this.files)-1]
+		return err
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		this.files = this.files[:len(this.files)-1]
+		this.writeIndex()
+		return fmt.Errorf("Binlog/openFile: %v", err)
+	}
+
+	fail := func(err error) error {
+		out.Close()
+		os.Remove(path)
+		this.files = this.files[:len(this.files)-1]
+		this.writeIndex()
+		return err
+	}
+
+	if _, err := out.Write([]byte(binlogMagic)); err != nil {
+		return fail(fmt.Errorf("Binlog/openFile: %s: %v", f.name, err))
+	}
+	f.size = uint64(len(binlogMagic))
+
+	var created uint32
+	if first {
+		created = uint32(now.Unix())
+	}
+
+	err = this.write(out, f, now, []binlogEvent{
+		{typ: binlogFormatDescriptionEvent, body: formatDescriptionBody(created, this.checksum)},
+		{typ: binlogPreviousGTIDsEvent, body: previousGTIDsBody(this.sid, this.gno)},
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	this.index++
+	this.out = out
+	return nil
+}
+
+// writeIndex replaces the index file with one listing the current files
+func (this *binlog) writeIndex() error {
+	var buf bytes.Buffer
+	for _, f := range this.files {
+		buf.WriteString(f.path)
+		buf.WriteByte('\n')
+	}
+
+	tmp := this.indexPath() + "~"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0640); err != nil {
+		return fmt.Errorf("Binlog/writeIndex: %v", err)
+	}
+	if err := os.Rename(tmp, this.indexPath()); err != nil {
+		return fmt.Errorf("Binlog/writeIndex: %v", err)
+	}
+
+	return nil
+}
+
+// write appends events to f, each with the position of the next one in its header.
+// They are synced to disk before returning. If that fails, f is cut back to where
+// it was, so it never ends with part of an event.
+func (this *binlog) write(out *os.File, f *binlogFile, now time.Time, events []binlogEvent) error {
+	var buf []byte
+	pos := f.size
+	for _, ev := range events {
+		pos += uint64(binlogEventSize(len(ev.body), ev.typ, f.checksum))
+		h := binlogHeader{
+			timestamp: uint32(now.Unix()),
+			typ:       ev.typ,
+			serverID:  this.serverID,
+			logPos:    uint32(pos),
+			flags:     ev.flags,
+		}
+		buf = append(buf, encodeBinlogEvent(h, ev.body, f.checksum)...)
+	}
+
+	_, err := out.Write(buf)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Truncate(int64(f.size))
+		return fmt.Errorf("Binlog/write: %s: %v", f.name, err)
+	}
+	f.size = pos
+
+	close(this.appended)
+	this.appended = make(chan struct{})
+	return nil
+}
+
+func (this *binlog) current() *binlogFile {
+	return this.files[len(this.files)-1]
+}
+
+// rotateEvent points to the file after the last one
+func (this *binlog) rotateEvent() binlogEvent {
+	next := filepath.Base(fmt.Sprintf("%s.%06d", this.base, this.index+1))
+	return binlogEvent{typ: binlogRotateEvent, body: rotateBody(uint64(len(binlogMagic)), next)}
+}
+
+// rotate ends the current file with a ROTATE event and continues in a new one, as
+// FLUSH BINARY LOGS does
+func (this *binlog) rotate() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	if this.rotated {
+		// The current file already ends with a ROTATE event
+		return this.reopen(now)
+	} else if this.out == nil {
+		return errBinlogClosed
+	}
+	return this.rotateFile(now)
+}
+
+// rotateFile switches to a new file, then removes the files that have expired
+func (this *binlog) rotateFile(now time.Time) error {
+	f := this.current()
+	if err := this.write(this.out, f, now, []binlogEvent{this.rotateEvent()}); err != nil {
+		return err
+	}
+	f.closed = true
+
+	this.out.Close()
+	this.out = nil
+	this.rotated = true
+
+	return this.reopen(now)
+}
+
+// reopen starts the file that the ROTATE event at the end of the current one
+// points to, if it hasn't been yet, then removes the files that have expired
+func (this *binlog) reopen(now time.Time) error {
+	if !this.rotated {
+		return nil
+	}
+
+	if err := this.openFile(now, false); err != nil {
+		return err
+	}
+	this.rotated = false
+
+	return this.purgeExpired(now)
+}
+
+// purgeExpired removes the oldest files last written more than
+// binlog_expire_logs_seconds ago. The file being written is always kept, and so are
+// the ones from the oldest file a dump is reading on.
+// http://dev.mysql.com/doc/refman/8.0/en/replication-options-binary-log.html#sysvar_binlog_expire_logs_seconds
+func (this *binlog) purgeExpired(now time.Time) error {
+	secs, _ := this.vars.get("binlog_expire_logs_seconds")
+	if secs == 0 {
+		return nil
+	}
+
+	n := 0
+	for ; n < len(this.files)-1; n++ {
+		f := this.files[n]
+		if this.readers[f.name] > 0 {
+			break
+		}
+
+		fi, err := os.Stat(f.path)
+		if err != nil {
+			glog.Warningf("Binlog/purgeExpired: %v", err)
+			continue
+		}
+		if fi.ModTime().Add(time.Duration(secs) * time.Second).After(now) {
+			break
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			glog.Warningf("Binlog/purgeExpired: %v", err)
+			break
+		}
+		glog.V(2).Infof("Binlog/purgeExpired: Removed %s", f.path)
+	}
+
+	if n == 0 {
+		return nil
+	}
+	this.files = append([]*binlogFile(nil), this.files[n:]...)
+	return this.writeIndex()
+}
+
+// addReader records that a dump is reading file name, so it isn't purged
+func (this *binlog) addReader(name string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.readers[name]++
+}
+
+// removeReader records that a dump is done with file name
+func (this *binlog) removeReader(name string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.readers[name]--; this.readers[name] <= 0 {
+		delete(this.readers, name)
+	}
+}
+
+// close closes the file being written. Nothing can be logged after that.
+func (this *binlog) close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.out != nil {
+		this.out.Close()
+		this.out = nil
+	}
+	this.rotated = false
+}
+
+// commit writes a transaction as number gno+1, preceded by its GTID event. The log
+// moves on to a new file once the current one reaches max_binlog_size.
+func (this *binlog) commit(events []binlogEvent) error {
+	now := time.Now()
+	if err := this.reopen(now); err != nil {
+		return err
+	} else if this.out == nil {
+		return errBinlogClosed
+	}
+
+	f := this.current()
+	gno := this.gno + 1
+	sequence := f.sequence + 1
+
+	gtid := binlogEvent{typ: binlogGTIDEvent, body: gtidBody(this.sid, gno, sequence-1, sequence)}
+	if err := this.write(this.out, f, now, append([]binlogEvent{gtid}, events...)); err != nil {
+		return err
+	}
+	this.gno = gno
+	f.sequence = sequence
+
+	// The transaction is in the log even if the next file can't be started, which
+	// is tried again with the next one
+	if max, _ := this.vars.get("max_binlog_size"); f.size >= max {
+		if err := this.rotateFile(now); err != nil {
+			glog.Errorf("Binlog/commit: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (this *binlog) logStatement(schema, sql string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.commit([]binlogEvent{{typ: binlogQueryEvent, body: queryBody(0, schema, sql)}})
+}
+
+// logRows writes a transaction made of a TABLE_MAP event for each table and rows
+// events for the changes. Nothing is written if any of the changes can't be
+// encoded.
+func (this *binlog) logRows(changes []RowChange) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	events := []binlogEvent{{typ: binlogQueryEvent, body: queryBody(0, "", "BEGIN")}}
+	mapped := make(map[string]bool)
+
+	for i := 0; i < len(changes); {
+		c := &changes[i]
+		typ, err := rowChangeType(c)
+		if err != nil {
+			return err
+		}
+
+		// Changes of the same kind to the same table share an event
+		j := i + 1
+		for j < len(changes) && changes[j].Schema == c.Schema && changes[j].Table == c.Table {
+			if t, _ := rowChangeType(&changes[j]); t != typ {
+				break
+			}
+			j++
+		}
+
+		cols := make([]*binlogColumn, len(c.Columns))
+		for k := range c.Columns {
+			if cols[k], err = newBinlogColumn(&c.Columns[k]); err != nil {
+				return err
+			}
+		}
+
+		key := c.Schema + "." + c.Table
+		id, ok := this.tableIDs[key]
+		if !ok {
+			id = uint64(len(this.tableIDs) + 1)
+			this.tableIDs[key] = id
+		}
+		if !mapped[key] {
+			events = append(events, binlogEvent{typ: binlogTableMapEvent, body: tableMapBody(id, c.Schema, c.Table, cols)})
+			mapped[key] = true
+		}
+
+		var rows [][]interface{}
+		images := 1
+		for _, change := range changes[i:j] {
+			switch typ {
+			case binlogWriteRowsEvent:
+				rows = append(rows, change.After)
+			case binlogDeleteRowsEvent:
+				rows = append(rows, change.Before)
+			case binlogUpdateRowsEvent:
+				rows = append(rows, change.Before, change.After)
+				images = 2
+			}
+		}
+
+		// Replicas drop their table maps at the end of a statement
+		var flags uint16
+		if j == len(changes) {
+			flags = rowsStmtEnd
+		}
+
+		body, err := rowsBody(id, flags, cols, images, rows)
+		if err != nil {
+			return fmt.Errorf("Binlog/logRows: %s: %v", key, err)
+		}
+		events = append(events, binlogEvent{typ: typ, body: body})
+
+		i = j
+	}
+
+	this.xid++
+	events = append(events, binlogEvent{typ: binlogXIDEvent, body: xidBody(this.xid)})
+
+	return this.commit(events)
+}
+
+func rowChangeType(c *RowChange) (binlogEventType, error) {
+	switch {
+	case c.Before == nil && c.After != nil:
+		return binlogWriteRowsEvent, nil
+	case c.Before != nil && c.After == nil:
+		return binlogDeleteRowsEvent, nil
+	case c.Before != nil && c.After != nil:
+		return binlogUpdateRowsEvent, nil
+	}
+	return 0, fmt.Errorf("Binlog/logRows: Change to %s.%s has neither a before nor an after image", c.Schema, c.Table)
+}
+
+func (this *binlog) file(name string) *binlogFile {
+	for _, f := range this.files {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// fileInfo returns a copy of file name, which can be used without holding the lock
+func (this *binlog) fileInfo(name string) (binlogFile, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	f := this.file(name)
+	if f == nil {
+		return binlogFile{}, false
+	}
+	return *f, true
+}
+
+// firstFile returns the name of the oldest file
+func (this *binlog) firstFile() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.files[0].name
+}
+
+// nextFile returns the name of the file after name, if there is one
+func (this *binlog) nextFile(name string) string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i, f := range this.files[:len(this.files)-1] {
+		if f.name == name {
+			return this.files[i+1].name
+		}
+	}
+	return ""
+}
+
+// logs returns the names and sizes of all files, oldest first
+func (this *binlog) logs() []binlogFile {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	files := make([]binlogFile, len(this.files))
+	for i, f := range this.files {
+		files[i] = *f
+	}
+	return files
+}
+
+// formatDescription returns the format description event that starts file name
+func (this *binlog) formatDescription(name string) ([]byte, error) {
+	f, ok := this.fileInfo(name)
+	if !ok {
+		return nil, fmt.Errorf("Could not find first log file name in binary log index file")
+	}
+
+	var fde []byte
+	_, err := scanBinlog(f.path, uint64(len(binlogMagic)), f.size, func(pos uint64, ev []byte) error {
+		fde = ev
+		return io.EOF
+	})
+	if err != nil || fde == nil {
+		return nil, fmt.Errorf("Could not open log file")
+	}
+
+	return fde, nil
+}
+
+// checkPosition returns an error unless an event of file name starts at pos, or pos
+// is the end of the file
+func (this *binlog) checkPosition(name string, pos uint64) error {
+	f, ok := this.fileInfo(name)
+	if !ok {
+		return fmt.Errorf("Could not find first log file name in binary log index file")
+	}
+	if pos > f.size {
+		return fmt.Errorf("Client requested master to start replication from position > file size")
+	}
+
+	end, err := scanBinlog(f.path, uint64(len(binlogMagic)), pos, func(uint64, []byte) error { return nil })
+	if err != nil {
+		return fmt.Errorf("Could not open log file")
+	}
+	if end != pos {
+		return fmt.Errorf("Client requested master to start replication from impossible position")
+	}
+
+	return nil
+}
+
+// read returns whole events of file name from pos on, whether pos is the end of a
+// file that is closed, and a channel that is closed once more events are added to
+// the log. It returns at most binlogReadSize bytes, unless the event at pos is
+// larger than that.
+func (this *binlog) read(name string, pos uint64) ([]byte, bool, <-chan struct{}, error) {
+	this.mu.Lock()
+	f := this.file(name)
+	if f == nil {
+		this.mu.Unlock()
+		return nil, false, nil, fmt.Errorf("Could not open log file")
+	}
+	path, size, closed, appended := f.path, f.size, f.closed, this.appended
+	this.mu.Unlock()
+
+	if pos >= size {
+		return nil, closed, appended, nil
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, false, nil, fmt.Errorf("Could not open log file")
+	}
+	defer r.Close()
+
+	n := size - pos
+	if n > binlogReadSize {
+		n = binlogReadSize
+	}
+	data := make([]byte, n)
+	if _, err := r.ReadAt(data, int64(pos)); err != nil {
+		return nil, false, nil, fmt.Errorf("I/O error reading log event")
+	}
+
+	end := 0
+	for end+binlogHeaderSize <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[end+9:]))
+		if end+size > len(data) {
+			break
+		}
+		end += size
+	}
+
+	if end == 0 {
+		data = make([]byte, binary.LittleEndian.Uint32(data[9:]))
+		if _, err := r.ReadAt(data, int64(pos)); err != nil {
+			return nil, false, nil, fmt.Errorf("I/O error reading log event")
+		}
+		end = len(data)
+	}
+
+	return data[:end], false, appended, nil
+}
+
+// firstFileFor returns the newest file that only has transactions before it that are
+// in gtids, where a replica that has gtids starts reading
+func (this *binlog) firstFileFor(gtids gtidSet) (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i := len(this.files) - 1; i >= 0; i-- {
+		if gtids.containsUpTo(this.sid, this.files[i].prevGno) {
+			return this.files[i].name, nil
+		}
+	}
+	return "", fmt.Errorf("The slave is connecting using CHANGE MASTER TO MASTER_AUTO_POSITION = 1, but the master has purged binary logs containing GTIDs that the slave requires.")
+}
+
+// status returns the file being written, its size, and the GTIDs logged so far
+func (this *binlog) status() (string, uint64, string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	f := this.current()
+
+	var executed string
+	switch this.gno {
+	case 0:
+	case 1:
+		executed = formatUUID(this.sid) + ":1"
+	default:
+		executed = fmt.Sprintf("%s:1-%d", formatUUID(this.sid), this.gno)
+	}
+
+	return f.name, f.size, executed
+}
+
+// scanBinlog calls fn with each whole event of the file at path that lies between
+// pos and end, and returns where the last of them ends. fn stops the scan by
+// returning io.EOF.
+func scanBinlog(path string, pos, end uint64, fn func(pos uint64, ev []byte) error) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return pos, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(io.NewSectionReader(file, int64(pos), int64(end-pos)))
+	header := make([]byte, binlogHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return pos, nil
+		} else if err != nil {
+			return pos, err
+		}
+
+		size := binary.LittleEndian.Uint32(header[9:])
+		if size < binlogHeaderSize {
+			return pos, fmt.Errorf("Invalid event size %d at %d", size, pos)
+		}
+
+		ev := make([]byte, size)
+		copy(ev, header)
+		if _, err := io.ReadFull(r, ev[binlogHeaderSize:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return pos, nil
+		} else if err != nil {
+			return pos, err
+		}
+
+		err := fn(pos, ev)
+		pos += uint64(size)
+		if err == io.EOF {
+			return pos, nil
+		} else if err != nil {
+			return pos, err
+		}
+	}
+}
+
+// binlogFileChecksum returns whether the events of the file that starts with
+// format description event fde end with a checksum
+func binlogFileChecksum(fde []byte) bool {
+	return fde[len(fde)-binlogChecksumSize-1] == binlogChecksumCRC32
+}
+
+// binlogEventBody returns the part of ev after the header, without the checksum
+func binlogEventBody(ev []byte, checksum bool) []byte {
+	if checksum || binlogEventType(ev[4]) == binlogFormatDescriptionEvent {
+		return ev[binlogHeaderSize : len(ev)-binlogChecksumSize]
+	}
+	return ev[binlogHeaderSize:]
+}
@@ -0,0 +1,594 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendDecimal(t *testing.T) {
+	// Examples from MySQL's strings/decimal.c
+	tests := []struct {
+		s                string
+		precision, scale int
+		expected         []byte
+	}{
+		{"1234567890.1234", 14, 4, []byte{0x81, 0x0d, 0xfb, 0x38, 0xd2, 0x04, 0xd2}},
+		{"-1234567890.1234", 14, 4, []byte{0x7e, 0xf2, 0x04, 0xc7, 0x2d, 0xfb, 0x2d}},
+		{"0", 5, 2, []byte{0x80, 0x00, 0x00}},
+		{"-0.00", 5, 2, []byte{0x80, 0x00, 0x00}},
+		{"1.5", 5, 2, []byte{0x80, 0x01, 0x32}},
+	}
+
+	for _, test := range tests {
+		b, err := appendDecimal(nil, test.s, test.precision, test.scale)
+		if err != nil || !bytes.Equal(b, test.expected) {
+			t.Errorf("%s as DECIMAL(%d,%d): Expecting % x, got % x, %v", test.s, test.precision, test.scale, test.expected, b, err)
+		}
+	}
+
+	for _, s := range []string{"123456", "1.2.3", "abc", ""} {
+		if _, err := appendDecimal(nil, s, 5, 2); err == nil {
+			t.Errorf("Expecting an error for %q", s)
+		}
+	}
+}
+
+func TestRowImage(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: TypeLong, NotNull: true},
+		{Name: "name", Type: TypeVarChar, Length: 10},
+		{Name: "created", Type: TypeDateTime},
+		{Name: "at", Type: TypeTime},
+	}
+
+	var cols []*binlogColumn
+	for i := range columns {
+		col, err := newBinlogColumn(&columns[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols = append(cols, col)
+	}
+
+	created := time.Date(2013, 7, 1, 12, 30, 15, 0, time.UTC)
+	b, err := appendRowImage(nil, cols, []interface{}{-2, "ab", created, -time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{0x00, 0xfe, 0xff, 0xff, 0xff, 2, 'a', 'b'}
+	expected = appendUintBE(expected, uint64(2013*13+7)<<22|1<<17|12<<12|30<<6|15|1<<39, 5)
+	expected = append(expected, 0x7f, 0xf0, 0x00)
+	if !bytes.Equal(b, expected) {
+		t.Errorf("Expecting % x, got % x", expected, b)
+	}
+
+	if b, err = appendRowImage(nil, cols, []interface{}{1, nil, nil, nil}); err != nil || !bytes.Equal(b, []byte{0x0e, 1, 0, 0, 0}) {
+		t.Errorf("Expecting NULLs, got % x, %v", b, err)
+	}
+
+	if _, err := appendRowImage(nil, cols, []interface{}{nil, nil, nil, nil}); err == nil {
+		t.Errorf("Expecting an error for NULL in a NOT NULL column")
+	}
+	if _, err := appendRowImage(nil, cols, []interface{}{1, "more than thirty bytes, which is too long", nil, nil}); err == nil {
+		t.Errorf("Expecting an error for a value that is too long")
+	}
+}
+
+// readBinlogEvent reads an event sent by dumpBinlog, checking its size and checksum
+func (this *rawClient) readBinlogEvent(t *testing.T) []byte {
+	p, err := this.readPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p[0] != okPacket {
+		t.Fatalf("Expecting an event, got %q", p)
+	}
+
+	ev := p[1:]
+	if size := binary.LittleEndian.Uint32(ev[9:]); int(size) != len(ev) {
+		t.Fatalf("Event of %d bytes has size %d", len(ev), size)
+	}
+
+	n := len(ev) - binlogChecksumSize
+	if sum := binary.LittleEndian.Uint32(ev[n:]); sum != crc32.ChecksumIEEE(ev[:n]) {
+		t.Errorf("Wrong checksum for event type %d", ev[4])
+	}
+
+	return ev
+}
+
+func TestBinlogDump(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.LogBin = filepath.Join(t.TempDir(), "binlog")
+	cfg.ServerID = 7
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "repl", Password: "p", Privileges: []string{"REPLICATION SLAVE", "REPLICATION CLIENT", "RELOAD"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	columns := []Column{
+		{Name: "id", Type: TypeLong, NotNull: true},
+		{Name: "name", Type: TypeVarChar, Length: 10},
+	}
+
+	if err := s.LogStatement("test", "CREATE TABLE t (id INT NOT NULL, name VARCHAR(10))"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LogRows(
+		RowChange{Schema: "test", Table: "t", Columns: columns, After: []interface{}{1, "ab"}},
+		RowChange{Schema: "test", Table: "t", Columns: columns, Before: []interface{}{1, "ab"}, After: []interface{}{1, "cd"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LogRows(RowChange{Schema: "test", Table: "t", Columns: columns, After: []interface{}{"x", "ab"}}); err == nil {
+		t.Errorf("Expecting an error for a bad value")
+	}
+
+	login := func(user string) *rawClient {
+		c, p := dialRawWith(t, s, rawLogin{user: user, password: "p"})
+		if p[0] != okPacket {
+			t.Fatalf("Handshake failed: %q", p)
+		}
+		return c
+	}
+
+	u := login("u")
+	defer u.Close()
+
+	register := []byte{2, 0, 0, 0, 2, 'r', '1', 0, 0, 0xea, 0x0c, 0, 0, 0, 0, 7, 0, 0, 0}
+	if p, err := u.command(comRegisterSlave, register); err != nil || errCode(p) != 1227 {
+		t.Errorf("Expecting ER_SPECIFIC_ACCESS_DENIED_ERROR, got %q, %v", p, err)
+	}
+
+	repl := login("repl")
+	defer repl.Close()
+
+	// What a replica asks before it starts reading
+	sid, _ := parseServerUUID("", 7)
+	if p, err := repl.command(comComQuery, []byte("SET @master_binlog_checksum= @@global.binlog_checksum")); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+	for q, expected := range map[string]string{
+		"SELECT @master_binlog_checksum":               "CRC32",
+		"SELECT @@GLOBAL.SERVER_ID":                    "7",
+		"SELECT @@GLOBAL.SERVER_UUID":                  formatUUID(sid),
+		"SELECT @@GLOBAL.GTID_MODE":                    "ON",
+		"SHOW VARIABLES LIKE 'binlog_format'":          "ROW",
+		"SHOW GLOBAL VARIABLES LIKE 'binlog_checksum'": "CRC32",
+	} {
+		rows, err := repl.query(q)
+		if err != nil || len(rows) != 1 || rows[0][len(rows[0])-1] != expected {
+			t.Errorf("%s: expecting %s, got %q, %v", q, expected, rows, err)
+		}
+	}
+	if p, err := repl.command(comComQuery, []byte("SET GLOBAL server_id = 8")); err != nil || errCode(p) != 1238 {
+		t.Errorf("Expecting ER_INCORRECT_GLOBAL_LOCAL_VAR, got %q, %v", p, err)
+	}
+
+	if p, err := repl.command(comRegisterSlave, register); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+
+	if rows, err := repl.query("SHOW SLAVE HOSTS"); err != nil || len(rows) != 1 || rows[0][0] != "2" || rows[0][1] != "r1" || rows[0][2] != "3306" || rows[0][3] != "7" {
+		t.Errorf("Expecting the replica, got %q, %v", rows, err)
+	}
+
+	if p, err := repl.command(comBinlogDump, []byte{4, 0, 0, 0}); err != nil || errCode(p) != 1835 {
+		t.Errorf("Expecting ER_MALFORMED_PACKET, got %q, %v", p, err)
+	}
+
+	// Read everything so far without blocking
+	dump := append([]byte{4, 0, 0, 0, byte(binlogDumpNonBlock), 0, 2, 0, 0, 0}, "binlog.000001"...)
+	repl.seq = 0
+	if err := repl.writePacket(append([]byte{byte(comBinlogDump)}, dump...)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []binlogEventType{
+		binlogRotateEvent, binlogFormatDescriptionEvent, binlogPreviousGTIDsEvent,
+		binlogGTIDEvent, binlogQueryEvent,
+		binlogGTIDEvent, binlogQueryEvent, binlogTableMapEvent, binlogWriteRowsEvent, binlogUpdateRowsEvent, binlogXIDEvent,
+	}
+
+	pos := uint32(len(binlogMagic))
+	var events [][]byte
+	for i, typ := range expected {
+		ev := repl.readBinlogEvent(t)
+		events = append(events, ev)
+		if binlogEventType(ev[4]) != typ {
+			t.Fatalf("Event %d: Expecting type %d, got %d", i, typ, ev[4])
+		}
+		if serverID := binary.LittleEndian.Uint32(ev[5:]); serverID != 7 {
+			t.Errorf("Event %d: Expecting server id 7, got %d", i, serverID)
+		}
+
+		if i == 0 {
+			// The artificial ROTATE says where the dump starts
+			if binary.LittleEndian.Uint32(ev[13:]) != 0 || string(ev[binlogHeaderSize+8:len(ev)-4]) != "binlog.000001" {
+				t.Errorf("Unexpected ROTATE event % x", ev)
+			}
+			continue
+		}
+
+		pos += uint32(len(ev))
+		if logPos := binary.LittleEndian.Uint32(ev[13:]); logPos != pos {
+			t.Errorf("Event %d: Expecting log position %d, got %d", i, pos, logPos)
+		}
+	}
+
+	if p, err := repl.readPacket(); err != nil || p[0] != eofPacket {
+		t.Fatalf("Expecting EOF, got %q, %v", p, err)
+	}
+
+	if query := events[4][binlogHeaderSize+13+5 : len(events[4])-4]; string(query) != "CREATE TABLE t (id INT NOT NULL, name VARCHAR(10))" {
+		t.Errorf("Unexpected query %q", query)
+	}
+	if rows := events[8]; !bytes.HasSuffix(rows[:len(rows)-4], []byte{0x00, 1, 0, 0, 0, 2, 'a', 'b'}) {
+		t.Errorf("Unexpected WRITE_ROWS event % x", rows)
+	}
+	if flags := binary.LittleEndian.Uint16(events[9][binlogHeaderSize+6:]); flags != rowsStmtEnd {
+		t.Errorf("Expecting the last rows event to end the statement, got flags %d", flags)
+	}
+
+	if rows, err := repl.query("SHOW MASTER STATUS"); err != nil || len(rows) != 1 || rows[0][0] != "binlog.000001" || rows[0][1] != fmt.Sprint(pos) || rows[0][4] != formatUUID(sid)+":1-2" {
+		t.Errorf("Unexpected master status %q, %v", rows, err)
+	}
+	if rows, err := u.query("SHOW MASTER STATUS"); err == nil {
+		t.Errorf("Expecting an access error for SHOW MASTER STATUS, got %q", rows)
+	}
+
+	// A replica that doesn't say it handles checksums gets the events without them
+	plain := login("repl")
+	defer plain.Close()
+	plain.seq = 0
+	if err := plain.writePacket(append([]byte{byte(comBinlogDump)}, dump...)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		p, err := plain.readPacket()
+		if err != nil || p[0] != okPacket {
+			t.Fatalf("Expecting an event, got %q, %v", p, err)
+		}
+
+		ev, n := p[1:], len(events[i])-binlogChecksumSize
+		switch {
+		case binlogEventType(ev[4]) == binlogFormatDescriptionEvent:
+			if len(ev) != len(events[i]) || ev[n-1] != binlogChecksumNone {
+				t.Errorf("Expecting the format description to turn off checksums, got % x", ev)
+			}
+		case !bytes.Equal(ev[binlogHeaderSize:], events[i][binlogHeaderSize:n]) || binary.LittleEndian.Uint32(ev[9:]) != uint32(n):
+			t.Errorf("Event %d: Expecting % x without its checksum, got % x", i, events[i], ev)
+		}
+	}
+	if p, err := plain.readPacket(); err != nil || p[0] != eofPacket {
+		t.Fatalf("Expecting EOF, got %q, %v", p, err)
+	}
+
+	// Starting at a position that isn't an event
+	repl.seq = 0
+	if p, err := repl.command(comBinlogDump, append([]byte{5, 0, 0, 0, 0, 0, 2, 0, 0, 0}, "binlog.000001"...)); err != nil || errCode(p) != 1236 {
+		t.Errorf("Expecting ER_MASTER_FATAL_ERROR_READING_BINLOG, got %q, %v", p, err)
+	}
+
+	// Follow the log live, already having the first transaction
+	if _, err := repl.command(comComQuery, []byte("SET @master_heartbeat_period = 50000000")); err != nil {
+		t.Fatal(err)
+	}
+
+	gtids := binary.LittleEndian.AppendUint64(nil, 1)
+	gtids = append(gtids, sid[:]...)
+	gtids = binary.LittleEndian.AppendUint64(gtids, 1)
+	gtids = binary.LittleEndian.AppendUint64(gtids, 1)
+	gtids = binary.LittleEndian.AppendUint64(gtids, 2)
+
+	dumpGTID := binary.LittleEndian.AppendUint16(nil, binlogDumpThroughGTID)
+	dumpGTID = binary.LittleEndian.AppendUint32(dumpGTID, 2)
+	dumpGTID = binary.LittleEndian.AppendUint32(dumpGTID, 0)
+	dumpGTID = binary.LittleEndian.AppendUint64(dumpGTID, 4)
+	dumpGTID = binary.LittleEndian.AppendUint32(dumpGTID, uint32(len(gtids)))
+	dumpGTID = append(dumpGTID, gtids...)
+
+	repl.seq = 0
+	if err := repl.writePacket(append([]byte{byte(comBinlogDumpGTID)}, dumpGTID...)); err != nil {
+		t.Fatal(err)
+	}
+
+	readTypes := func(types ...binlogEventType) {
+		for _, typ := range types {
+			ev := repl.readBinlogEvent(t)
+			if binlogEventType(ev[4]) != typ {
+				t.Fatalf("Expecting type %d, got %d", typ, ev[4])
+			}
+		}
+	}
+
+	// The CREATE TABLE is left out
+	readTypes(binlogRotateEvent, binlogFormatDescriptionEvent, binlogPreviousGTIDsEvent,
+		binlogGTIDEvent, binlogQueryEvent, binlogTableMapEvent, binlogWriteRowsEvent, binlogUpdateRowsEvent, binlogXIDEvent)
+
+	readTypes(binlogHeartbeatEvent)
+
+	if err := s.LogRows(RowChange{Schema: "test", Table: "t", Columns: columns, Before: []interface{}{1, "cd"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		ev := repl.readBinlogEvent(t)
+		if binlogEventType(ev[4]) != binlogHeartbeatEvent {
+			if binlogEventType(ev[4]) != binlogGTIDEvent {
+				t.Fatalf("Expecting GTID event, got %d", ev[4])
+			}
+			break
+		}
+	}
+	readTypes(binlogQueryEvent, binlogTableMapEvent, binlogDeleteRowsEvent, binlogXIDEvent)
+
+	// FLUSH BINARY LOGS moves on to the next file
+	admin := login("repl")
+	defer admin.Close()
+	if p, err := admin.command(comComQuery, []byte("FLUSH BINARY LOGS")); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+
+	for {
+		ev := repl.readBinlogEvent(t)
+		if binlogEventType(ev[4]) != binlogHeartbeatEvent {
+			if binlogEventType(ev[4]) != binlogRotateEvent || string(ev[binlogHeaderSize+8:len(ev)-4]) != "binlog.000002" {
+				t.Fatalf("Expecting ROTATE to binlog.000002, got % x", ev)
+			}
+			break
+		}
+	}
+	readTypes(binlogFormatDescriptionEvent, binlogPreviousGTIDsEvent)
+
+	size := uint64(len(binlogMagic) + len(events[1]) + binlogEventSize(len(previousGTIDsBody(sid, 3)), binlogPreviousGTIDsEvent, true))
+	if name, pos, executed := s.binlog.status(); name != "binlog.000002" || pos != size || executed != formatUUID(sid)+":1-3" {
+		t.Errorf("Unexpected status %s, %d, %s", name, pos, executed)
+	}
+}
+
+func TestBinlogFiles(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.LogBin = filepath.Join(t.TempDir(), "binlog")
+	cfg.MaxBinlogSize = 4096
+
+	s, stop := startTestServer(t, cfg)
+
+	columns := []Column{
+		{Name: "id", Type: TypeLong, NotNull: true},
+		{Name: "name", Type: TypeVarChar, Length: 1000},
+	}
+	insert := func(s *Server, id int) {
+		if err := s.LogRows(RowChange{Schema: "test", Table: "t", Columns: columns, After: []interface{}{id, strings.Repeat("x", 1000)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Four transactions of over 1000 bytes fill the first file
+	for i := 1; i <= 5; i++ {
+		insert(s, i)
+	}
+
+	first, second := cfg.LogBin+".000001", cfg.LogBin+".000002"
+	if index, err := os.ReadFile(cfg.LogBin + ".index"); err != nil || string(index) != first+"\n"+second+"\n" {
+		t.Errorf("Unexpected index %q, %v", index, err)
+	}
+
+	c := dialRaw(t, s, "root")
+	defer c.Close()
+
+	rows, err := c.query("SHOW BINARY LOGS")
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("Expecting two files, got %q, %v", rows, err)
+	}
+	for i, path := range []string{first, second} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows[i][0] != filepath.Base(path) || rows[i][1] != fmt.Sprint(fi.Size()) {
+			t.Errorf("Expecting %s of %d bytes, got %q", path, fi.Size(), rows[i])
+		}
+	}
+
+	sid := s.binlog.sid
+	if rows, err := c.query("SHOW BINLOG EVENTS LIMIT 1"); err != nil || len(rows) != 1 || rows[0][0] != "binlog.000001" || rows[0][1] != "4" || rows[0][2] != "Format_desc" || rows[0][5] != "Server ver: 5.7.0-qld, Binlog ver: 4" {
+		t.Errorf("Expecting the format description, got %q, %v", rows, err)
+	}
+
+	rows, err = c.query("SHOW BINLOG EVENTS IN 'binlog.000002'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][2]string{
+		{"Format_desc", "Server ver: 5.7.0-qld, Binlog ver: 4"},
+		{"Previous_gtids", formatUUID(sid) + ":1-4"},
+		{"Gtid", "SET @@SESSION.GTID_NEXT= '" + formatUUID(sid) + ":5'"},
+		{"Query", "BEGIN"},
+		{"Table_map", "table_id: 1 (test.t)"},
+		{"Write_rows", "table_id: 1 flags: STMT_END_F"},
+		{"Xid", "COMMIT /* xid=5 */"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("Expecting %d events, got %q", len(expected), rows)
+	}
+	for i, row := range rows {
+		if row[2] != expected[i][0] || row[5] != expected[i][1] || row[3] != "1" {
+			t.Errorf("Expecting %q, got %q", expected[i], row)
+		}
+		if i > 0 && row[1] != rows[i-1][4] {
+			t.Errorf("Event at %s follows one that ends at %s", row[1], rows[i-1][4])
+		}
+	}
+
+	if r, err := c.query("SHOW BINLOG EVENTS IN 'binlog.000002' FROM " + rows[2][1] + " LIMIT 1, 2"); err != nil || len(r) != 2 || r[0][2] != "Query" || r[1][2] != "Table_map" {
+		t.Errorf("Expecting two events, got %q, %v", r, err)
+	}
+	for _, q := range []string{"SHOW BINLOG EVENTS FROM 5", "SHOW BINLOG EVENTS IN 'binlog.000009'"} {
+		if _, err := c.query(q); err == nil || err.(*SQLError).Code != 1220 {
+			t.Errorf("%s: expecting ER_ERROR_WHEN_EXECUTING_COMMAND, got %v", q, err)
+		}
+	}
+
+	c.Close()
+	stop()
+
+	if err := s.LogRows(RowChange{Schema: "test", Table: "t", Columns: columns, After: []interface{}{6, ""}}); err != errBinlogClosed {
+		t.Errorf("Expecting errBinlogClosed, got %v", err)
+	}
+
+	// A partly written event at the end of the last file is cut off after a restart,
+	// and the first file has expired
+	f, err := os.OpenFile(second, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(first, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.BinlogExpireLogsSeconds = 3600
+	s, stop = startTestServer(t, cfg)
+	defer stop()
+
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("Expecting %s to be removed, got %v", first, err)
+	}
+
+	insert(s, 6)
+
+	c = dialRaw(t, s, "root")
+	defer c.Close()
+
+	if rows, err := c.query("SHOW BINARY LOGS"); err != nil || len(rows) != 2 || rows[0][0] != "binlog.000002" || rows[1][0] != "binlog.000003" {
+		t.Errorf("Expecting the second and third file, got %q, %v", rows, err)
+	}
+
+	rows, err = c.query("SHOW BINLOG EVENTS IN 'binlog.000002'")
+	if err != nil || len(rows) != len(expected)+1 || rows[len(rows)-1][2] != "Rotate" || rows[len(rows)-1][5] != "binlog.000003;pos=4" {
+		t.Errorf("Expecting the second file to end with a ROTATE event, got %q, %v", rows, err)
+	}
+
+	if rows, err := c.query("SHOW MASTER STATUS"); err != nil || len(rows) != 1 || rows[0][0] != "binlog.000003" || rows[0][4] != formatUUID(sid)+":1-6" {
+		t.Errorf("Expecting transactions 1 to 6, got %q, %v", rows, err)
+	}
+}
+
+func TestBinlogPurgeReading(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.LogBin = filepath.Join(t.TempDir(), "binlog")
+	cfg.BinlogExpireLogsSeconds = 3600
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		if err := s.binlog.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := cfg.LogBin+".000001", cfg.LogBin+".000002"
+	expire := func() {
+		old := time.Now().Add(-2 * time.Hour)
+		for _, path := range []string{first, second} {
+			if err := os.Chtimes(path, old, old); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+		}
+		if err := s.binlog.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dump reading the second file keeps it and the ones after it
+	s.binlog.addReader("binlog.000002")
+	expire()
+
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("Expecting %s to be removed, got %v", first, err)
+	}
+	if _, err := os.Stat(second); err != nil {
+		t.Errorf("Expecting %s to be kept, got %v", second, err)
+	}
+
+	s.binlog.removeReader("binlog.000002")
+	expire()
+
+	if _, err := os.Stat(second); !os.IsNotExist(err) {
+		t.Errorf("Expecting %s to be removed, got %v", second, err)
+	}
+	if len(s.binlog.readers) != 0 {
+		t.Errorf("Expecting no readers, got %v", s.binlog.readers)
+	}
+}
+
+func TestBinlogRotateFailure(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.LogBin = filepath.Join(t.TempDir(), "binlog")
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	// Something in the way of the second file
+	first, second := cfg.LogBin+".000001", cfg.LogBin+".000002"
+	if err := os.Mkdir(second, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.binlog.rotate(); err == nil {
+		t.Errorf("Expecting the rotation to fail")
+	}
+	if err := s.LogStatement("test", "CREATE TABLE t (id INT)"); err == nil {
+		t.Errorf("Expecting logging to fail")
+	}
+	if index, err := os.ReadFile(cfg.LogBin + ".index"); err != nil || string(index) != first+"\n" {
+		t.Errorf("Expecting only the first file in the index, got %q, %v", index, err)
+	}
+
+	// Logging carries on in the second file once it can be started
+	if err := os.Remove(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LogStatement("test", "CREATE TABLE t (id INT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialRaw(t, s, "root")
+	defer c.Close()
+
+	rows, err := c.query("SHOW BINLOG EVENTS IN 'binlog.000001'")
+	if err != nil || len(rows) != 3 || rows[2][5] != "binlog.000002;pos=4" {
+		t.Errorf("Expecting the first file to end with a ROTATE event, got %q, %v", rows, err)
+	}
+
+	rows, err = c.query("SHOW BINLOG EVENTS IN 'binlog.000002'")
+	if err != nil || len(rows) != 4 || rows[3][5] != "use `test`; CREATE TABLE t (id INT)" {
+		t.Errorf("Expecting the statement in the second file, got %q, %v", rows, err)
+	}
+}
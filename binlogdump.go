@@ -0,0 +1,452 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/golang/glog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// While there is nothing new to send, replicas get a heartbeat this often unless
+// they set @master_heartbeat_period
+const defaultHeartbeatPeriod = 30 * time.Second
+
+// replicaInfo is what a replica tells about itself with COM_REGISTER_SLAVE
+type replicaInfo struct {
+	serverID uint32
+	host     string
+	port     uint16
+	masterID uint32
+	uuid     string
+}
+
+// replicas keeps the registered replicas by connection id, until their connection
+// ends
+type replicas struct {
+	mu sync.Mutex
+	m  map[uint32]replicaInfo
+}
+
+func newReplicas() *replicas {
+	return &replicas{m: make(map[uint32]replicaInfo)}
+}
+
+func (this *replicas) add(id uint32, r replicaInfo) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.m[id] = r
+}
+
+func (this *replicas) remove(id uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.m, id)
+}
+
+// list returns the replicas ordered by server id
+func (this *replicas) list() []replicaInfo {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var list []replicaInfo
+	for _, r := range this.m {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].serverID < list[j].serverID })
+	return list
+}
+
+// binlogError is the error replicas get when the log can't be read
+func binlogError(err error) error {
+	return newSQLError(1236, "Got fatal error 1236 from master when reading data from binary log: '%s'", err.Error())
+}
+
+// handleRegisterSlave answers COM_REGISTER_SLAVE, which replicas send before asking
+// for the binary log, so they show up in SHOW SLAVE HOSTS
+// http://dev.mysql.com/doc/internals/en/com-register-slave.html
+func (this *connection) handleRegisterSlave(payload []byte) error {
+	if err := this.checkPrivilege(privReplSlave, "REPLICATION SLAVE"); err != nil {
+		return err
+	}
+
+	/*
+		4              server-id
+		1              slaves hostname length
+		string[$len]   slaves hostname
+		1              slaves user len
+		string[$len]   slaves user
+		1              slaves password len
+		string[$len]   slaves password
+		2              slaves mysql-port
+		4              replication rank
+		4              master-id
+	*/
+	buf := bytes.NewBuffer(payload)
+	r := replicaInfo{}
+
+	next := func(n int) []byte {
+		b := buf.Next(n)
+		if len(b) < n {
+			return nil
+		}
+		return b
+	}
+
+	str := func() (string, bool) {
+		n, err := buf.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		s := buf.Next(int(n))
+		return string(s), len(s) == int(n)
+	}
+
+	id := next(4)
+	host, ok1 := str()
+	_, ok2 := str()
+	_, ok3 := str()
+	port := next(2)
+	if id == nil || !ok1 || !ok2 || !ok3 || port == nil {
+		return newSQLError(1835, "Malformed communication packet.")
+	}
+
+	r.serverID = binary.LittleEndian.Uint32(id)
+	r.host = host
+	r.port = binary.LittleEndian.Uint16(port)
+	if b := next(8); b != nil {
+		r.masterID = binary.LittleEndian.Uint32(b[4:])
+	}
+	if v, ok := this.userVars["slave_uuid"]; ok {
+		r.uuid = v.str
+	}
+
+	glog.V(3).Infof("Connection #%d registered as replica %d at %s:%d", this.id, r.serverID, r.host, r.port)
+	this.srv.replicas.add(this.id, r)
+
+	return this.writeOkPacket()
+}
+
+// handleBinlogDump answers COM_BINLOG_DUMP, streaming the binary log from a file
+// and position
+// http://dev.mysql.com/doc/internals/en/com-binlog-dump.html
+func (this *connection) handleBinlogDump(ctx context.Context, payload []byte) error {
+	/*
+		4              binlog-pos
+		2              flags
+		4              server-id
+		string[EOF]    binlog-filename
+	*/
+	if len(payload) < 10 {
+		return newSQLError(1835, "Malformed communication packet.")
+	}
+
+	pos := uint64(binary.LittleEndian.Uint32(payload))
+	flags := binary.LittleEndian.Uint16(payload[4:])
+	serverID := binary.LittleEndian.Uint32(payload[6:])
+	name := string(payload[10:])
+
+	return this.dumpBinlog(ctx, serverID, name, pos, flags, nil)
+}
+
+// handleBinlogDumpGTID answers COM_BINLOG_DUMP_GTID. The replica sends the GTIDs it
+// already has, and gets all the transactions it doesn't have.
+// http://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+func (this *connection) handleBinlogDumpGTID(ctx context.Context, payload []byte) error {
+	/*
+		2              flags
+		4              server-id
+		4              binlog-filename-len
+		string[len]    binlog-filename
+		8              binlog-pos
+		if flags & BINLOG_THROUGH_GTID {
+			4              data-size
+			string[len]    data
+		}
+	*/
+	malformed := newSQLError(1835, "Malformed communication packet.")
+	if len(payload) < 10 {
+		return malformed
+	}
+
+	flags := binary.LittleEndian.Uint16(payload)
+	serverID := binary.LittleEndian.Uint32(payload[2:])
+	n := uint64(binary.LittleEndian.Uint32(payload[6:]))
+	payload = payload[10:]
+	if uint64(len(payload)) < n+8 {
+		return malformed
+	}
+	payload = payload[n+8:]
+
+	gtids := make(gtidSet)
+	if flags&binlogDumpThroughGTID != 0 {
+		if len(payload) < 4 || uint64(len(payload)-4) < uint64(binary.LittleEndian.Uint32(payload)) {
+			return malformed
+		}
+
+		var err error
+		if gtids, err = parseGTIDSet(payload[4 : 4+binary.LittleEndian.Uint32(payload)]); err != nil {
+			return malformed
+		}
+	}
+
+	if this.srv.binlog == nil {
+		return binlogError(errBinlogClosed)
+	}
+
+	// The file and position the replica sent don't matter, it starts with the
+	// oldest file that has any transaction it's missing
+	name, err := this.srv.binlog.firstFileFor(gtids)
+	if err != nil {
+		return binlogError(err)
+	}
+
+	return this.dumpBinlog(ctx, serverID, name, uint64(len(binlogMagic)), flags, gtids)
+}
+
+// dumpBinlog sends the events of the binary log from file name and pos on, each in
+// a packet of its own after an OK byte. The replica is first told where it's
+// starting with an artificial ROTATE event and the format description of the
+// file. At the end of the log, it either gets an EOF packet, if it asked not to
+// block, or the events as they are added, with heartbeats in between. If gtids is
+// set, transactions in it are left out.
+func (this *connection) dumpBinlog(ctx context.Context, serverID uint32, name string, pos uint64, flags uint16, gtids gtidSet) error {
+	if err := this.checkPrivilege(privReplSlave, "REPLICATION SLAVE"); err != nil {
+		return err
+	}
+
+	log := this.srv.binlog
+	if log == nil {
+		return binlogError(errBinlogClosed)
+	}
+
+	if name == "" {
+		name = log.firstFile()
+	}
+	if pos < uint64(len(binlogMagic)) {
+		pos = uint64(len(binlogMagic))
+	}
+
+	// The file being read isn't purged until the dump moves on from it
+	log.addReader(name)
+	defer func() {
+		log.removeReader(name)
+	}()
+
+	fde, err := log.formatDescription(name)
+	if err != nil {
+		return binlogError(err)
+	}
+	if err := log.checkPosition(name, pos); err != nil {
+		return binlogError(err)
+	}
+
+	glog.V(3).Infof("Connection #%d: Replica %d reading binary log from %s:%d", this.id, serverID, name, pos)
+
+	// Replicas that can check event checksums say so by setting
+	// @master_binlog_checksum. The others get the events without them.
+	// http://dev.mysql.com/doc/refman/5.7/en/replication-options-binary-log.html#sysvar_binlog_checksum
+	v, ok := this.userVars["master_binlog_checksum"]
+	aware := ok && v.kind != valueNull
+	fileChecksum := binlogFileChecksum(fde)
+
+	rotate := encodeBinlogEvent(binlogHeader{
+		typ:      binlogRotateEvent,
+		serverID: log.serverID,
+		flags:    logEventArtificial,
+	}, rotateBody(pos, name), log.checksum && aware)
+	if err := this.writeBinlogEvent(rotate); err != nil {
+		return err
+	}
+
+	// Starting in the middle of a file, the replica still needs its format. A zero
+	// position tells it not to take the event's position as its own.
+	if pos > uint64(len(binlogMagic)) {
+		ev := setBinlogLogPos(fde, 0, fileChecksum)
+		if !aware {
+			ev = stripBinlogChecksum(ev)
+		}
+		if err := this.writeBinlogEvent(ev); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := defaultHeartbeatPeriod
+	if v, ok := this.userVars["master_heartbeat_period"]; ok {
+		heartbeat = time.Duration(v.num)
+	}
+
+	// Set while leaving out the events of a transaction the replica has
+	skipping := false
+
+	for {
+		data, closed, appended, err := log.read(name, pos)
+		if err != nil {
+			return binlogError(err)
+		}
+
+		if len(data) > 0 {
+			this.setState("Sending binlog event to slave")
+		}
+
+		// Read on until there's nothing more
+		more := len(data) > 0
+
+		for len(data) > 0 {
+			size := binary.LittleEndian.Uint32(data[9:])
+			ev := data[:size]
+			data = data[size:]
+			pos += uint64(size)
+
+			switch binlogEventType(ev[4]) {
+			case binlogGTIDEvent:
+				var sid [16]byte
+				copy(sid[:], ev[binlogHeaderSize+1:])
+				skipping = gtids != nil && gtids.contains(sid, binary.LittleEndian.Uint64(ev[binlogHeaderSize+17:]))
+			case binlogQueryEvent, binlogTableMapEvent, binlogWriteRowsEvent, binlogUpdateRowsEvent, binlogDeleteRowsEvent, binlogXIDEvent:
+			default:
+				skipping = false
+			}
+			if skipping {
+				continue
+			}
+
+			if binlogEventType(ev[4]) == binlogFormatDescriptionEvent {
+				fileChecksum = binlogFileChecksum(ev)
+			}
+			if !aware && fileChecksum {
+				ev = stripBinlogChecksum(ev)
+			}
+
+			if err := this.writeBinlogEvent(ev); err != nil {
+				return err
+			}
+		}
+
+		if more {
+			continue
+		}
+
+		// The ROTATE event at the end of a file was sent, carry on with the next one
+		if closed {
+			if next := log.nextFile(name); next != "" {
+				log.addReader(next)
+				log.removeReader(name)
+				name, pos = next, uint64(len(binlogMagic))
+				continue
+			}
+		}
+
+		if flags&binlogDumpNonBlock != 0 {
+			return this.writeEOFPacket()
+		}
+
+		this.setState("Master has sent all binlog to slave; waiting for more updates")
+
+		if err := this.waitBinlog(ctx, appended, heartbeat, name, pos, log.checksum && aware); err != nil {
+			return err
+		}
+
+		// The server is going away. A graceful shutdown tells the replica once the
+		// command is over.
+		select {
+		case <-this.srv.netQuit:
+			return nil
+		default:
+		}
+	}
+}
+
+// waitBinlog waits for events to be added to the log, sending the replica a
+// heartbeat with the current file and position once heartbeat has passed
+func (this *connection) waitBinlog(ctx context.Context, appended <-chan struct{}, heartbeat time.Duration, name string, pos uint64, checksum bool) error {
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		timer := time.NewTimer(heartbeat)
+		defer timer.Stop()
+		tick = timer.C
+	}
+
+	select {
+	case <-appended:
+	case <-this.srv.netQuit:
+	case <-ctx.Done():
+		return newSQLError(1317, "Query execution was interrupted")
+
+	case <-tick:
+		log := this.srv.binlog
+		return this.writeBinlogEvent(encodeBinlogEvent(binlogHeader{
+			typ:      binlogHeartbeatEvent,
+			serverID: log.serverID,
+			logPos:   uint32(pos),
+			flags:    logEventArtificial,
+		}, []byte(name), checksum))
+	}
+
+	return nil
+}
+
+func (this *connection) writeBinlogEvent(ev []byte) error {
+	this.buf.Reset()
+	this.buf.WriteByte(okPacket)
+	this.buf.Write(ev)
+	return this.writePacket()
+}
+
+// execShowMasterStatus answers SHOW MASTER STATUS, which tells where the binary log
+// is being written. There are no rows if binary logging is off.
+// http://dev.mysql.com/doc/refman/5.7/en/show-master-status.html
+func (this *connection) execShowMasterStatus() error {
+	if !this.account.has(privSuper) && !this.account.has(privReplClient) {
+		return newSQLError(1227, "Access denied; you need (at least one of) the SUPER, REPLICATION CLIENT privilege(s) for this operation")
+	}
+
+	cols := []*columnDef{
+		varcharColumn("File", 512),
+		systemColumn("", "", "Position", fieldTypeLongLong, 20),
+		varcharColumn("Binlog_Do_DB", 255),
+		varcharColumn("Binlog_Ignore_DB", 255),
+		varcharColumn("Executed_Gtid_Set", 1000),
+	}
+
+	var rows [][]interface{}
+	if this.srv.binlog != nil {
+		name, pos, executed := this.srv.binlog.status()
+		rows = append(rows, []interface{}{name, pos, "", "", executed})
+	}
+
+	return this.writeResultSet(cols, rows)
+}
+
+// execShowSlaveHosts answers SHOW SLAVE HOSTS with the replicas that registered
+// http://dev.mysql.com/doc/refman/5.7/en/show-slave-hosts.html
+func (this *connection) execShowSlaveHosts() error {
+	if err := this.checkPrivilege(privReplSlave, "REPLICATION SLAVE"); err != nil {
+		return err
+	}
+
+	cols := []*columnDef{
+		systemColumn("", "", "Server_id", fieldTypeLong, 10),
+		varcharColumn("Host", 255),
+		systemColumn("", "", "Port", fieldTypeLong, 7),
+		systemColumn("", "", "Master_id", fieldTypeLong, 10),
+		varcharColumn("Slave_UUID", 36),
+	}
+
+	var rows [][]interface{}
+	for _, r := range this.srv.replicas.list() {
+		rows = append(rows, []interface{}{r.serverID, r.host, r.port, r.masterID, r.uuid})
+	}
+
+	return this.writeResultSet(cols, rows)
+}
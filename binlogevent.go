@@ -0,0 +1,872 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Every binary log file starts with this
+	binlogMagic = "\xfebin"
+
+	binlogHeaderSize   = 19
+	binlogChecksumSize = 4
+
+	// Version 4 logs, as written by MySQL 5.0 and later
+	binlogVersion = 4
+
+	// The server version in format description events. Replicas only look for
+	// checksums in logs written by 5.6.1 and later.
+	binlogServerVersion = "5.7.0-qld"
+)
+
+// Checksum algorithms, as named by the binlog_checksum variable
+const (
+	binlogChecksumNone byte = iota
+	binlogChecksumCRC32
+)
+
+// Lengths of the fixed part after the header, by event type starting from 1
+// http://dev.mysql.com/doc/internals/en/format-description-event.html
+var binlogPostHeaderLengths []byte = []byte{
+	56, 13, 0, 8, 0, 18, 0, 4, 4, 4, 4, 18, 0, 0, 95, 0, 4, 26, 8, 0,
+	0, 0, 8, 8, 8, 2, 0, 0, 0, 10, 10, 10, 42, 42, 0, 18, 52, 0,
+}
+
+// binlogHeader is the common header of all events
+// http://dev.mysql.com/doc/internals/en/binlog-event-header.html
+type binlogHeader struct {
+	timestamp uint32
+	typ       binlogEventType
+	serverID  uint32
+
+	// Where the next event starts, 0 for artificial events
+	logPos uint32
+	flags  uint16
+}
+
+// encodeBinlogEvent returns the event with header h and body, followed by its CRC32
+// if checksum is set. Format description events always have one.
+func encodeBinlogEvent(h binlogHeader, body []byte, checksum bool) []byte {
+	checksum = checksum || h.typ == binlogFormatDescriptionEvent
+
+	size := binlogHeaderSize + len(body)
+	if checksum {
+		size += binlogChecksumSize
+	}
+
+	ev := make([]byte, binlogHeaderSize, size)
+	binary.LittleEndian.PutUint32(ev[0:], h.timestamp)
+	ev[4] = byte(h.typ)
+	binary.LittleEndian.PutUint32(ev[5:], h.serverID)
+	binary.LittleEndian.PutUint32(ev[9:], uint32(size))
+	binary.LittleEndian.PutUint32(ev[13:], h.logPos)
+	binary.LittleEndian.PutUint16(ev[17:], h.flags)
+	ev = append(ev, body...)
+
+	if checksum {
+		ev = binary.LittleEndian.AppendUint32(ev, crc32.ChecksumIEEE(ev))
+	}
+	return ev
+}
+
+// binlogEventSize is the size of an event with a body of n bytes
+func binlogEventSize(n int, typ binlogEventType, checksum bool) int {
+	if checksum || typ == binlogFormatDescriptionEvent {
+		return binlogHeaderSize + n + binlogChecksumSize
+	}
+	return binlogHeaderSize + n
+}
+
+// setBinlogLogPos changes the position in the header of an encoded event, updating
+// its checksum
+func setBinlogLogPos(ev []byte, pos uint32, checksum bool) []byte {
+	ev = append([]byte(nil), ev...)
+	binary.LittleEndian.PutUint32(ev[13:], pos)
+	if checksum || binlogEventType(ev[4]) == binlogFormatDescriptionEvent {
+		n := len(ev) - binlogChecksumSize
+		binary.LittleEndian.PutUint32(ev[n:], crc32.ChecksumIEEE(ev[:n]))
+	}
+	return ev
+}
+
+// stripBinlogChecksum returns ev without its CRC32, for replicas that don't expect
+// one. The format description event always has a checksum, it only changes to say
+// that the events after it have none.
+func stripBinlogChecksum(ev []byte) []byte {
+	n := len(ev) - binlogChecksumSize
+
+	if binlogEventType(ev[4]) == binlogFormatDescriptionEvent {
+		ev = append([]byte(nil), ev...)
+		ev[n-1] = binlogChecksumNone
+		binary.LittleEndian.PutUint32(ev[n:], crc32.ChecksumIEEE(ev[:n]))
+		return ev
+	}
+
+	ev = append([]byte(nil), ev[:n]...)
+	binary.LittleEndian.PutUint32(ev[9:], uint32(n))
+	return ev
+}
+
+// http://dev.mysql.com/doc/internals/en/format-description-event.html
+func formatDescriptionBody(created uint32, checksum bool) []byte {
+	body := binary.LittleEndian.AppendUint16(nil, binlogVersion)
+
+	var version [50]byte
+	copy(version[:], binlogServerVersion)
+	body = append(body, version[:]...)
+
+	body = binary.LittleEndian.AppendUint32(body, created)
+	body = append(body, binlogHeaderSize)
+	body = append(body, binlogPostHeaderLengths...)
+
+	if checksum {
+		return append(body, binlogChecksumCRC32)
+	}
+	return append(body, binlogChecksumNone)
+}
+
+// http://dev.mysql.com/doc/internals/en/rotate-event.html
+func rotateBody(pos uint64, name string) []byte {
+	body := binary.LittleEndian.AppendUint64(nil, pos)
+	return append(body, name...)
+}
+
+// http://dev.mysql.com/doc/internals/en/query-event.html
+func queryBody(threadID uint32, schema, query string) []byte {
+	/*
+		4              slave_proxy_id
+		4              execution time
+		1              schema length
+		2              error-code
+		2              status-vars length
+		string[$len]   status-vars
+		string[$len]   schema
+		1              [00]
+		string[EOF]    query
+	*/
+	body := binary.LittleEndian.AppendUint32(nil, threadID)
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	body = append(body, byte(len(schema)))
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = append(body, schema...)
+	body = append(body, 0)
+	return append(body, query...)
+}
+
+// http://dev.mysql.com/doc/internals/en/xid-event.html
+func xidBody(xid uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, xid)
+}
+
+// gtidBody describes the transaction that follows as number gno from source sid.
+// The logical clock tells replicas which transactions they may apply in parallel.
+func gtidBody(sid [16]byte, gno, lastCommitted, sequence uint64) []byte {
+	/*
+		1              flags, 1 if the transaction may have statement based events
+		16             source id
+		8              transaction number
+		1              logical timestamp type code, 2
+		8              last committed
+		8              sequence number
+	*/
+	body := []byte{1}
+	body = append(body, sid[:]...)
+	body = binary.LittleEndian.AppendUint64(body, gno)
+	body = append(body, 2)
+	body = binary.LittleEndian.AppendUint64(body, lastCommitted)
+	return binary.LittleEndian.AppendUint64(body, sequence)
+}
+
+// previousGTIDsBody lists the transactions in the logs before this one, which are
+// numbers 1 to gno from source sid
+func previousGTIDsBody(sid [16]byte, gno uint64) []byte {
+	if gno == 0 {
+		return binary.LittleEndian.AppendUint64(nil, 0)
+	}
+
+	body := binary.LittleEndian.AppendUint64(nil, 1)
+	body = append(body, sid[:]...)
+	body = binary.LittleEndian.AppendUint64(body, 1)
+	body = binary.LittleEndian.AppendUint64(body, 1)
+	return binary.LittleEndian.AppendUint64(body, gno+1)
+}
+
+// http://dev.mysql.com/doc/internals/en/table-map-event.html
+func tableMapBody(tableID uint64, schema, table string, cols []*binlogColumn) []byte {
+	var buf bytes.Buffer
+
+	buf.Write(appendUint48(nil, tableID))
+	buf.Write([]byte{0, 0})
+
+	buf.WriteByte(byte(len(schema)))
+	buf.WriteString(schema)
+	buf.WriteByte(0)
+	buf.WriteByte(byte(len(table)))
+	buf.WriteString(table)
+	buf.WriteByte(0)
+
+	writeLenencInt(&buf, uint64(len(cols)))
+	var meta []byte
+	for _, col := range cols {
+		buf.WriteByte(byte(col.typ))
+		meta = append(meta, col.meta...)
+	}
+	writeLenencInt(&buf, uint64(len(meta)))
+	buf.Write(meta)
+
+	nullable := make([]byte, (len(cols)+7)/8)
+	for i, col := range cols {
+		if !col.col.NotNull {
+			nullable[i/8] |= 1 << uint(i%8)
+		}
+	}
+	buf.Write(nullable)
+
+	return buf.Bytes()
+}
+
+// rowsBody encodes the rows of a WRITE_ROWS, UPDATE_ROWS or DELETE_ROWS event (v2).
+// Updates have a before and an after image for each row, the others one image.
+// http://dev.mysql.com/doc/internals/en/rows-event.html
+func rowsBody(tableID uint64, flags uint16, cols []*binlogColumn, images int, rows [][]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.Write(appendUint48(nil, tableID))
+	buf.Write(binary.LittleEndian.AppendUint16(nil, flags))
+
+	// No extra data, just the length of the length
+	buf.Write([]byte{2, 0})
+
+	writeLenencInt(&buf, uint64(len(cols)))
+
+	// All columns are in every image
+	present := bytes.Repeat([]byte{0xff}, (len(cols)+7)/8)
+	for i := 0; i < images; i++ {
+		buf.Write(present)
+	}
+
+	body := buf.Bytes()
+	for _, row := range rows {
+		var err error
+		if body, err = appendRowImage(body, cols, row); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+func appendUint48(b []byte, n uint64) []byte {
+	return append(b, byte(n), byte(n>>8), byte(n>>16), byte(n>>24), byte(n>>32), byte(n>>40))
+}
+
+// appendUintBE appends the n low bytes of v, most significant first
+func appendUintBE(b []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+// binlogColumn is how a column is described in TABLE_MAP events and encoded in row
+// images
+type binlogColumn struct {
+	col *Column
+	typ fieldType
+
+	// Type specific data in TABLE_MAP events
+	meta []byte
+
+	// For strings and blobs, the most bytes a value can have and the size of the
+	// length in front of the value
+	maxLen   uint64
+	lenBytes int
+
+	// For decimals
+	precision, scale int
+
+	// Digits of fractional seconds
+	fsp int
+}
+
+// newBinlogColumn works out how values of col are written. Text columns hold utf8,
+// up to 3 bytes per character. DECIMAL columns get their precision from Length, the
+// display length that counts the sign and the decimal point.
+// http://dev.mysql.com/doc/internals/en/table-map-event.html
+func newBinlogColumn(col *Column) (*binlogColumn, error) {
+	bc := &binlogColumn{col: col, typ: fieldType(col.Type)}
+
+	length := uint64(col.Length)
+	if length == 0 {
+		length = uint64(columnLengths[col.Type])
+	}
+
+	switch col.Type {
+	case TypeTiny, TypeShort, TypeLong, TypeLongLong, TypeYear, TypeDate:
+
+	case TypeFloat:
+		bc.meta = []byte{4}
+	case TypeDouble:
+		bc.meta = []byte{8}
+
+	case TypeDateTime, TypeTimestamp, TypeTime:
+		bc.fsp = int(col.Decimals)
+		if bc.fsp > 6 {
+			bc.fsp = 6
+		}
+		bc.meta = []byte{byte(bc.fsp)}
+		bc.typ = map[ColumnType]fieldType{
+			TypeDateTime:  fieldTypeDateTime2,
+			TypeTimestamp: fieldTypeTimestamp2,
+			TypeTime:      fieldTypeTime2,
+		}[col.Type]
+
+	case TypeDecimal:
+		bc.scale = int(col.Decimals)
+		bc.precision = int(length)
+		if bc.scale > 0 {
+			bc.precision--
+		}
+		if !col.Unsigned {
+			bc.precision--
+		}
+		if bc.precision > 65 {
+			bc.precision = 65
+		}
+		if bc.scale > 30 || bc.precision < 1 || bc.precision < bc.scale {
+			return nil, fmt.Errorf("Binlog/newBinlogColumn: Invalid DECIMAL column %s", col.Name)
+		}
+		bc.meta = []byte{byte(bc.precision), byte(bc.scale)}
+
+	case TypeVarChar:
+		bc.typ = fieldTypeVarchar
+		bc.maxLen = length * 3
+		if bc.maxLen > math.MaxUint16 {
+			bc.maxLen = math.MaxUint16
+		}
+		bc.lenBytes = 1
+		if bc.maxLen > 255 {
+			bc.lenBytes = 2
+		}
+		bc.meta = binary.LittleEndian.AppendUint16(nil, uint16(bc.maxLen))
+
+	case TypeChar:
+		bc.maxLen = length * 3
+		if bc.maxLen > 765 {
+			bc.maxLen = 765
+		}
+		bc.lenBytes = 1
+		if bc.maxLen > 255 {
+			bc.lenBytes = 2
+		}
+		// The high bits of lengths over 255 are folded into the type
+		bc.meta = []byte{byte(fieldTypeString) ^ byte((bc.maxLen&0x300)>>4), byte(bc.maxLen)}
+
+	case TypeBlob:
+		switch {
+		case length <= 255:
+			bc.lenBytes = 1
+		case length <= math.MaxUint16:
+			bc.lenBytes = 2
+		case length <= 1<<24-1:
+			bc.lenBytes = 3
+		default:
+			bc.lenBytes = 4
+		}
+		bc.maxLen = 1<<(8*uint(bc.lenBytes)) - 1
+		bc.meta = []byte{byte(bc.lenBytes)}
+
+	default:
+		return nil, fmt.Errorf("Binlog/newBinlogColumn: Column %s has a type that can't be logged (%d)", col.Name, col.Type)
+	}
+
+	return bc, nil
+}
+
+// appendRowImage appends a row image, the bitmap of NULL values and then the value
+// of each column that isn't NULL
+// http://dev.mysql.com/doc/internals/en/rows-event.html#write-rows-eventv2
+func appendRowImage(b []byte, cols []*binlogColumn, row []interface{}) ([]byte, error) {
+	if len(row) != len(cols) {
+		return nil, fmt.Errorf("Binlog/appendRowImage: Got %d values for %d columns", len(row), len(cols))
+	}
+
+	nulls := len(b)
+	b = append(b, make([]byte, (len(cols)+7)/8)...)
+
+	for i, col := range cols {
+		if row[i] == nil {
+			if col.col.NotNull {
+				return nil, fmt.Errorf("Binlog/appendRowImage: Column %s can't be NULL", col.col.Name)
+			}
+			b[nulls+i/8] |= 1 << uint(i%8)
+			continue
+		}
+
+		var err error
+		if b, err = col.appendValue(b, row[i]); err != nil {
+			return nil, fmt.Errorf("Binlog/appendRowImage: Column %s: %v", col.col.Name, err)
+		}
+	}
+
+	return b, nil
+}
+
+func (this *binlogColumn) appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch this.col.Type {
+	case TypeTiny, TypeShort, TypeLong, TypeLongLong:
+		n, err := binlogInt(v)
+		if err != nil {
+			return nil, err
+		}
+		size := map[ColumnType]int{TypeTiny: 1, TypeShort: 2, TypeLong: 4, TypeLongLong: 8}[this.col.Type]
+		for i := 0; i < size; i++ {
+			b = append(b, byte(n>>(8*uint(i))))
+		}
+		return b, nil
+
+	case TypeYear:
+		year, err := binlogInt(v)
+		if t, ok := v.(time.Time); ok {
+			year, err = uint64(t.Year()), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if year == 0 {
+			return append(b, 0), nil
+		}
+		return append(b, byte(year-1900)), nil
+
+	case TypeFloat, TypeDouble:
+		f, err := binlogFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if this.col.Type == TypeFloat {
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(f)), nil
+
+	case TypeDecimal:
+		return appendDecimal(b, binlogDecimalString(v, this.scale), this.precision, this.scale)
+
+	case TypeVarChar, TypeChar, TypeBlob:
+		s := binlogString(v)
+		if uint64(len(s)) > this.maxLen {
+			return nil, fmt.Errorf("%d bytes is longer than the column's %d", len(s), this.maxLen)
+		}
+		for i := 0; i < this.lenBytes; i++ {
+			b = append(b, byte(len(s)>>(8*uint(i))))
+		}
+		return append(b, s...), nil
+
+	case TypeDate:
+		t, err := binlogTime(v)
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(t.Day()) | uint64(t.Month())<<5 | uint64(t.Year())<<9
+		return append(b, byte(n), byte(n>>8), byte(n>>16)), nil
+
+	case TypeDateTime:
+		t, err := binlogTime(v)
+		if err != nil {
+			return nil, err
+		}
+		ymd := uint64(t.Year()*13+int(t.Month()))<<5 | uint64(t.Day())
+		hms := uint64(t.Hour()<<12 | t.Minute()<<6 | t.Second())
+		b = appendUintBE(b, (ymd<<17|hms)+0x8000000000, 5)
+		return appendFraction(b, t.Nanosecond()/1000, this.fsp), nil
+
+	case TypeTimestamp:
+		t, err := binlogTime(v)
+		if err != nil {
+			return nil, err
+		}
+		b = appendUintBE(b, uint64(t.Unix()), 4)
+		return appendFraction(b, t.Nanosecond()/1000, this.fsp), nil
+
+	case TypeTime:
+		d, err := binlogDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendTime2(b, d, this.fsp), nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %d", this.col.Type)
+}
+
+// truncateMicros drops the digits of usec beyond fsp
+func truncateMicros(usec, fsp int) int {
+	for i := fsp; i < 6; i++ {
+		usec /= 10
+	}
+	for i := fsp; i < 6; i++ {
+		usec *= 10
+	}
+	return usec
+}
+
+// appendFraction appends the fractional seconds of DATETIME2 and TIMESTAMP2 values,
+// in (fsp+1)/2 bytes
+func appendFraction(b []byte, usec, fsp int) []byte {
+	usec = truncateMicros(usec, fsp)
+
+	switch fsp {
+	case 1, 2:
+		return appendUintBE(b, uint64(usec/10000), 1)
+	case 3, 4:
+		return appendUintBE(b, uint64(usec/100), 2)
+	case 5, 6:
+		return appendUintBE(b, uint64(usec), 3)
+	}
+	return b
+}
+
+// appendTime2 appends a TIME2 value, which is signed and can be more than a day
+func appendTime2(b []byte, d time.Duration, fsp int) []byte {
+	neg := d < 0
+	if neg {
+		d = -d
+	}
+
+	secs := int64(d / time.Second)
+	usec := int64(truncateMicros(int(d%time.Second/time.Microsecond), fsp))
+	hms := (secs/3600)<<12 | (secs/60%60)<<6 | secs%60
+
+	packed := hms<<24 + usec
+	if neg {
+		packed = -packed
+	}
+
+	// Same as MySQL, whose fraction part takes the sign of the value
+	switch fsp {
+	case 1, 2:
+		b = appendUintBE(b, uint64(packed>>24+0x800000), 3)
+		return append(b, byte(int8(packed%(1<<24)/10000)))
+	case 3, 4:
+		b = appendUintBE(b, uint64(packed>>24+0x800000), 3)
+		return appendUintBE(b, uint64(uint16(int16(packed%(1<<24)/100))), 2)
+	case 5, 6:
+		return appendUintBE(b, uint64(packed+0x800000000000), 6)
+	}
+	return appendUintBE(b, uint64(packed>>24+0x800000), 3)
+}
+
+// Bytes needed for the digits of a partial group of a DECIMAL
+var decimalDigitBytes = [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+// appendDecimal appends s, a number in decimal notation, in MySQL's binary DECIMAL
+// format. Digits beyond the scale are dropped.
+// http://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func appendDecimal(b []byte, s string, precision, scale int) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if strings.Trim(intPart+fracPart, "0123456789") != "" || intPart+fracPart == "" {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(fracPart) > scale {
+		fracPart = fracPart[:scale]
+	}
+
+	intg := precision - scale
+	if len(intPart) > intg {
+		return nil, fmt.Errorf("%s is out of range for DECIMAL(%d,%d)", s, precision, scale)
+	}
+	if strings.Trim(intPart+fracPart, "0") == "" {
+		neg = false
+	}
+
+	intPart = strings.Repeat("0", intg-len(intPart)) + intPart
+	fracPart += strings.Repeat("0", scale-len(fracPart))
+
+	group := func(digits string) uint64 {
+		n, _ := strconv.ParseUint(digits, 10, 32)
+		return n
+	}
+
+	start := len(b)
+	lead := intg % 9
+	if lead > 0 {
+		b = appendUintBE(b, group(intPart[:lead]), decimalDigitBytes[lead])
+	}
+	for i := lead; i < intg; i += 9 {
+		b = appendUintBE(b, group(intPart[i:i+9]), 4)
+	}
+	for i := 0; i+9 <= scale; i += 9 {
+		b = appendUintBE(b, group(fracPart[i:i+9]), 4)
+	}
+	if trail := scale % 9; trail > 0 {
+		b = appendUintBE(b, group(fracPart[scale-trail:]), decimalDigitBytes[trail])
+	}
+
+	// Negative numbers have all bits inverted, and the top bit is flipped so the
+	// bytes sort in numeric order
+	if neg {
+		for i := start; i < len(b); i++ {
+			b[i] = ^b[i]
+		}
+	}
+	b[start] ^= 0x80
+
+	return b, nil
+}
+
+// binlogInt converts a value for an integer column. Negative numbers are kept in
+// two's complement, as MySQL logs signed and unsigned columns the same way.
+func binlogInt(v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case int:
+		return uint64(v), nil
+	case int8:
+		return uint64(v), nil
+	case int16:
+		return uint64(v), nil
+	case int32:
+		return uint64(v), nil
+	case int64:
+		return uint64(v), nil
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string, []byte:
+		s := binlogString(v)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return uint64(n), nil
+		}
+		return strconv.ParseUint(s, 10, 64)
+	}
+	return 0, fmt.Errorf("can't use %T as an integer", v)
+}
+
+func binlogFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string, []byte:
+		return strconv.ParseFloat(binlogString(v), 64)
+	}
+
+	n, err := binlogInt(v)
+	if err != nil {
+		return 0, fmt.Errorf("can't use %T as a float", v)
+	}
+	if isSignedInt(v) {
+		return float64(int64(n)), nil
+	}
+	return float64(n), nil
+}
+
+func isSignedInt(v interface{}) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64:
+		return true
+	}
+	return false
+}
+
+func binlogDecimalString(v interface{}, scale int) string {
+	switch v := v.(type) {
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', scale, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', scale, 64)
+	}
+	return binlogString(v)
+}
+
+func binlogString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// Layouts accepted for date and time values given as strings
+var binlogTimeLayouts []string = []string{
+	defaultTimeFormat + ".999999",
+	"2006-01-02",
+}
+
+func binlogTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string, []byte:
+		for _, layout := range binlogTimeLayouts {
+			if t, err := time.Parse(layout, binlogString(v)); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid date %q", v)
+	}
+	return time.Time{}, fmt.Errorf("can't use %T as a date", v)
+}
+
+// binlogDuration converts a value for a TIME column, either a time.Duration or the
+// time of day of a time.Time
+func binlogDuration(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case time.Duration:
+		return v, nil
+	case time.Time:
+		return v.Sub(time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, v.Location())), nil
+	}
+	return 0, fmt.Errorf("can't use %T as a time", v)
+}
+
+// parseServerUUID returns the source id for GTIDs, either the configured one or a name based
+// UUID derived from the server id, so it stays the same across restarts
+func parseServerUUID(s string, serverID uint32) ([16]byte, error) {
+	var id [16]byte
+
+	if s == "" {
+		id = md5.Sum([]byte(fmt.Sprintf("qld server %d", serverID)))
+		id[6] = id[6]&0x0f | 0x30
+		id[8] = id[8]&0x3f | 0x80
+		return id, nil
+	}
+
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("Binlog/parseServerUUID: Invalid UUID %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func formatUUID(id [16]byte) string {
+	s := hex.EncodeToString(id[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// gtidSet holds ranges of transaction numbers by source id. Each range is
+// [start, end).
+type gtidSet map[[16]byte][][2]uint64
+
+// parseGTIDSet reads the binary form of a GTID set, as sent with
+// COM_BINLOG_DUMP_GTID
+// http://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+func parseGTIDSet(b []byte) (gtidSet, error) {
+	set := make(gtidSet)
+	errInvalid := fmt.Errorf("Binlog/parseGTIDSet: Invalid GTID set")
+
+	if len(b) < 8 {
+		return nil, errInvalid
+	}
+	n := binary.LittleEndian.Uint64(b)
+	b = b[8:]
+
+	for i := uint64(0); i < n; i++ {
+		if len(b) < 24 {
+			return nil, errInvalid
+		}
+		var sid [16]byte
+		copy(sid[:], b)
+		intervals := binary.LittleEndian.Uint64(b[16:])
+		b = b[24:]
+
+		if uint64(len(b)) < intervals*16 {
+			return nil, errInvalid
+		}
+		for j := uint64(0); j < intervals; j++ {
+			set[sid] = append(set[sid], [2]uint64{binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:])})
+			b = b[16:]
+		}
+	}
+
+	return set, nil
+}
+
+func (this gtidSet) contains(sid [16]byte, gno uint64) bool {
+	for _, r := range this[sid] {
+		if gno >= r[0] && gno < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// containsUpTo returns true if the set has all numbers from 1 to gno of sid
+func (this gtidSet) containsUpTo(sid [16]byte, gno uint64) bool {
+	return this.upTo(sid) >= gno
+}
+
+// upTo returns the highest number n such that the set has all numbers from 1 to n
+// of sid
+func (this gtidSet) upTo(sid [16]byte) uint64 {
+	ranges := append([][2]uint64(nil), this[sid]...)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	next := uint64(1)
+	for _, r := range ranges {
+		if r[0] <= next && r[1] > next {
+			next = r[1]
+		}
+	}
+	return next - 1
+}
+
+// String returns the set in the text form MySQL uses, such as
+// 3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:7
+func (this gtidSet) String() string {
+	var sets []string
+	for sid, ranges := range this {
+		s := formatUUID(sid)
+		for _, r := range ranges {
+			if r[1]-r[0] == 1 {
+				s += fmt.Sprintf(":%d", r[0])
+			} else {
+				s += fmt.Sprintf(":%d-%d", r[0], r[1]-1)
+			}
+		}
+		sets = append(sets, s)
+	}
+
+	sort.Strings(sets)
+	return strings.Join(sets, ",\n")
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// execShowBinaryLogs answers SHOW BINARY LOGS with the files of the binary log
+// http://dev.mysql.com/doc/refman/5.7/en/show-binary-logs.html
+func (this *connection) execShowBinaryLogs() error {
+	if !this.account.has(privSuper) && !this.account.has(privReplClient) {
+		return newSQLError(1227, "Access denied; you need (at least one of) the SUPER, REPLICATION CLIENT privilege(s) for this operation")
+	}
+
+	if this.srv.binlog == nil {
+		return newSQLError(1381, "You are not using binary logging")
+	}
+
+	cols := []*columnDef{
+		varcharColumn("Log_name", 255),
+		systemColumn("", "", "File_size", fieldTypeLongLong, 20),
+	}
+
+	var rows [][]interface{}
+	for _, f := range this.srv.binlog.logs() {
+		rows = append(rows, []interface{}{f.name, f.size})
+	}
+
+	return this.writeResultSet(cols, rows)
+}
+
+// execShowBinlogEvents answers SHOW BINLOG EVENTS with the events of one file of
+// the binary log, the first one unless the statement names another. There are no
+// rows if binary logging is off.
+// http://dev.mysql.com/doc/refman/5.7/en/show-binlog-events.html
+func (this *connection) execShowBinlogEvents(stmt *binlogEventsStmt) error {
+	if err := this.checkPrivilege(privReplSlave, "REPLICATION SLAVE"); err != nil {
+		return err
+	}
+
+	cols := []*columnDef{
+		varcharColumn("Log_name", 255),
+		systemColumn("", "", "Pos", fieldTypeLongLong, 20),
+		varcharColumn("Event_type", 15),
+		systemColumn("", "", "Server_id", fieldTypeLong, 10),
+		systemColumn("", "", "End_log_pos", fieldTypeLongLong, 20),
+		varcharColumn("Info", 1000),
+	}
+
+	log := this.srv.binlog
+	if log == nil {
+		return this.writeResultSet(cols, nil)
+	}
+
+	name := stmt.log
+	if name == "" {
+		name = log.firstFile()
+	}
+
+	f, ok := log.fileInfo(name)
+	if !ok {
+		return newSQLError(1220, "Error when executing command SHOW BINLOG EVENTS: Could not find target log")
+	}
+
+	pos := stmt.pos
+	if pos < uint64(len(binlogMagic)) {
+		pos = uint64(len(binlogMagic))
+	}
+
+	var rows [][]interface{}
+	found := pos == f.size
+	skip := stmt.offset
+
+	_, err := scanBinlog(f.path, uint64(len(binlogMagic)), f.size, func(at uint64, ev []byte) error {
+		if at < pos {
+			return nil
+		}
+		found = found || at == pos
+
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		if stmt.hasLimit && uint64(len(rows)) == stmt.limit {
+			return io.EOF
+		}
+
+		typ := binlogEventType(ev[4])
+		eventType, ok := binlogEventNames[typ]
+		if !ok {
+			eventType = fmt.Sprintf("Unknown (%d)", typ)
+		}
+
+		rows = append(rows, []interface{}{
+			f.name,
+			at,
+			eventType,
+			binary.LittleEndian.Uint32(ev[5:]),
+			uint64(binary.LittleEndian.Uint32(ev[13:])),
+			describeBinlogEvent(ev, f.checksum),
+		})
+		return nil
+	})
+	if err != nil || !found {
+		return newSQLError(1220, "Error when executing command SHOW BINLOG EVENTS: Wrong offset or I/O error")
+	}
+
+	return this.writeResultSet(cols, rows)
+}
+
+// describeBinlogEvent returns the Info column of SHOW BINLOG EVENTS for ev, in the
+// form MySQL uses
+func describeBinlogEvent(ev []byte, checksum bool) string {
+	body := binlogEventBody(ev, checksum)
+
+	switch binlogEventType(ev[4]) {
+	case binlogQueryEvent:
+		n := int(body[8])
+		at := 13 + int(binary.LittleEndian.Uint16(body[11:]))
+		schema, query := body[at:at+n], body[at+n+1:]
+		if len(schema) == 0 {
+			return string(query)
+		}
+		return fmt.Sprintf("use `%s`; %s", schema, query)
+
+	case binlogTableMapEvent:
+		n := int(body[8])
+		schema := body[9 : 9+n]
+		rest := body[9+n+1:]
+		table := rest[1 : 1+int(rest[0])]
+		return fmt.Sprintf("table_id: %d (%s.%s)", binlogTableID(body), schema, table)
+
+	case binlogWriteRowsEvent, binlogUpdateRowsEvent, binlogDeleteRowsEvent:
+		s := fmt.Sprintf("table_id: %d", binlogTableID(body))
+		if binary.LittleEndian.Uint16(body[6:])&rowsStmtEnd != 0 {
+			s += " flags: STMT_END_F"
+		}
+		return s
+
+	case binlogXIDEvent:
+		return fmt.Sprintf("COMMIT /* xid=%d */", binary.LittleEndian.Uint64(body))
+
+	case binlogRotateEvent:
+		return fmt.Sprintf("%s;pos=%d", body[8:], binary.LittleEndian.Uint64(body))
+
+	case binlogFormatDescriptionEvent:
+		version := bytes.TrimRight(body[2:52], "\x00")
+		return fmt.Sprintf("Server ver: %s, Binlog ver: %d", version, binary.LittleEndian.Uint16(body))
+
+	case binlogGTIDEvent:
+		var sid [16]byte
+		copy(sid[:], body[1:])
+		return fmt.Sprintf("SET @@SESSION.GTID_NEXT= '%s:%d'", formatUUID(sid), binary.LittleEndian.Uint64(body[17:]))
+
+	case binlogPreviousGTIDsEvent:
+		set, err := parseGTIDSet(body)
+		if err != nil {
+			return ""
+		}
+		return set.String()
+	}
+
+	return ""
+}
+
+// binlogTableID reads the 6 byte table id that starts TABLE_MAP and rows events
+func binlogTableID(body []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(body)) | uint64(binary.LittleEndian.Uint16(body[4:]))<<32
+}
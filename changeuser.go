@@ -0,0 +1,239 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+)
+
+// The only authentication method the server supports
+const nativePasswordPlugin = "mysql_native_password"
+
+type changeUserRequest struct {
+	user     string
+	authResp []byte
+	schema   string
+	charset  byte
+	plugin   string
+	attrs    map[string]string
+}
+
+// http://dev.mysql.com/doc/internals/en/com-change-user.html
+func parseChangeUser(payload []byte, caps clientFlag) (*changeUserRequest, error) {
+	buf := bytes.NewBuffer(payload)
+	req := &changeUserRequest{}
+
+	/*
+		string[NUL]    user
+		if capabilities & SECURE_CONNECTION {
+			1              auth-response-len
+			string[$len]   auth-response
+		} else {
+			string[NUL]    auth-response
+		}
+		string[NUL]    schema-name
+		if more data {
+			2              character-set
+			if capabilities & CLIENT_PLUGIN_AUTH {
+				string[NUL]    auth plugin name
+			}
+			if capabilities & CLIENT_CONNECT_ATTRS {
+				lenenc-int     length of all key-values
+				lenenc-str     key
+				lenenc-str     value
+				...
+			}
+		}
+	*/
+
+	user, err := buf.ReadBytes(0x00)
+	if err != nil {
+		return nil, fmt.Errorf("Connection/parseChangeUser: Missing user name")
+	}
+	req.user = string(bytes.TrimRight(user, "\x00"))
+
+	if caps&clientSecureConnection != 0 {
+		n, err := buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("Connection/parseChangeUser: Missing auth response")
+		}
+
+		if req.authResp = buf.Next(int(n)); len(req.authResp) != int(n) {
+			return nil, fmt.Errorf("Connection/parseChangeUser: Insufficient data length. Expect %d, received %d", int(n), len(req.authResp))
+		}
+	} else {
+		resp, err := buf.ReadBytes(0x00)
+		if err != nil {
+			return nil, fmt.Errorf("Connection/parseChangeUser: Missing auth response")
+		}
+		req.authResp = bytes.TrimRight(resp, "\x00")
+	}
+
+	schema, err := buf.ReadBytes(0x00)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	req.schema = string(bytes.TrimRight(schema, "\x00"))
+
+	if buf.Len() < 2 {
+		return req, nil
+	}
+	req.charset = buf.Next(2)[0]
+
+	if caps&clientPluginAuth != 0 && buf.Len() > 0 {
+		plugin, err := buf.ReadBytes(0x00)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		req.plugin = string(bytes.TrimRight(plugin, "\x00"))
+	}
+
+	if caps&clientConnectAttrs != 0 && buf.Len() > 0 {
+		n, err := readLenencInt(buf)
+		if err != nil || uint64(buf.Len()) < n {
+			return nil, fmt.Errorf("Connection/parseChangeUser: Invalid connection attributes")
+		}
+
+		attrs := bytes.NewBuffer(buf.Next(int(n)))
+		req.attrs = make(map[string]string)
+		for attrs.Len() > 0 {
+			key, err := readLenencString(attrs)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readLenencString(attrs)
+			if err != nil {
+				return nil, err
+			}
+			req.attrs[key] = value
+		}
+	}
+
+	return req, nil
+}
+
+// handleChangeUser answers COM_CHANGE_USER. The client logs in again as another
+// user and gets a fresh session. Any failure ends the connection, as the old session
+// is gone by then.
+func (this *connection) handleChangeUser(ctx context.Context, payload []byte) error {
+	if err := this.changeUser(ctx, payload); err != nil {
+		if _, ok := err.(*SQLError); !ok {
+			return err
+		}
+
+		glog.V(3).Infof("Connection #%d: %v", this.id, err)
+		if err := this.writeErrPacket(err); err != nil {
+			return err
+		}
+		return errChangeUserFailed
+	}
+
+	return this.writeOkPacket()
+}
+
+func (this *connection) changeUser(ctx context.Context, payload []byte) error {
+	req, err := parseChangeUser(payload, this.clientCapabilities)
+	if err != nil {
+		return err
+	}
+	glog.V(3).Infof("Connection #%d changing user to %s, schema = %s, plugin = %s, attributes = %v", this.id, req.user, req.schema, req.plugin, req.attrs)
+
+	// Clients that used another method for the auth response are asked to switch to
+	// the one the server supports, with a new challenge
+	if req.plugin != "" && req.plugin != nativePasswordPlugin {
+		if req.authResp, err = this.switchAuthPlugin(); err != nil {
+			return err
+		}
+	}
+
+	acct, err := this.srv.accounts.authenticate(req.user, clientIP(this.RemoteAddr()), this.cipher[:], req.authResp)
+	if err != nil {
+		return err
+	}
+
+	if err := this.checkListener(acct); err != nil {
+		return err
+	}
+
+	if req.schema != "" {
+		if err := this.checkSchema(acct, req.schema); err != nil {
+			return err
+		}
+	}
+
+	// The connection now counts against the limits of the new account
+	this.srv.limits.release(this.account)
+	this.account = nil
+
+	maxConnections, _ := this.srv.globals.get("max_connections")
+	maxUserConnections, _ := this.srv.globals.get("max_user_connections")
+	if err := this.srv.limits.admit(acct, maxConnections, maxUserConnections); err != nil {
+		return err
+	}
+	this.account = acct
+
+	if err := this.srv.resources.connect(acct); err != nil {
+		return err
+	}
+
+	if err := this.resetSession(ctx); err != nil {
+		return err
+	}
+
+	this.username = req.user
+	this.schema = req.schema
+	this.schemaChanged = this.sysVarValue("session_track_schema") != 0
+	if req.charset != 0 {
+		this.charset = req.charset
+	}
+
+	this.mu.Lock()
+	this.info.User = this.username
+	this.info.Schema = this.schema
+	this.mu.Unlock()
+
+	return nil
+}
+
+// switchAuthPlugin asks the client to authenticate with mysql_native_password and a
+// new challenge, and returns its response
+// http://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::AuthSwitchRequest
+func (this *connection) switchAuthPlugin() ([]byte, error) {
+	if this.clientCapabilities&clientPluginAuth == 0 {
+		return nil, newSQLError(1251, "Client does not support authentication protocol requested by server; consider upgrading MySQL client")
+	}
+
+	if _, err := io.ReadFull(this.rand, this.cipher[:]); err != nil {
+		return nil, err
+	}
+
+	/*
+		1              [fe]
+		string[NUL]    plugin name
+		string[EOF]    auth plugin data
+	*/
+	this.buf.Reset()
+	this.buf.WriteByte(eofPacket)
+	this.buf.WriteString(nativePasswordPlugin)
+	this.buf.WriteByte(0)
+	this.buf.Write(this.cipher[:])
+	this.buf.WriteByte(0)
+
+	if err := this.writePacket(); err != nil {
+		return nil, err
+	}
+
+	if err := this.readPacket(); err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), this.buf.Bytes()...), nil
+}
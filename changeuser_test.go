@@ -0,0 +1,178 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+)
+
+// changeUser builds a COM_CHANGE_USER payload
+func changeUser(user string, authResp []byte, schema, plugin string) []byte {
+	var p bytes.Buffer
+	p.WriteString(user)
+	p.WriteByte(0)
+	p.WriteByte(byte(len(authResp)))
+	p.Write(authResp)
+	p.WriteString(schema)
+	p.WriteByte(0)
+	p.Write([]byte{collationUtf8General, 0})
+	p.WriteString(plugin)
+	p.WriteByte(0)
+
+	var attrs bytes.Buffer
+	writeLenencString(&attrs, "_client_name")
+	writeLenencString(&attrs, "test")
+	writeLenencInt(&p, uint64(attrs.Len()))
+	p.Write(attrs.Bytes())
+
+	return p.Bytes()
+}
+
+func TestChangeUser(t *testing.T) {
+	var mu sync.Mutex
+	var rollbacks int
+
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Databases = []string{"testdb"}
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "v", Password: "q", Privileges: []string{"SELECT"}},
+	}
+	cfg.QueryHandler = QueryHandlerFunc(func(ctx context.Context, session Session, q string) (*Result, error) {
+		switch q {
+		case "ROLLBACK":
+			mu.Lock()
+			rollbacks++
+			mu.Unlock()
+		case "WHO":
+			info := session.User() + "@" + session.Schema()
+			if session.InTransaction() {
+				info += " in transaction"
+			}
+			return &Result{Info: info}, nil
+		}
+		return nil, nil
+	})
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	c, p := dialRawWith(t, s, rawLogin{user: "u", password: "p", caps: clientPluginAuth})
+	defer c.Close()
+	if p[0] != okPacket {
+		t.Fatalf("Handshake failed: %q", p)
+	}
+	challenge := append(append([]byte(nil), c.greeting[11:19]...), c.greeting[38:50]...)
+
+	who := func() string {
+		p, err := c.command(comComQuery, []byte("WHO"))
+		if err != nil || p[0] != okPacket {
+			t.Fatalf("Expecting OK, got %q, %v", p, err)
+		}
+		return string(p[7:])
+	}
+
+	if _, err := c.command(comComQuery, []byte("BEGIN")); err != nil {
+		t.Fatal(err)
+	}
+	if w := who(); w != "u@ in transaction" {
+		t.Fatalf("Wrong session %q", w)
+	}
+
+	// The open transaction is rolled back
+	if p, err := c.command(comChangeUser, changeUser("v", scramble(challenge, "q"), "testdb", nativePasswordPlugin)); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+	if w := who(); w != "v@testdb" {
+		t.Errorf("Wrong session %q", w)
+	}
+
+	mu.Lock()
+	if rollbacks != 1 {
+		t.Errorf("Expecting 1 rollback, got %d", rollbacks)
+	}
+	mu.Unlock()
+
+	// Another plugin is switched to mysql_native_password with a new challenge
+	p, err := c.command(comChangeUser, changeUser("u", []byte("whatever"), "", "caching_sha2_password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "\xfe" + nativePasswordPlugin + "\x00"
+	if !bytes.HasPrefix(p, []byte(prefix)) || len(p) != len(prefix)+21 {
+		t.Fatalf("Expecting AuthSwitchRequest, got %q", p)
+	}
+	if err := c.writePacket(scramble(p[len(prefix):len(prefix)+20], "p")); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := c.readPacket(); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK after auth switch, got %q, %v", p, err)
+	}
+	if w := who(); w != "u@" {
+		t.Errorf("Wrong session %q", w)
+	}
+
+	// A failure drops the connection
+	if p, err := c.command(comChangeUser, changeUser("v", scramble(challenge, "wrong"), "", nativePasswordPlugin)); err != nil || errCode(p) != 1045 {
+		t.Errorf("Expecting ER_ACCESS_DENIED_ERROR, got %q, %v", p, err)
+	}
+	if _, err := c.readPacket(); err == nil {
+		t.Error("Expecting connection to be closed")
+	}
+}
+
+func TestHandshakeAuthSwitch(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Accounts = []AccountConfig{{User: "u", Password: "p"}}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	// The greeting names the plugin the challenge is for
+	c, p := dialRawWith(t, s, rawLogin{user: "u", password: "p", caps: clientPluginAuth, plugin: "caching_sha2_password"})
+	defer c.Close()
+	if !bytes.HasSuffix(c.greeting, []byte("\x00"+nativePasswordPlugin+"\x00")) {
+		t.Errorf("Expecting %s in the greeting, got %q", nativePasswordPlugin, c.greeting)
+	}
+
+	// A client that answered for another plugin is switched to mysql_native_password
+	prefix := "\xfe" + nativePasswordPlugin + "\x00"
+	if !bytes.HasPrefix(p, []byte(prefix)) || len(p) != len(prefix)+21 {
+		t.Fatalf("Expecting AuthSwitchRequest, got %q", p)
+	}
+	if err := c.writePacket(scramble(p[len(prefix):len(prefix)+20], "p")); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := c.readPacket(); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK after auth switch, got %q, %v", p, err)
+	}
+}
+
+func TestParseChangeUser(t *testing.T) {
+	req, err := parseChangeUser(changeUser("v", []byte("xyz"), "db", "p"), clientSecureConnection|clientPluginAuth|clientConnectAttrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.user != "v" || string(req.authResp) != "xyz" || req.schema != "db" || req.charset != collationUtf8General || req.plugin != "p" || req.attrs["_client_name"] != "test" {
+		t.Errorf("Wrong request %#v", req)
+	}
+
+	// Old clients stop after the schema
+	if req, err := parseChangeUser([]byte("v\x00\x00db\x00"), clientSecureConnection); err != nil || req.user != "v" || req.schema != "db" {
+		t.Errorf("Wrong request %#v, %v", req, err)
+	}
+
+	if _, err := parseChangeUser([]byte("v"), clientSecureConnection); err == nil {
+		t.Error("Expecting error for truncated packet")
+	}
+}
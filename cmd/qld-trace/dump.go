@@ -0,0 +1,317 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/reducedb/qld/trace"
+	"io"
+	"strings"
+)
+
+// http://dev.mysql.com/doc/internals/en/command-phase.html
+var commandNames = []string{
+	"COM_SLEEP", "COM_QUIT", "COM_INIT_DB", "COM_QUERY", "COM_FIELD_LIST",
+	"COM_CREATE_DB", "COM_DROP_DB", "COM_REFRESH", "COM_SHUTDOWN", "COM_STATISTICS",
+	"COM_PROCESS_INFO", "COM_CONNECT", "COM_PROCESS_KILL", "COM_DEBUG", "COM_PING",
+	"COM_TIME", "COM_DELAYED_INSERT", "COM_CHANGE_USER", "COM_BINLOG_DUMP",
+	"COM_TABLE_DUMP", "COM_CONNECT_OUT", "COM_REGISTER_SLAVE", "COM_STMT_PREPARE",
+	"COM_STMT_EXECUTE", "COM_STMT_SEND_LONG_DATA", "COM_STMT_CLOSE", "COM_STMT_RESET",
+	"COM_SET_OPTION", "COM_STMT_FETCH", "COM_DAEMON", "COM_BINLOG_DUMP_GTID",
+	"COM_RESET_CONNECTION",
+}
+
+// Commands whose payload is a string worth printing as text
+var textCommands = map[byte]bool{
+	0x02: true, // COM_INIT_DB
+	0x03: true, // COM_QUERY
+	0x04: true, // COM_FIELD_LIST
+	0x05: true, // COM_CREATE_DB
+	0x06: true, // COM_DROP_DB
+	0x16: true, // COM_STMT_PREPARE
+}
+
+type responseState int
+
+const (
+	stateHandshake responseState = iota
+	stateAuth
+	stateCommand
+	stateResponse
+	stateColumns
+	stateRows
+)
+
+// decoder follows the conversation well enough to label each packet. It does not
+// try to understand prepared statement or replication traffic beyond the first byte.
+type decoder struct {
+	state responseState
+}
+
+func dumpFile(name string) error {
+	f, r, err := openTrace(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := r.Header()
+	fmt.Printf("# %s: connection %d from %s, started %s\n", name, h.ConnId, h.RemoteAddr, h.Start.Format("2006-01-02 15:04:05.000000"))
+
+	d := &decoder{}
+
+	for {
+		pkt, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s %s seq=%-3d len=%-6d %s\n", pkt.Time.Format("15:04:05.000000"), pkt.Direction, pkt.Sequence, len(pkt.Payload), d.describe(pkt))
+	}
+}
+
+func (this *decoder) describe(pkt *trace.Packet) string {
+	p := pkt.Payload
+
+	if pkt.Direction == trace.ClientToServer {
+		// A packet with sequence 0 from the client always starts a new command
+		if pkt.Sequence == 0 {
+			this.state = stateCommand
+		}
+
+		switch this.state {
+		case stateHandshake, stateAuth:
+			this.state = stateAuth
+			return describeHandshakeResponse(p)
+		case stateCommand:
+			this.state = stateResponse
+			return describeCommand(p)
+		}
+
+		return "data " + preview(p)
+	}
+
+	if len(p) == 0 {
+		return "empty"
+	}
+
+	switch this.state {
+	case stateHandshake:
+		this.state = stateAuth
+		return describeHandshake(p)
+
+	case stateAuth:
+		if p[0] == 0xfe {
+			return "auth switch request " + preview(p[1:])
+		}
+		return describeGeneric(p)
+
+	case stateResponse:
+		if p[0] == 0x00 || p[0] == 0xff || (p[0] == 0xfe && len(p) < 9) {
+			return describeGeneric(p)
+		}
+
+		n, _, ok := lenencInt(p)
+		if !ok {
+			return describeGeneric(p)
+		}
+		this.state = stateColumns
+		return fmt.Sprintf("result set, %d columns", n)
+
+	case stateColumns:
+		if p[0] == 0xfe && len(p) < 9 {
+			this.state = stateRows
+			return describeGeneric(p)
+		}
+		return "column " + describeColumn(p)
+
+	case stateRows:
+		if p[0] == 0xff || (p[0] == 0xfe && len(p) < 9) {
+			this.state = stateCommand
+			return describeGeneric(p)
+		}
+		return "row " + describeRow(p)
+	}
+
+	return describeGeneric(p)
+}
+
+func describeHandshake(p []byte) string {
+	if len(p) < 1 || p[0] != 0x0a {
+		return describeGeneric(p)
+	}
+
+	end := strings.IndexByte(string(p[1:]), 0)
+	if end < 0 || len(p) < end+6 {
+		return "handshake (truncated)"
+	}
+
+	id := binary.LittleEndian.Uint32(p[end+2:])
+	return fmt.Sprintf("handshake v10 server=%q connection=%d", p[1:end+1], id)
+}
+
+func describeHandshakeResponse(p []byte) string {
+	if len(p) < 32 {
+		return describeGeneric(p)
+	}
+
+	caps := binary.LittleEndian.Uint32(p)
+	rest := p[32:]
+
+	user := rest
+	if i := strings.IndexByte(string(rest), 0); i >= 0 {
+		user = rest[:i]
+	}
+
+	return fmt.Sprintf("handshake response caps=0x%08x charset=%d user=%q", caps, p[8], user)
+}
+
+func describeCommand(p []byte) string {
+	if len(p) == 0 {
+		return "empty command"
+	}
+
+	name := fmt.Sprintf("COM_UNKNOWN(0x%02x)", p[0])
+	if int(p[0]) < len(commandNames) {
+		name = commandNames[p[0]]
+	}
+
+	if textCommands[p[0]] {
+		return fmt.Sprintf("%s %q", name, strings.TrimRight(string(p[1:]), "\x00"))
+	}
+
+	if len(p) == 1 {
+		return name
+	}
+	return name + " " + preview(p[1:])
+}
+
+func describeGeneric(p []byte) string {
+	switch p[0] {
+	case 0x00:
+		affected, n, _ := lenencInt(p[1:])
+		insertId, m, _ := lenencInt(p[1+n:])
+		desc := fmt.Sprintf("OK affected=%d insert_id=%d", affected, insertId)
+		if off := 1 + n + m; len(p) >= off+4 {
+			desc += fmt.Sprintf(" status=0x%04x warnings=%d", binary.LittleEndian.Uint16(p[off:]), binary.LittleEndian.Uint16(p[off+2:]))
+		}
+		return desc
+
+	case 0xff:
+		if len(p) < 9 {
+			return "ERR (truncated)"
+		}
+		return fmt.Sprintf("ERR %d (%s): %s", binary.LittleEndian.Uint16(p[1:]), p[4:9], p[9:])
+
+	case 0xfe:
+		if len(p) < 9 {
+			if len(p) >= 5 {
+				return fmt.Sprintf("EOF warnings=%d status=0x%04x", binary.LittleEndian.Uint16(p[1:]), binary.LittleEndian.Uint16(p[3:]))
+			}
+			return "EOF"
+		}
+	}
+
+	return "data " + preview(p)
+}
+
+func describeColumn(p []byte) string {
+	// catalog, schema, table, org_table, name, org_name
+	var fields []string
+	for i := 0; i < 5 && len(p) > 0; i++ {
+		s, n, ok := lenencString(p)
+		if !ok {
+			break
+		}
+		fields = append(fields, s)
+		p = p[n:]
+	}
+
+	if len(fields) < 5 {
+		return preview(p)
+	}
+	return fmt.Sprintf("%s.%s.%s", fields[1], fields[2], fields[4])
+}
+
+func describeRow(p []byte) string {
+	var vals []string
+	for len(p) > 0 {
+		if p[0] == 0xfb {
+			vals = append(vals, "NULL")
+			p = p[1:]
+			continue
+		}
+
+		s, n, ok := lenencString(p)
+		if !ok {
+			return preview(p)
+		}
+		vals = append(vals, fmt.Sprintf("%q", s))
+		p = p[n:]
+	}
+
+	return "(" + strings.Join(vals, ", ") + ")"
+}
+
+// preview shows printable payloads as text and anything else as hex
+func preview(p []byte) string {
+	const max = 64
+
+	trunc := ""
+	if len(p) > max {
+		p = p[:max]
+		trunc = "..."
+	}
+
+	for _, c := range p {
+		if c < 0x20 || c > 0x7e {
+			return hex.EncodeToString(p) + trunc
+		}
+	}
+	return fmt.Sprintf("%q%s", p, trunc)
+}
+
+// http://dev.mysql.com/doc/internals/en/integer.html#packet-Protocol::LengthEncodedInteger
+func lenencInt(p []byte) (uint64, int, bool) {
+	if len(p) == 0 {
+		return 0, 0, false
+	}
+
+	switch p[0] {
+	case 0xfc:
+		if len(p) < 3 {
+			return 0, 0, false
+		}
+		return uint64(binary.LittleEndian.Uint16(p[1:])), 3, true
+	case 0xfd:
+		if len(p) < 4 {
+			return 0, 0, false
+		}
+		return uint64(p[1]) | uint64(p[2])<<8 | uint64(p[3])<<16, 4, true
+	case 0xfe:
+		if len(p) < 9 {
+			return 0, 0, false
+		}
+		return binary.LittleEndian.Uint64(p[1:]), 9, true
+	case 0xfb, 0xff:
+		return 0, 0, false
+	}
+
+	return uint64(p[0]), 1, true
+}
+
+func lenencString(p []byte) (string, int, bool) {
+	n, m, ok := lenencInt(p)
+	if !ok || uint64(len(p)-m) < n {
+		return "", 0, false
+	}
+	return string(p[m : m+int(n)]), m + int(n), true
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+// qld-trace decodes qld protocol captures into readable dumps, and replays them
+// against a running server.
+//
+//	qld-trace dump FILE...
+//	qld-trace replay [-addr host:port] [-password pw] [-timeout d] FILE
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/reducedb/qld/trace"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s dump FILE...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s replay [-addr host:port] [-password pw] [-timeout d] FILE\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "dump":
+		fs := flag.NewFlagSet("dump", flag.ExitOnError)
+		fs.Parse(os.Args[2:])
+		if fs.NArg() == 0 {
+			usage()
+		}
+
+		for _, name := range fs.Args() {
+			if err = dumpFile(name); err != nil {
+				break
+			}
+		}
+
+	case "replay":
+		fs := flag.NewFlagSet("replay", flag.ExitOnError)
+		opts := replayOptions{}
+		fs.StringVar(&opts.addr, "addr", "127.0.0.1:3306", "address of the server to replay against")
+		fs.StringVar(&opts.password, "password", "", "recompute the auth response with this password for the new challenge")
+		fs.DurationVar(&opts.timeout, "timeout", defaultReplayTimeout, "how long to wait for each server packet")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+
+		err = replayFile(fs.Arg(0), opts)
+
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+func openTrace(name string) (*os.File, *trace.Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := trace.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return f, r, nil
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/reducedb/qld/trace"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultReplayTimeout = 5 * time.Second
+
+type replayOptions struct {
+	addr     string
+	password string
+	timeout  time.Duration
+}
+
+// replayFile sends every client packet in the capture to the server at opts.addr,
+// in order. Wherever the capture has a server packet, one packet is read from the
+// live server and compared with the recorded one, so divergences are reported where
+// they happen.
+func replayFile(name string, opts replayOptions) error {
+	f, r, err := openTrace(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conn, err := net.DialTimeout("tcp", opts.addr, opts.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var (
+		challenge  []byte
+		handshake  = true
+		mismatches int
+	)
+
+	for {
+		pkt, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if pkt.Direction == trace.ServerToClient {
+			conn.SetReadDeadline(time.Now().Add(opts.timeout))
+			seq, payload, err := readPacket(conn)
+			if err != nil {
+				return fmt.Errorf("reading server packet: %v", err)
+			}
+
+			// The greeting always differs in the connection id and the challenge
+			if challenge == nil && len(payload) > 0 && payload[0] == 0x0a {
+				challenge = parseChallenge(payload)
+				fmt.Printf("S->C seq=%-3d %s\n", seq, describeHandshake(payload))
+				continue
+			}
+
+			if seq != pkt.Sequence || !bytes.Equal(payload, pkt.Payload) {
+				mismatches++
+				fmt.Printf("S->C seq=%-3d MISMATCH\n  recorded: seq=%d %s\n  replayed: seq=%d %s\n", seq, pkt.Sequence, preview(pkt.Payload), seq, preview(payload))
+			} else {
+				fmt.Printf("S->C seq=%-3d ok %s\n", seq, describeReplayed(payload))
+			}
+			continue
+		}
+
+		payload := pkt.Payload
+		if pkt.Sequence == 0 {
+			handshake = false
+		}
+
+		if handshake && opts.password != "" && challenge != nil {
+			if payload, err = rewriteAuthResponse(payload, scramblePassword(challenge, opts.password)); err != nil {
+				return err
+			}
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(opts.timeout))
+		if err := writePacket(conn, pkt.Sequence, payload); err != nil {
+			return fmt.Errorf("writing client packet: %v", err)
+		}
+
+		if handshake {
+			fmt.Printf("C->S seq=%-3d %s\n", pkt.Sequence, describeHandshakeResponse(payload))
+		} else {
+			fmt.Printf("C->S seq=%-3d %s\n", pkt.Sequence, describeCommand(payload))
+		}
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%d server packets differed from the capture", mismatches)
+	}
+
+	fmt.Println("# replay matched the capture")
+	return nil
+}
+
+func describeReplayed(p []byte) string {
+	if len(p) == 0 {
+		return "empty"
+	}
+	return describeGeneric(p)
+}
+
+func readPacket(conn net.Conn) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[3], payload, nil
+}
+
+func writePacket(conn net.Conn, seq byte, payload []byte) error {
+	pkt := make([]byte, 4, 4+len(payload))
+	pkt[0] = byte(len(payload))
+	pkt[1] = byte(len(payload) >> 8)
+	pkt[2] = byte(len(payload) >> 16)
+	pkt[3] = seq
+	pkt = append(pkt, payload...)
+
+	_, err := conn.Write(pkt)
+	return err
+}
+
+// parseChallenge extracts the 20 byte auth-plugin-data from a HandshakeV10 packet
+// http://dev.mysql.com/doc/internals/en/connection-phase-packets.html
+func parseChallenge(p []byte) []byte {
+	end := strings.IndexByte(string(p[1:]), 0)
+	if end < 0 {
+		return nil
+	}
+
+	// version NUL, 4 bytes connection id, 8 bytes data part 1
+	off := 1 + end + 1 + 4
+	if len(p) < off+8+1+2+1+2+2+1+10+12 {
+		return nil
+	}
+
+	challenge := append([]byte(nil), p[off:off+8]...)
+	off += 8 + 1 + 2 + 1 + 2 + 2 + 1 + 10
+	return append(challenge, p[off:off+12]...)
+}
+
+// http://dev.mysql.com/doc/internals/en/secure-password-authentication.html
+// SHA1(password) XOR SHA1(challenge + SHA1(SHA1(password)))
+func scramblePassword(challenge []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+
+	h := sha1.New()
+	h.Write(challenge)
+	h.Write(stage2[:])
+	scramble := h.Sum(nil)
+
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
+
+// rewriteAuthResponse replaces the auth-response of a HandshakeResponse41 that uses
+// a 1 byte auth-response length, which is what qld asks clients for.
+func rewriteAuthResponse(p []byte, auth []byte) ([]byte, error) {
+	if len(p) < 32 {
+		return nil, fmt.Errorf("handshake response too short")
+	}
+
+	end := bytes.IndexByte(p[32:], 0)
+	if end < 0 {
+		return nil, fmt.Errorf("handshake response has no user name")
+	}
+
+	off := 32 + end + 1
+	if off >= len(p) || off+1+int(p[off]) > len(p) {
+		return nil, fmt.Errorf("handshake response has no auth response")
+	}
+
+	out := append([]byte(nil), p[:off]...)
+	out = append(out, byte(len(auth)))
+	out = append(out, auth...)
+	return append(out, p[off+1+int(p[off]):]...), nil
+}
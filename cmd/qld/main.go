@@ -0,0 +1,91 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+// qld runs the server. SIGTERM or SIGINT start a graceful shutdown, a second signal
+// closes all connections right away.
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/golang/glog"
+	"github.com/reducedb/qld"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	configFile      = flag.String("config", "", "JSON configuration file")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 0, "how long to wait for connections to drain on shutdown, overrides ShutdownTimeout in the configuration")
+)
+
+func main() {
+	flag.Parse()
+	defer glog.Flush()
+
+	var (
+		cfg *qld.Config
+		err error
+	)
+
+	if *configFile != "" {
+		cfg, err = qld.LoadConfig(*configFile)
+	} else {
+		cfg, err = qld.NewConfig()
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	if *shutdownTimeout > 0 {
+		// Also applies to shutdowns started by clients, in whole seconds
+		timeout = *shutdownTimeout
+		cfg.ShutdownTimeout = uint64((timeout + time.Second - 1) / time.Second)
+	}
+
+	s, err := qld.NewServer(cfg)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	if err := s.Listen(); err != nil {
+		glog.Fatal(err)
+	}
+
+	for _, addr := range s.Addrs() {
+		glog.Infof("Listening on %s", addr)
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-sigs
+		glog.Infof("Received %s, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		go func() {
+			<-sigs
+			glog.Info("Received second signal, closing all connections")
+			cancel()
+		}()
+
+		if err := s.Shutdown(ctx); err != nil {
+			glog.Warningf("Shutdown did not complete cleanly: %v", err)
+		}
+	}()
+
+	if err := s.Serve(); err != nil {
+		glog.Fatal(err)
+	}
+
+	glog.Info("Server exited")
+}
@@ -8,6 +8,7 @@ package qld
 
 import (
 	"bytes"
+	"context"
 	"github.com/golang/glog"
 	"io"
 )
@@ -16,6 +17,9 @@ type command struct {
 	cmd     serverCommand
 	cmdName string
 	stmt    string
+
+	// The packet after the command byte
+	payload []byte
 }
 
 func newCommand(data bytes.Buffer) (*command, error) {
@@ -31,9 +35,15 @@ func newCommand(data bytes.Buffer) (*command, error) {
 func (this *command) parseCommand(data bytes.Buffer) error {
 	// 1 byte - character set
 	this.cmd = serverCommand(data.Next(1)[0])
-	this.cmdName = commandName[this.cmd]
+	if this.cmd < comEnd {
+		this.cmdName = commandName[this.cmd]
+	} else {
+		this.cmdName = commandName[comEnd]
+	}
 	glog.V(3).Infof("Cmd = %s(%d)", this.cmdName, this.cmd)
 
+	this.payload = append([]byte(nil), data.Bytes()...)
+
 	if tmp, err := data.ReadBytes(0x00); err != nil && err != io.EOF {
 		return err
 	} else {
@@ -44,46 +54,117 @@ func (this *command) parseCommand(data bytes.Buffer) error {
 	return nil
 }
 
-func (this *command) execute() error {
-	switch this.cmd {
-	case comQuit:
-		// should really never get here because handleCommandPhase() should have taken care of it
-		return nil
-		/*
-			case comInitDB:
-			case comComQuery:
-			case comFieldList:
-			case comCreateDB:
-			case comDropDB:
-			case comRefresh:
-			case comShutdown:
-			case comStatistics:
-			case comProcessInfo:
-			case comConnect:
-			case comProcessKill:
-			case comDebug:
-			case comPing:
-			case comTime:
-			case comDelayedInsert:
-			case comChangeUser:
-			case comBinlogDump:
-			case comTableDump:
-			case comConnectOut:
-			case comRegisterSlave:
-			case comStmtPrepare:
-			case comStmtExecute:
-			case comStmtSendLongData:
-			case comStmtClose:
-			case comStmtReset:
-			case comSetOption:
-			case comStmtFetch:
-			case comDaemon:
-			case comBinlogDumpGTID:
-			case comResetConnection:
-		*/
-	default:
-		//case comSleep:
+// execute runs the handler registered for the command, either a built-in one or one
+// set in Config.Commands
+func (this *command) execute(ctx context.Context, c *connection) error {
+	fn, ok := c.srv.commands[this.cmd]
+	if !ok {
 		return SQLErrors[1047]
 	}
-	return nil
+	return fn(ctx, c, this)
+}
+
+// commandFunc answers a single command on c. ctx is canceled if the command is
+// killed.
+type commandFunc func(ctx context.Context, c *connection, cmd *command) error
+
+// The commands qld answers itself, unless Config.Commands says otherwise. COM_QUIT is
+// handled before any of these run and cannot be overridden.
+var builtinCommands map[serverCommand]commandFunc = map[serverCommand]commandFunc{
+	comComQuery: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleQuery(ctx, cmd.stmt)
+	},
+
+	// Also answered while the server is shutting down, for as long as the
+	// connection is still open
+	comPing: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.writeOkPacket()
+	},
+
+	comStatistics: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleStatistics()
+	},
+
+	comInitDB: func(ctx context.Context, c *connection, cmd *command) error {
+		if err := c.changeSchema(cmd.stmt); err != nil {
+			return err
+		}
+		return c.writeOkPacket()
+	},
+
+	comFieldList: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleFieldList(ctx, cmd.payload)
+	},
+
+	comProcessInfo: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.execProcessList(false)
+	},
+
+	comProcessKill: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleProcessKill(cmd.payload)
+	},
+
+	comChangeUser: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleChangeUser(ctx, cmd.payload)
+	},
+
+	comResetConnection: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleResetConnection(ctx)
+	},
+
+	comSetOption: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleSetOption(cmd.payload)
+	},
+
+	comRefresh: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleRefresh(ctx, cmd.payload)
+	},
+
+	comShutdown: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleShutdown()
+	},
+
+	comDebug: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleDebug()
+	},
+
+	comRegisterSlave: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleRegisterSlave(cmd.payload)
+	},
+
+	comBinlogDump: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleBinlogDump(ctx, cmd.payload)
+	},
+
+	comBinlogDumpGTID: func(ctx context.Context, c *connection, cmd *command) error {
+		return c.handleBinlogDumpGTID(ctx, cmd.payload)
+	},
+}
+
+// newCommands returns the handlers for a server, the built-in ones with the ones from
+// overrides replacing them. A nil handler in overrides removes the command.
+func newCommands(overrides map[byte]CommandHandler) map[serverCommand]commandFunc {
+	commands := make(map[serverCommand]commandFunc, len(builtinCommands)+len(overrides))
+	for cmd, fn := range builtinCommands {
+		commands[cmd] = fn
+	}
+
+	for cmd, h := range overrides {
+		if h == nil {
+			delete(commands, serverCommand(cmd))
+		} else {
+			commands[serverCommand(cmd)] = h.commandFunc()
+		}
+	}
+
+	return commands
+}
+
+// isQuestion returns true for the commands counted by the Questions status variable
+func (this *command) isQuestion() bool {
+	switch this.cmd {
+	case comPing, comStatistics, comStmtPrepare, comStmtClose, comStmtReset:
+		return false
+	}
+	return true
 }
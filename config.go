@@ -6,11 +6,190 @@
 
 package qld
 
-type config struct {
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type Config struct {
+	// Where the server accepts connections. Defaults to TCP port 3306 on all
+	// interfaces.
+	Listeners []ListenerConfig
+
+	// Certificate and private key, both PEM encoded, for clients that switch to TLS.
+	// TLS is only offered to clients when these are set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Databases clients may select, at login or with USE. INFORMATION_SCHEMA and
+	// PERFORMANCE_SCHEMA always exist. If there are none, any name is accepted.
+	Databases []string
+
+	// The accounts clients log in with. If there are none, the server works like
+	// mysqld --skip-grant-tables: any user name is accepted without a password and
+	// has all privileges.
+	Accounts []AccountConfig
+
+	// Maximum number of simultaneous client connections, counting those still
+	// logging in. One more is allowed for an account with the CONNECTION_ADMIN or
+	// SUPER privilege, so an administrator can always get in.
+	MaxConnections uint64
+
+	// Maximum number of simultaneous connections per account, for accounts that don't
+	// set their own limit. 0 means no limit.
+	MaxUserConnections uint64
+
+	// How commands are run, "one-thread-per-connection" (the default) or
+	// "pool-of-threads". With the thread pool, commands run on a bounded number of
+	// workers instead of each connection's own goroutine.
+	ThreadHandling string
+
+	// Number of thread pool groups. Defaults to the number of CPUs.
+	ThreadPoolSize int
+
+	// Workers per group beyond the first one
+	ThreadPoolOversubscribe int
+
+	// Maximum number of workers, including the extra ones started for stalled groups
+	ThreadPoolMaxThreads int
+
+	// Milliseconds a group may go without starting a command while it has some
+	// waiting, before it is considered stalled and gets an extra worker
+	ThreadPoolStallLimit uint64
+
+	// Which commands are queued with high priority: "transactions", for connections
+	// with a transaction open, "statements" for all, or "none". A connection gets at
+	// most ThreadPoolHighPrioTickets high priority commands in a row.
+	ThreadPoolHighPrioMode    string
+	ThreadPoolHighPrioTickets uint64
+
+	// Number of handshake failures in a row after which a host is blocked until
+	// FLUSH HOSTS, or until Server.FlushHosts() or Server.UnblockHost() is called.
+	MaxConnectErrors uint64
+
+	// Number of client IP addresses the host cache remembers. 0 disables the cache,
+	// and with it host blocking.
+	HostCacheSize uint64
+
+	// Number of seconds the server waits for activity on a noninteractive connection
+	// before closing it. This is the global default for the wait_timeout variable.
+	WaitTimeout uint64
+
+	// Number of seconds the server waits for activity on an interactive connection
+	// (one that sets clientInteractive) before closing it. Interactive sessions
+	// start with this as their wait_timeout.
+	InteractiveTimeout uint64
+
+	// Number of seconds the server waits for the client to complete the handshake.
+	ConnectTimeout uint64
+
+	// Number of seconds the server waits for the rest of a packet once it has
+	// started arriving, and for a write to the client to complete.
+	NetReadTimeout  uint64
+	NetWriteTimeout uint64
+
+	// Queries taking longer than this many seconds are counted as slow queries
+	LongQueryTime uint64
+
+	// Number of seconds a shutdown started by a client with SHUTDOWN waits for
+	// connections to drain before closing them
+	ShutdownTimeout uint64
+
+	// Base name of the binary log files, such as "binlog" for binlog.000001,
+	// binlog.000002 and so on, and binlog.index listing them. It may include a
+	// directory. Binary logging is off unless this is set. The log holds the changes
+	// reported with Server.LogRows and Server.LogStatement, for replicas to stream
+	// with COM_BINLOG_DUMP. A restarted server carries on with the files in the
+	// index.
+	LogBin string
+
+	// Size in bytes after which the log moves on to a new file. Transactions are
+	// never split, so files can get larger than this.
+	MaxBinlogSize uint64
+
+	// Number of seconds after which files that are no longer written are removed,
+	// when the server starts and when the log moves on to a new file. 0 keeps them
+	// forever.
+	BinlogExpireLogsSeconds uint64
+
+	// Identifies the server in the binary log and to replicas
+	ServerID uint32
+
+	// Source id of the GTIDs the server assigns, a UUID such as
+	// 3e11fa47-71ca-11e1-9e33-c80aa9429562. If not set, one is derived from ServerID.
+	ServerUUID string
+
+	// Whether binary log events end with a checksum, "CRC32" or "NONE"
+	BinlogChecksum string
+
+	// If set, every connection records all of its packets to a capture file in this
+	// directory. See the trace package and cmd/qld-trace for reading them.
+	TraceDir string
+
+	// Runs the queries qld doesn't answer itself. Without one, such queries fail
+	// with ER_NOT_SUPPORTED_YET. Can only be set from code.
+	QueryHandler QueryHandler `json:"-"`
+
+	// Handlers for commands, by command byte. They replace the built-in handlers,
+	// and a nil handler removes one. Commands without a handler fail with
+	// ER_UNKNOWN_COM_ERROR. Can only be set from code.
+	Commands map[byte]CommandHandler `json:"-"`
+
+	// Networks, in CIDR notation, of the proxies and load balancers in front of the
+	// server. Connections from these must start with a PROXY protocol v1 or v2
+	// header, and the client address in it replaces the proxy's address.
+	ProxyProtocolNetworks []string
 }
 
-func newConfig() (*config, error) {
-	cfg := &config{}
+func NewConfig() (*Config, error) {
+	cfg := &Config{
+		Listeners: []ListenerConfig{
+			{Network: "tcp", Address: ":3306"},
+		},
+		WaitTimeout:        28800,
+		InteractiveTimeout: 28800,
+		ConnectTimeout:     10,
+		NetReadTimeout:     30,
+		NetWriteTimeout:    60,
+		LongQueryTime:      10,
+		ShutdownTimeout:    30,
+		MaxConnections:     151,
+		MaxConnectErrors:   100,
+		HostCacheSize:      279,
+		ServerID:           1,
+		BinlogChecksum:     "CRC32",
+
+		MaxBinlogSize:           1073741824,
+		BinlogExpireLogsSeconds: 2592000,
+
+		ThreadHandling:            "one-thread-per-connection",
+		ThreadPoolOversubscribe:   3,
+		ThreadPoolMaxThreads:      65536,
+		ThreadPoolStallLimit:      500,
+		ThreadPoolHighPrioMode:    "transactions",
+		ThreadPoolHighPrioTickets: 4294967295,
+	}
+
+	return cfg, nil
+}
+
+// LoadConfig reads the configuration from a JSON file. Settings that are not in the
+// file keep their defaults.
+func LoadConfig(path string) (*Config, error) {
+	cfg, err := NewConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("Config/LoadConfig: Error parsing %s: %v", path, err)
+	}
 
 	return cfg, nil
 }
@@ -8,24 +8,56 @@ package qld
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/reducedb/qld/trace"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type connection struct {
 	// Embedded struct so effectively Connection inherits all net.Conn functions
 	net.Conn
 
-	id int
+	// The socket as accepted, before any PROXY or TLS wrapping. Closing it is how
+	// the server forces a connection to end.
+	sock net.Conn
+
+	// Protects idle, info, cancel and killed. A connection is idle while it waits for
+	// the first byte of the next command.
+	mu   sync.Mutex
+	idle bool
+	info connInfo
+
+	// Cancels the context of the command being executed, nil between commands
+	cancel context.CancelFunc
+
+	// Set by KILL CONNECTION
+	killed bool
+
+	// Assigned by the server's connection registry
+	id uint32
+
+	// The server that accepted this connection, and the options of the listener
+	// it came in on
+	srv      *Server
+	listener *ListenerConfig
+
+	// Set once the client has switched to TLS
+	tls bool
 
 	// Random bytes generator
 	rand io.Reader
 
 	// Pointer to the database configurations
-	cfg *config
+	cfg *Config
 
 	// Buffer holding the incoming or outgoing packet. This can technical get very big
 	// since it's never released. If a result set is, say 1 GB, then this buffer will
@@ -45,15 +77,78 @@ type connection struct {
 	charset            byte
 	schema             string
 	authResp           string
+	authPlugin         string
+
+	// The account the client authenticated as. Counted against the connection
+	// limits until the connection ends.
+	account *account
+
+	// Set once the connection counts against max_connections, from before the
+	// handshake until the connection ends
+	counted bool
+
+	// Set when the default database changed and the next OK packet should tell
+	// the client, see session_track_schema
+	schemaChanged bool
+
+	// Server status flags sent in OK and EOF packets, such as whether a transaction
+	// is open
+	status serverStatusFlag
+
+	// High priority commands the thread pool has run for this connection in a row
+	highPrioRun uint64
+
+	// Session system variables and user variables
+	vars     *variables
+	userVars map[string]setValue
+
+	// True until the handshake completes. The whole handshake is bounded by
+	// connect_timeout rather than the per packet network timeouts.
+	handshaking bool
+
+	// Protocol capture, only set when the server is configured with a TraceDir
+	tracer    *trace.Writer
+	traceFile *os.File
 
 	quitChan chan bool
 }
 
 func (this *connection) handleConnectionPhase() error {
-	if err := this.handlePlainHandshake(); err != nil {
+	this.handshaking = true
+	this.SetDeadline(time.Now().Add(this.timeout("connect_timeout")))
+
+	ip := clientIP(this.RemoteAddr())
+
+	maxConnections, _ := this.srv.globals.get("max_connections")
+	err := this.srv.limits.connect(maxConnections)
+	if err == nil {
+		this.counted = true
+		err = this.srv.checkHost(ip)
+	}
+	if err == nil {
+		err = this.handlePlainHandshake()
+	}
+
+	if err != nil {
+		atomic.AddUint64(&this.srv.stats.abortedConnects, 1)
+		this.srv.hostConnectError(ip, err)
+
+		// Let the client know why it's being turned away
+		if _, ok := err.(*SQLError); ok {
+			if err2 := this.writeErrPacket(err); err2 != nil {
+				glog.Error(err2.Error())
+			}
+		}
 		return err
 	}
 
+	this.handshaking = false
+	this.SetDeadline(time.Time{})
+
+	this.srv.hostConnectSuccess(ip)
+
+	this.setLogin(this.username, this.schema)
+
 	glog.V(3).Info("Handshake successful")
 	return nil
 }
@@ -61,7 +156,16 @@ func (this *connection) handleConnectionPhase() error {
 func (this *connection) handleCommandPhase() error {
 	for {
 		cmd, err := this.nextCommand()
-		if err != nil {
+		if err != nil && this.isKilled() {
+			glog.V(3).Infof("Connection #%d killed", this.id)
+			return nil
+		} else if err == errServerShutdown || (err == errIdleTimeout && this.srv.isShuttingDown()) {
+			glog.V(3).Infof("Connection #%d disconnecting for server shutdown", this.id)
+			return this.writeDisconnect(newSQLError(1053, "Server shutdown in progress"))
+		} else if err == errIdleTimeout {
+			glog.V(3).Infof("Connection #%d idle for too long, disconnecting", this.id)
+			return this.writeDisconnect(SQLErrors[4031])
+		} else if err != nil {
 			glog.Error(err.Error())
 			return err
 		}
@@ -71,29 +175,167 @@ func (this *connection) handleCommandPhase() error {
 			return nil
 		}
 
-		if err := cmd.execute(); err != nil {
-			glog.Error(err.Error())
-			if err2 := this.writeErrPacket(err); err2 != nil {
-				glog.Error(err2.Error())
+		// Commands write their own responses. Only SQL errors are reported back to the
+		// client, anything else means the connection is no longer usable.
+		if cmd.isQuestion() {
+			atomic.AddUint64(&this.srv.stats.questions, 1)
+		}
+
+		start := time.Now()
+		ctx, cancel := context.WithCancel(context.Background())
+		this.beginCommand(cmd, cancel)
+		err = this.srv.sched.run(this, func() error {
+			return cmd.execute(ctx, this)
+		})
+		this.endCommand()
+
+		// Whatever error a killed command ended with, the client is told it was
+		// interrupted
+		if _, ok := err.(*SQLError); ok && ctx.Err() != nil {
+			err = newSQLError(1317, "Query execution was interrupted")
+		}
+		cancel()
+
+		if cmd.cmd == comComQuery && time.Since(start) > this.timeout("long_query_time") {
+			atomic.AddUint64(&this.srv.stats.slowQueries, 1)
+		}
+
+		if err != nil {
+			if _, ok := err.(*SQLError); !ok {
+				glog.Error(err.Error())
+				return err
 			}
-		} else {
-			if err2 := this.writeOkPacket(); err2 != nil {
+
+			glog.V(3).Info(err.Error())
+			if err2 := this.writeErrPacket(err); err2 != nil {
 				glog.Error(err2.Error())
+				return err2
 			}
 		}
 	}
+}
 
-	return nil
+// newSessionVars returns the session variables a session starts with. As in mysqld,
+// interactive clients such as the mysql CLI get interactive_timeout as their
+// wait_timeout.
+func (this *connection) newSessionVars() *variables {
+	vars := this.srv.globals.sessionCopy()
+	if this.clientCapabilities&clientInteractive != 0 {
+		if n, ok := vars.get("interactive_timeout"); ok {
+			vars.set("wait_timeout", n)
+		}
+	}
+	return vars
 }
 
 func (this *connection) nextCommand() (*command, error) {
 	this.sequence = 0
 
-	if err := this.readPacket(); err != nil {
+	if !this.srv.isShuttingDown() {
+		this.mu.Lock()
+		this.idle = true
+		this.SetReadDeadline(time.Now().Add(this.timeout("wait_timeout")))
+		this.mu.Unlock()
+
+		err := this.readPacket()
+		if err == nil {
+			return newCommand(this.buf)
+		} else if err != errIdleTimeout || !this.srv.isShuttingDown() {
+			return nil, err
+		}
+	}
+
+	// Once the server is shutting down, the connection only waits a moment for a
+	// COM_PING, which is still answered, before it disconnects
+	this.mu.Lock()
+	this.idle = false
+	this.SetReadDeadline(time.Now().Add(drainPingWait))
+	this.mu.Unlock()
+
+	if err := this.readPacket(); err == errIdleTimeout {
+		return nil, errServerShutdown
+	} else if err != nil {
 		return nil, err
 	}
 
-	return newCommand(this.buf)
+	cmd, err := newCommand(this.buf)
+	if err == nil && cmd.cmd != comPing && cmd.cmd != comQuit {
+		return nil, errServerShutdown
+	}
+	return cmd, err
+}
+
+// snapshot returns the current state of the connection for the process list
+func (this *connection) snapshot() connInfo {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.info
+}
+
+// setLogin records who the connection belongs to once the handshake is done
+func (this *connection) setLogin(user, schema string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.info.User = user
+	this.info.Schema = schema
+	this.info.Command = commandName[comSleep]
+	this.info.State = ""
+	this.info.CommandStart = time.Now()
+}
+
+func (this *connection) setState(state string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.info.State = state
+}
+
+func (this *connection) beginCommand(cmd *command, cancel context.CancelFunc) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.cancel = cancel
+	this.info.Command = cmd.cmdName
+	this.info.State = "starting"
+	this.info.CommandStart = time.Now()
+	if cmd.cmd == comComQuery {
+		this.info.Info = cmd.stmt
+	}
+}
+
+func (this *connection) endCommand() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.cancel = nil
+	this.info.Command = commandName[comSleep]
+	this.info.State = ""
+	this.info.Info = ""
+	this.info.CommandStart = time.Now()
+}
+
+// interruptIfIdle wakes up the connection if it is waiting for the next command, so
+// it notices the server is shutting down
+func (this *connection) interruptIfIdle() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.idle {
+		this.SetReadDeadline(time.Now())
+	}
+}
+
+// writeDisconnect sends an unsolicited error packet just before the server closes
+// the connection, so the client can tell why it was disconnected.
+func (this *connection) writeDisconnect(e *SQLError) error {
+	this.sequence = 0
+	return this.writeErrPacket(e)
+}
+
+func (this *connection) timeout(name string) time.Duration {
+	return time.Duration(this.sysVarValue(name)) * time.Second
 }
 
 func (this *connection) handlePlainHandshake() error {
@@ -109,10 +351,61 @@ func (this *connection) handlePlainHandshake() error {
 		return err
 	}
 
+	// http://dev.mysql.com/doc/internals/en/ssl-handshake.html
+	// An SSLRequest is a handshake response cut short after the 32 bytes of
+	// capabilities, max packet size, charset and filler. The client then starts TLS
+	// and sends the full response over the encrypted connection.
+	if this.buf.Len() == 32 && clientFlag(binary.LittleEndian.Uint32(this.buf.Bytes()))&clientSSL != 0 {
+		if err := this.startTLS(); err != nil {
+			return err
+		}
+
+		if err := this.readPacket(); err != nil {
+			return err
+		}
+	}
+
 	if err := this.parseHandshakeResponse41(); err != nil {
 		return err
 	}
 
+	// Clients that used another method for the auth response are asked to switch to
+	// the one the server supports, with a new challenge
+	if this.authPlugin != "" && this.authPlugin != nativePasswordPlugin {
+		resp, err := this.switchAuthPlugin()
+		if err != nil {
+			return err
+		}
+		this.authResp = string(resp)
+	}
+
+	acct, err := this.srv.accounts.authenticate(this.username, clientIP(this.RemoteAddr()), this.cipher[:], []byte(this.authResp))
+	if err != nil {
+		return err
+	}
+
+	if err := this.checkListener(acct); err != nil {
+		return err
+	}
+
+	if this.schema != "" {
+		if err := this.checkSchema(acct, this.schema); err != nil {
+			return err
+		}
+	}
+
+	maxConnections, _ := this.srv.globals.get("max_connections")
+	maxUserConnections, _ := this.srv.globals.get("max_user_connections")
+	if err := this.srv.limits.admit(acct, maxConnections, maxUserConnections); err != nil {
+		return err
+	}
+
+	if err := this.srv.resources.connect(acct); err != nil {
+		this.srv.limits.release(acct)
+		return err
+	}
+	this.account = acct
+
 	if err := this.writeOkPacket(); err != nil {
 		return err
 	}
@@ -120,9 +413,50 @@ func (this *connection) handlePlainHandshake() error {
 	return nil
 }
 
+func (this *connection) serverCapabilities() clientFlag {
+	if this.srv.tlsConfig != nil {
+		return serverCapabilityFlags | clientSSL
+	}
+	return serverCapabilityFlags
+}
+
+func (this *connection) startTLS() error {
+	if this.srv.tlsConfig == nil {
+		return fmt.Errorf("Connection/startTLS: Client requested TLS but it is not configured")
+	}
+
+	conn := tls.Server(this.Conn, this.srv.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	glog.V(3).Infof("Connection #%d switched to TLS", this.id)
+	this.Conn = conn
+	this.tls = true
+
+	return nil
+}
+
+// checkListener enforces the options of the listener the connection came in on
+func (this *connection) checkListener(acct *account) error {
+	if this.listener.RequireTLS && !isSecure(this.listener, this.tls) {
+		return newSQLError(3159, "Connections using insecure transport are prohibited on this listener")
+	}
+
+	if this.listener.AdminOnly && !acct.isAdmin() {
+		return newSQLError(1227, "Access denied; you need (at least one of) the SERVICE_CONNECTION_ADMIN privilege(s) for this operation")
+	}
+
+	return nil
+}
+
 func (this *connection) writePacket() error {
 	var header [defaultHeaderSize]byte
 
+	if !this.handshaking {
+		this.SetWriteDeadline(time.Now().Add(this.timeout("net_write_timeout")))
+	}
+
 	// Split packets as needed
 	for {
 		data := this.buf.Next(defaultMaxPacketSize)
@@ -149,15 +483,13 @@ func (this *connection) writePacket() error {
 
 		glog.V(3).Infof("Wrote %d bytes", len(data)+len(header))
 
+		this.tracePacket(trace.ServerToClient, data)
 		this.sequence++
 
 		if pktLen < defaultMaxPacketSize {
 			return nil
 		}
 	}
-
-	// Should never reach here
-	return nil
 }
 
 func (this *connection) readPacket() (err error) {
@@ -178,16 +510,26 @@ func (this *connection) readPacket() (err error) {
 
 	// http://dev.mysql.com/doc/internals/en/sending-more-than-16mbyte.html
 	// We are in a for loop to continue reading until payload is < defaultMaxPacketSize
-	for {
+	for first := true; ; first = false {
 		// 4 bytes - packet header
-		if n, err := this.Read(header[:]); err != nil {
+		if n, err := io.ReadFull(this, header[:]); err != nil {
+			if first && n == 0 && !this.handshaking && isTimeout(err) {
+				return errIdleTimeout
+			}
 			return err
-		} else if n != defaultHeaderSize {
-			return fmt.Errorf("Connection/readPacket: Error reading header. Expect %d bytes. Got %d.", defaultHeaderSize, n)
 		} else {
 			glog.V(3).Infof("read data, n = %d", n)
 		}
 
+		// Once a packet starts arriving, the rest of it must arrive within
+		// net_read_timeout
+		if !this.handshaking {
+			this.mu.Lock()
+			this.idle = false
+			this.SetReadDeadline(time.Now().Add(this.timeout("net_read_timeout")))
+			this.mu.Unlock()
+		}
+
 		if header[3] != this.sequence {
 			return fmt.Errorf("Connecton/readPacket: sequence number mismatch")
 		}
@@ -209,6 +551,7 @@ func (this *connection) readPacket() (err error) {
 			this.buf.SetBuffer(data)
 		*/
 
+		start := this.buf.Len()
 		if n, err := io.CopyN(&this.buf, this, int64(pktLen)); err != nil {
 			return err
 		} else if n != int64(pktLen) {
@@ -217,18 +560,16 @@ func (this *connection) readPacket() (err error) {
 
 		glog.V(3).Infof("Read %d bytes", this.buf.Len()+4)
 
+		this.tracePacket(trace.ClientToServer, this.buf.Bytes()[start:])
 		this.sequence++
 
 		if pktLen < defaultMaxPacketSize {
 			return nil
 		}
 	}
-
-	// Should really never get here
-	return nil
 }
 
-//http://dev.mysql.com/doc/internals/en/generic-response-packets.html#packet-ERR_Packet
+// http://dev.mysql.com/doc/internals/en/generic-response-packets.html#packet-ERR_Packet
 func (this *connection) writeErrPacket(e error) error {
 	sqlerr, ok := e.(*SQLError)
 	if !ok {
@@ -279,6 +620,12 @@ func (this *connection) writeErrPacket(e error) error {
 
 // http://dev.mysql.com/doc/internals/en/generic-response-packets.html#packet-OK_Packet
 func (this *connection) writeOkPacket() error {
+	return this.writeOkResult(0, 0, "")
+}
+
+// writeOkResult writes an OK packet for a statement that changed affected rows and
+// generated lastInsertId, with a human readable info message
+func (this *connection) writeOkResult(affected, lastInsertId uint64, info string) error {
 	// Reset the buffer so we are clear for read/write
 	this.buf.Reset()
 
@@ -299,10 +646,48 @@ func (this *connection) writeOkPacket() error {
 		return err
 	}
 
-	if n, err := this.buf.Write([]byte{0, 0, 0, 0, 0, 0}); err != nil {
+	writeLenencInt(&this.buf, affected)
+	writeLenencInt(&this.buf, lastInsertId)
+
+	status := this.status
+	tracked := this.schemaChanged && this.clientCapabilities&clientSessionTrack != 0
+	if tracked {
+		status |= serverSessionStateChanged
+	}
+	this.schemaChanged = false
+
+	if n, err := this.buf.Write([]byte{byte(status), byte(status >> 8), 0, 0}); err != nil {
 		return err
-	} else if n != 6 {
-		return fmt.Errorf("Connection/writeOkPacket: Error writing okPacket. Expecting %d, got %d", 6, n)
+	} else if n != 4 {
+		return fmt.Errorf("Connection/writeOkPacket: Error writing okPacket. Expecting %d, got %d", 4, n)
+	}
+
+	/*
+		if capabilities & CLIENT_SESSION_TRACK {
+			lenenc_str     info
+			if status & SERVER_SESSION_STATE_CHANGED {
+				lenenc_str     session state changes, each
+					1              type
+					lenenc_str     data
+			}
+		}
+	*/
+	if tracked {
+		var change bytes.Buffer
+		writeLenencString(&change, this.schema)
+
+		var state bytes.Buffer
+		state.WriteByte(sessionTrackSchema)
+		writeLenencString(&state, change.String())
+
+		writeLenencString(&this.buf, info)
+		writeLenencString(&this.buf, state.String())
+	} else if this.clientCapabilities&clientSessionTrack != 0 {
+		if info != "" {
+			writeLenencString(&this.buf, info)
+		}
+	} else {
+		this.buf.WriteString(info)
 	}
 
 	//glog.V(3).Infof("ok packet = %#v", this.buf.Bytes())
@@ -346,26 +731,46 @@ func (this *connection) initHandshakeV10() error {
 		return err
 	}
 
+	caps := this.serverCapabilities()
+
 	// 2 bytes - capability flags (lower 2 bytes)
-	if err := binary.Write(&this.buf, binary.LittleEndian, uint16(serverCapabilityFlags)); err != nil {
+	if err := binary.Write(&this.buf, binary.LittleEndian, uint16(caps)); err != nil {
+		return err
+	}
+
+	// 1 byte - character set
+	if err := this.buf.WriteByte(collationUtf8General); err != nil {
+		return err
+	}
+
+	// 2 bytes - status flags
+	if err := binary.Write(&this.buf, binary.LittleEndian, uint16(this.status)); err != nil {
 		return err
 	}
 
-	// if more data in the packet:
-	// 1 byte - character set (optional)
-	// 2 bytes - status flags (optional)
 	// 2 bytes - capability flags (upper 2 bytes)
+	if err := binary.Write(&this.buf, binary.LittleEndian, uint16(caps>>16)); err != nil {
+		return err
+	}
+
 	// if capabilities & CLIENT_PLUGIN_AUTH {
 	// 	1 byte - length of auth-plugin-data
 	// } else {
 	// 	1 byte - [00]
 	// }
+	var authLen byte
+	if caps&clientPluginAuth != 0 {
+		authLen = byte(len(this.cipher) + 1)
+	}
+	if err := this.buf.WriteByte(authLen); err != nil {
+		return err
+	}
+
 	// 10 bytes - string[10] reserved (all [00])
-	// So 16 bytes of 0x00
-	if n, err := this.buf.Write([]byte{collationUtf8General, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+	if n, err := this.buf.Write(make([]byte, 10)); err != nil {
 		return err
-	} else if n != 16 {
-		return fmt.Errorf("Connection/writeInitialHandshakePacket: Error writing charset, status and capability flags. Expecting %d, got %d", 16, n)
+	} else if n != 10 {
+		return fmt.Errorf("Connection/writeInitialHandshakePacket: Error writing reserved bytes. Expecting %d, got %d", 10, n)
 	}
 
 	// Write the last 12 bytes of cipher
@@ -381,17 +786,13 @@ func (this *connection) initHandshakeV10() error {
 		return err
 	}
 
-	/*
-		  if capabilities & CLIENT_SECURE_CONNECTION {
-		string[$len]   auth-plugin-data-part-2 ($len=MAX(13, length of auth-plugin-data - 8))
-		  if capabilities & CLIENT_PLUGIN_AUTH {
-		    if version >= (5.5.7 and < 5.5.10) or (>= 5.6.0 and < 5.6.2) {
-		string[EOF]    auth-plugin name
-		    } elseif version >= 5.5.10 or >= 5.6.2 {
-		string[NUL]    auth-plugin name
-		    }
-		  }
-	*/
+	// string[NUL]    auth-plugin name
+	if caps&clientPluginAuth != 0 {
+		this.buf.WriteString(nativePasswordPlugin)
+		if err := this.buf.WriteByte(0x00); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -405,6 +806,8 @@ func (this *connection) parseHandshakeResponse41() error {
 	}
 	glog.V(3).Infof("Client capabilities = 0x%x, %032b", this.clientCapabilities, this.clientCapabilities)
 
+	this.vars = this.newSessionVars()
+
 	// 4 bytes - max-packet size
 	this.maxPktSize = binary.LittleEndian.Uint32(this.buf.Next(4))
 	if this.maxPktSize == 0 {
@@ -432,7 +835,7 @@ func (this *connection) parseHandshakeResponse41() error {
 	if err != nil {
 		return err
 	}
-	this.username = string(tmp)
+	this.username = string(bytes.TrimRight(tmp, "\x00"))
 	glog.V(3).Infof("User name = %s", this.username)
 
 	// if capabilities & CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA {
@@ -477,16 +880,29 @@ func (this *connection) parseHandshakeResponse41() error {
 	// 	string[NUL]    database
 	// }
 
-	if serverCapabilityFlags&clientConnectWithDB != 0 {
+	if this.clientCapabilities&clientConnectWithDB != 0 {
 		if tmp, err := this.buf.ReadBytes(0x00); err != nil && err != io.EOF {
 			return err
 		} else {
-			this.schema = string(tmp)
+			this.schema = string(bytes.TrimRight(tmp, "\x00"))
 		}
 	}
 	glog.V(3).Infof("Schema = %s", this.schema)
 
-	// This should be the end of the packet
+	// if capabilities & CLIENT_PLUGIN_AUTH {
+	// 	string[NUL]    auth plugin name
+	// }
+
+	if this.clientCapabilities&clientPluginAuth != 0 {
+		if tmp, err := this.buf.ReadBytes(0x00); err != nil && err != io.EOF {
+			return err
+		} else {
+			this.authPlugin = string(bytes.TrimRight(tmp, "\x00"))
+		}
+	}
+	glog.V(3).Infof("Auth plugin = %s", this.authPlugin)
+
+	// Connection attributes may follow, which are ignored
 
 	return nil
 }
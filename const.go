@@ -181,6 +181,8 @@ const (
 	clientConnectAttrs                                      // Client supports connection attributes
 	clientPluginAuthLenencClientData                        // Enable authentication response packet to be larger than 255 bytes
 	clientCanHandleExpiredPasswords                         // Don't close the connection for a connection with expired password
+	clientSessionTrack                                      // Client can handle session state changes in OK packets
+	clientDeprecateEOF                                      // Client no longer needs EOF packets
 	clientSSLVerifyServerCert        clientFlag = 1 << 30
 	clientRememberOptions            clientFlag = 1 << 31
 )
@@ -196,7 +198,10 @@ const serverCapabilityFlags = clientLongPassword |
 	//	clientSSL |
 	// clientTransactions |
 	// clientReserved |
-	clientSecureConnection
+	clientSecureConnection |
+	clientMultiStatements |
+	clientPluginAuth |
+	clientSessionTrack
 
 // http://dev.mysql.com/doc/internals/en/status-flags.html
 type serverStatusFlag uint32
@@ -231,6 +236,80 @@ const (
 	// or aborts. Since this flag is sent to clients in OK and EOF packets, the flag
 	// indicates the transaction status at the end of command execution.
 	serverStatusInTransReadOnly
+
+	// The OK packet carries session state changes, for clients with
+	// clientSessionTrack
+	serverSessionStateChanged
+)
+
+// Options of comSetOption
+// http://dev.mysql.com/doc/internals/en/com-set-option.html
+const (
+	optionMultiStatementsOn uint16 = iota
+	optionMultiStatementsOff
+)
+
+// The binary log events the server writes
+// http://dev.mysql.com/doc/internals/en/binlog-event-type.html
+type binlogEventType byte
+
+const (
+	binlogQueryEvent             binlogEventType = 2
+	binlogRotateEvent            binlogEventType = 4
+	binlogFormatDescriptionEvent binlogEventType = 15
+	binlogXIDEvent               binlogEventType = 16
+	binlogTableMapEvent          binlogEventType = 19
+	binlogHeartbeatEvent         binlogEventType = 27
+	binlogWriteRowsEvent         binlogEventType = 30
+	binlogUpdateRowsEvent        binlogEventType = 31
+	binlogDeleteRowsEvent        binlogEventType = 32
+	binlogGTIDEvent              binlogEventType = 33
+	binlogPreviousGTIDsEvent     binlogEventType = 35
+)
+
+// Names of the event types in SHOW BINLOG EVENTS
+var binlogEventNames map[binlogEventType]string = map[binlogEventType]string{
+	binlogQueryEvent:             "Query",
+	binlogRotateEvent:            "Rotate",
+	binlogFormatDescriptionEvent: "Format_desc",
+	binlogXIDEvent:               "Xid",
+	binlogTableMapEvent:          "Table_map",
+	binlogHeartbeatEvent:         "Heartbeat",
+	binlogWriteRowsEvent:         "Write_rows",
+	binlogUpdateRowsEvent:        "Update_rows",
+	binlogDeleteRowsEvent:        "Delete_rows",
+	binlogGTIDEvent:              "Gtid",
+	binlogPreviousGTIDsEvent:     "Previous_gtids",
+}
+
+// Flags in the header of binary log events
+// http://dev.mysql.com/doc/internals/en/binlog-event-flag.html
+const (
+	// The event was made up for a replica and is not in any log
+	logEventArtificial uint16 = 0x20
+)
+
+// Flags of rows events
+const (
+	// The last rows event of a statement
+	rowsStmtEnd uint16 = 0x01
+)
+
+// Flags of comBinlogDump and comBinlogDumpGTID
+// http://dev.mysql.com/doc/internals/en/com-binlog-dump.html
+const (
+	// Send an EOF packet at the end of the log instead of waiting for more events
+	binlogDumpNonBlock uint16 = 0x01
+
+	// comBinlogDumpGTID carries the set of GTIDs the replica already has
+	binlogDumpThroughGTID uint16 = 0x04
+)
+
+// http://dev.mysql.com/doc/internals/en/packet-OK_Packet.html#cs-sect-packet-ok-sessioninfo
+const (
+	sessionTrackSystemVariables byte = iota
+	sessionTrackSchema
+	sessionTrackStateChange
 )
 
 // Server status flags that must be cleared when starting execution of a new SQL
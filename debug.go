@@ -0,0 +1,80 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/glog"
+	"runtime"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// handleDebug answers COM_DEBUG, as sent by mysqladmin debug, by writing the state of
+// the server to the log
+// http://dev.mysql.com/doc/internals/en/com-debug.html
+func (this *connection) handleDebug() error {
+	if err := this.checkPrivilege(privSuper, "SUPER"); err != nil {
+		return err
+	}
+
+	glog.Infof("Connection #%d: Debug information requested by %s\n%s", this.id, this.account, this.srv.debugState())
+	return this.writeEOFPacket()
+}
+
+// debugState describes what the server is doing, for COM_DEBUG
+func (this *Server) debugState() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Status information:\n\n")
+	fmt.Fprintf(&buf, "Uptime: %d  Threads: %d  Questions: %d  Slow queries: %d  Opened tables: %d\n",
+		this.statusValue("Uptime"),
+		this.statusValue("Threads_connected"),
+		this.statusValue("Questions"),
+		this.statusValue("Slow_queries"),
+		this.statusValue("Opened_tables"))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(&buf, "Goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(&buf, "Memory: %d bytes allocated, %d bytes of heap, %d bytes from the system, %d garbage collections\n",
+		mem.Alloc, mem.HeapSys, mem.Sys, mem.NumGC)
+
+	// Connections waiting in the thread pool queues are the ones waiting for a worker
+	if tp, ok := this.sched.(*threadPool); ok {
+		fmt.Fprintf(&buf, "\nThread pool: %d threads, %d idle, %d stalls\n",
+			atomic.LoadInt64(&tp.threads), atomic.LoadInt64(&tp.idle), atomic.LoadUint64(&tp.stalls))
+
+		for i, g := range tp.groups {
+			g.mu.Lock()
+			fmt.Fprintf(&buf, "Group %d: %d workers, %d high and %d low priority commands waiting\n", i, g.workers, len(g.high), len(g.low))
+			g.mu.Unlock()
+		}
+	}
+
+	fmt.Fprintf(&buf, "\nConnections:\n")
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Id\tUser\tHost\tdb\tCommand\tTime\tState\tInfo")
+
+	now := time.Now()
+	for _, info := range this.conns.snapshot() {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", info.Id, info.User, info.Host, info.Schema,
+			info.Command, now.Sub(info.CommandStart)/time.Second, info.State, info.Info)
+	}
+	w.Flush()
+
+	if dumper, ok := this.cfg.QueryHandler.(StateDumper); ok {
+		fmt.Fprintf(&buf, "\nQuery handler:\n")
+		if err := dumper.DumpState(&buf); err != nil {
+			fmt.Fprintf(&buf, "Error getting query handler state: %v\n", err)
+		}
+	}
+
+	return buf.String()
+}
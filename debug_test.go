@@ -0,0 +1,74 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type dumpHandler struct {
+	QueryHandlerFunc
+	dumps int32
+}
+
+func (this *dumpHandler) DumpState(w io.Writer) error {
+	atomic.AddInt32(&this.dumps, 1)
+	_, err := fmt.Fprintln(w, "2 tables open")
+	return err
+}
+
+func TestDebug(t *testing.T) {
+	h := &dumpHandler{}
+
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.ThreadHandling = poolOfThreads
+	cfg.QueryHandler = h
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"SUPER"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	login := func(user string) *rawClient {
+		c, p := dialRawWith(t, s, rawLogin{user: user, password: "p"})
+		if p[0] != okPacket {
+			t.Fatalf("Handshake failed: %q", p)
+		}
+		return c
+	}
+
+	u := login("u")
+	defer u.Close()
+	admin := login("admin")
+	defer admin.Close()
+
+	if p, err := u.command(comDebug, nil); err != nil || errCode(p) != 1227 {
+		t.Errorf("Expecting ER_SPECIFIC_ACCESS_DENIED_ERROR, got %q, %v", p, err)
+	}
+
+	if p, err := admin.command(comDebug, nil); err != nil || p[0] != eofPacket {
+		t.Errorf("Expecting EOF, got %q, %v", p, err)
+	}
+
+	if n := atomic.LoadInt32(&h.dumps); n != 1 {
+		t.Errorf("Expecting 1 dump, got %d", n)
+	}
+
+	state := s.debugState()
+	for _, expected := range []string{"Threads: 2", "Goroutines: ", "Thread pool: ", "Group 0: ", "Sleep", "admin", "2 tables open"} {
+		if !strings.Contains(state, expected) {
+			t.Errorf("Expecting %q in\n%s", expected, state)
+		}
+	}
+}
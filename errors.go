@@ -12,7 +12,12 @@ import (
 )
 
 var (
-	errNotProtocol41 = errors.New("Client does not support protocol 4.1+")
+	errNotProtocol41  = errors.New("Client does not support protocol 4.1+")
+	errIdleTimeout    = errors.New("Connection idle timeout exceeded")
+	errServerShutdown = errors.New("Server is shutting down")
+
+	errChangeUserFailed = errors.New("COM_CHANGE_USER failed, closing connection")
+	errBinlogClosed     = errors.New("Binary log is not open")
 )
 
 type SQLError struct {
@@ -27,6 +32,15 @@ func (this *SQLError) Error() string {
 	return fmt.Sprintf("%s(%d): %s", this.State, this.Code, this.Message)
 }
 
+// newSQLError returns a copy of the SQLError registered under code, with the message
+// replaced by the formatted one. The entries in SQLErrors are shared, so they should
+// never be modified directly.
+func newSQLError(code int, format string, args ...interface{}) *SQLError {
+	e := *SQLErrors[code]
+	e.Message = fmt.Sprintf(format, args...)
+	return &e
+}
+
 var SQLErrors map[int]*SQLError = map[int]*SQLError{
 	1022: &SQLError{1022, "ER_DUP_KEY", "23000"},
 	1037: &SQLError{1037, "ER_OUTOFMEMORY", "HY001"},
@@ -36,7 +50,9 @@ var SQLErrors map[int]*SQLError = map[int]*SQLError{
 	1043: &SQLError{1043, "ER_HANDSHAKE_ERROR", "08S01"},
 	1044: &SQLError{1044, "ER_DBACCESS_DENIED_ERROR", "42000"},
 	1045: &SQLError{1045, "ER_ACCESS_DENIED_ERROR", "28000"},
+	1046: &SQLError{1046, "ER_NO_DB_ERROR", "3D000"},
 	1047: &SQLError{1047, "ER_UNKNOWN_COM_ERROR", "HY000"},
+	1049: &SQLError{1049, "ER_BAD_DB_ERROR", "42000"},
 	1050: &SQLError{1050, "ER_TABLE_EXISTS_ERROR", "42S01"},
 	1051: &SQLError{1051, "ER_BAD_TABLE_ERROR", "42S02"},
 	1052: &SQLError{1052, "ER_NON_UNIQ_ERROR", "23000"},
@@ -70,10 +86,13 @@ var SQLErrors map[int]*SQLError = map[int]*SQLError{
 	1084: &SQLError{1084, "ER_BLOBS_AND_NO_TERMINATED", "42000"},
 	1090: &SQLError{1090, "ER_CANT_REMOVE_ALL_FIELDS", "42000"},
 	1091: &SQLError{1091, "ER_CANT_DROP_FIELD_OR_KEY", "42000"},
+	1094: &SQLError{1094, "ER_NO_SUCH_THREAD", "HY000"},
+	1095: &SQLError{1095, "ER_KILL_DENIED_ERROR", "HY000"},
 	1101: &SQLError{1101, "ER_BLOB_CANT_HAVE_DEFAULT", "42000"},
 	1102: &SQLError{1102, "ER_WRONG_DB_NAME", "42000"},
 	1103: &SQLError{1103, "ER_WRONG_TABLE_NAME", "42000"},
 	1104: &SQLError{1104, "ER_TOO_BIG_SELECT", "42000"},
+	1105: &SQLError{1105, "ER_UNKNOWN_ERROR", "HY000"},
 	1106: &SQLError{1106, "ER_UNKNOWN_PROCEDURE", "42000"},
 	1107: &SQLError{1107, "ER_WRONG_PARAMCOUNT_TO_PROCEDURE", "42000"},
 	1109: &SQLError{1109, "ER_UNKNOWN_TABLE", "42S02"},
@@ -128,6 +147,7 @@ var SQLErrors map[int]*SQLError = map[int]*SQLError{
 	1184: &SQLError{1184, "ER_NEW_ABORTING_CONNECTION", "08S01"},
 	1189: &SQLError{1189, "ER_MASTER_NET_READ", "08S01"},
 	1190: &SQLError{1190, "ER_MASTER_NET_WRITE", "08S01"},
+	1193: &SQLError{1193, "ER_UNKNOWN_SYSTEM_VARIABLE", "HY000"},
 	1203: &SQLError{1203, "ER_TOO_MANY_USER_CONNECTIONS", "42000"},
 	1205: &SQLError{1205, "ER_LOCK_WAIT_TIMEOUT", "41000"},
 	1207: &SQLError{1207, "ER_READ_ONLY_TRANSACTION", "25000"},
@@ -136,13 +156,19 @@ var SQLErrors map[int]*SQLError = map[int]*SQLError{
 	1216: &SQLError{1216, "ER_NO_REFERENCED_ROW", "23000"},
 	1217: &SQLError{1217, "ER_ROW_IS_REFERENCED", "23000"},
 	1218: &SQLError{1218, "ER_CONNECT_TO_MASTER", "08S01"},
+	1220: &SQLError{1220, "ER_ERROR_WHEN_EXECUTING_COMMAND", "HY000"},
 	1222: &SQLError{1222, "ER_WRONG_NUMBER_OF_COLUMNS_IN_SELECT", "21000"},
 	1226: &SQLError{1226, "ER_USER_LIMIT_REACHED", "42000"},
+	1227: &SQLError{1227, "ER_SPECIFIC_ACCESS_DENIED_ERROR", "42000"},
+	1228: &SQLError{1228, "ER_LOCAL_VARIABLE", "HY000"},
+	1229: &SQLError{1229, "ER_GLOBAL_VARIABLE", "HY000"},
 	1230: &SQLError{1230, "ER_NO_DEFAULT", "42000"},
 	1231: &SQLError{1231, "ER_WRONG_VALUE_FOR_VAR", "42000"},
 	1232: &SQLError{1232, "ER_WRONG_TYPE_FOR_VAR", "42000"},
 	1234: &SQLError{1234, "ER_CANT_USE_OPTION_HERE", "42000"},
 	1235: &SQLError{1235, "ER_NOT_SUPPORTED_YET", "42000"},
+	1236: &SQLError{1236, "ER_MASTER_FATAL_ERROR_READING_BINLOG", "HY000"},
+	1238: &SQLError{1238, "ER_INCORRECT_GLOBAL_LOCAL_VAR", "HY000"},
 	1239: &SQLError{1239, "ER_WRONG_FK_DEF", "42000"},
 	1241: &SQLError{1241, "ER_OPERAND_COLUMNS", "21000"},
 	1242: &SQLError{1242, "ER_SUBQUERY_NO_1_ROW", "21000"},
@@ -161,4 +187,13 @@ var SQLErrors map[int]*SQLError = map[int]*SQLError{
 	1280: &SQLError{1280, "ER_WRONG_NAME_FOR_INDEX", "42000"},
 	1281: &SQLError{1281, "ER_WRONG_NAME_FOR_CATALOG", "42000"},
 	1286: &SQLError{1286, "ER_UNKNOWN_STORAGE_ENGINE", "42000"},
+	1290: &SQLError{1290, "ER_OPTION_PREVENTS_STATEMENT", "HY000"},
+	1317: &SQLError{1317, "ER_QUERY_INTERRUPTED", "70100"},
+	1372: &SQLError{1372, "ER_PASSWORD_FORMAT", "HY000"},
+	1381: &SQLError{1381, "ER_NO_BINARY_LOGGING", "HY000"},
+	1396: &SQLError{1396, "ER_CANNOT_USER", "HY000"},
+	1524: &SQLError{1524, "ER_PLUGIN_IS_NOT_LOADED", "HY000"},
+	1835: &SQLError{1835, "ER_MALFORMED_PACKET", "HY000"},
+	3159: &SQLError{3159, "ER_SECURE_TRANSPORT_REQUIRED", "HY000"},
+	4031: &SQLError{4031, "ER_CLIENT_INTERACTION_TIMEOUT", "HY000"},
 }
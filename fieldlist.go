@@ -0,0 +1,91 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+)
+
+// handleFieldList sends the definitions of the columns of a table in the default
+// database whose names match a LIKE pattern, each followed by its default value, and
+// then an EOF packet.
+// http://dev.mysql.com/doc/internals/en/com-field-list.html
+func (this *connection) handleFieldList(ctx context.Context, payload []byte) error {
+	/*
+		string[NUL]    table
+		string[EOF]    field wildcard
+	*/
+	table, wildcard := payload, []byte(nil)
+	if i := bytes.IndexByte(payload, 0); i >= 0 {
+		table, wildcard = payload[:i], payload[i+1:]
+	}
+
+	if this.schema == "" {
+		return newSQLError(1046, "No database selected")
+	}
+
+	cols, err := this.tableColumns(ctx, this.schema, string(table))
+	if err != nil {
+		return err
+	}
+
+	for _, col := range cols {
+		if len(wildcard) > 0 && !likeMatch(string(wildcard), col.name) {
+			continue
+		}
+
+		this.buf.Reset()
+		appendColumnDef(&this.buf, col)
+		if col.defaultValue == nil {
+			this.buf.WriteByte(0xfb)
+		} else {
+			writeLenencString(&this.buf, *col.defaultValue)
+		}
+
+		if err := this.writePacket(); err != nil {
+			return err
+		}
+	}
+
+	return this.writeEOFPacket()
+}
+
+// tableColumns returns the columns of schema.table, from either the system tables
+// or the query handler
+func (this *connection) tableColumns(ctx context.Context, schema, table string) ([]*columnDef, error) {
+	atomic.AddUint64(&this.srv.stats.openedTables, 1)
+
+	if t, ok := lookupSystemTable(schema, table); ok {
+		cols, _, err := t(this)
+		return cols, err
+	}
+
+	var columns []Column
+	if lister, ok := this.srv.cfg.QueryHandler.(ColumnLister); ok {
+		var err error
+		if columns, err = lister.ListColumns(ctx, this, schema, table); err != nil {
+			return nil, handlerError(err)
+		}
+	}
+
+	if columns == nil {
+		return nil, newSQLError(1146, "Table '%s.%s' doesn't exist", schema, table)
+	}
+
+	cols := make([]*columnDef, len(columns))
+	for i := range columns {
+		col := columns[i]
+		if col.Schema == "" && col.Table == "" {
+			col.Schema, col.Table = schema, table
+		}
+		cols[i] = col.columnDef()
+	}
+
+	return cols, nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type columnsHandler struct {
+	QueryHandlerFunc
+}
+
+func (this columnsHandler) ListColumns(ctx context.Context, session Session, schema, table string) ([]Column, error) {
+	if schema != "testdb" || table != "t" {
+		return nil, nil
+	}
+
+	zero := "0"
+	return []Column{
+		{Name: "id", Type: TypeLongLong, NotNull: true},
+		{Name: "name", Type: TypeVarChar},
+		{Name: "count", Type: TypeLong, Default: &zero},
+	}, nil
+}
+
+// fieldList sends COM_FIELD_LIST and returns the name and default of each column, or
+// the error code
+func fieldList(t *testing.T, c *rawClient, args string) ([][2]string, int) {
+	p, err := c.command(comFieldList, []byte(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields [][2]string
+	for ; p[0] != eofPacket; p, err = c.readPacket() {
+		if err != nil {
+			t.Fatal(err)
+		} else if code := errCode(p); code != 0 {
+			return nil, code
+		}
+
+		// catalog, schema, table, org_table, name, org_name, then 13 bytes of fixed
+		// length fields and the default
+		var strs []string
+		for i := 0; i < 6; i++ {
+			strs = append(strs, string(p[1:1+p[0]]))
+			p = p[1+p[0]:]
+		}
+
+		def := "NULL"
+		if p = p[13:]; p[0] != 0xfb {
+			def = string(p[1 : 1+p[0]])
+		}
+		fields = append(fields, [2]string{strs[4], def})
+	}
+
+	return fields, 0
+}
+
+func TestFieldList(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.QueryHandler = columnsHandler{}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	c, p := dialRawWith(t, s, rawLogin{user: "fields", schema: "testdb"})
+	defer c.Close()
+	if p[0] != okPacket {
+		t.Fatalf("Handshake failed: %q", p)
+	}
+
+	all := [][2]string{{"id", "NULL"}, {"name", "NULL"}, {"count", "0"}}
+	tests := []struct {
+		args   string
+		fields [][2]string
+		code   int
+	}{
+		{"t\x00", all, 0},
+		{"t", all, 0},
+		{"t\x00%", all, 0},
+		{"t\x00_a%", [][2]string{{"name", "NULL"}}, 0},
+		{"t\x00x%", nil, 0},
+		{"missing\x00", nil, 1146},
+	}
+
+	for _, test := range tests {
+		fields, code := fieldList(t, c, test.args)
+		if code != test.code || !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%q: expecting %v, %d, got %v, %d", test.args, test.fields, test.code, fields, code)
+		}
+	}
+
+	if _, err := c.command(comInitDB, []byte("performance_schema")); err != nil {
+		t.Fatal(err)
+	}
+	if fields, code := fieldList(t, c, "host_cache\x00%ERROR_SEEN"); code != 0 || len(fields) != 2 {
+		t.Errorf("Expecting 2 host_cache columns, got %v, %d", fields, code)
+	}
+
+	// Without a default database
+	c2 := dialRaw(t, s, "fields")
+	defer c2.Close()
+	if _, code := fieldList(t, c2, "t\x00"); code != 1046 {
+		t.Errorf("Expecting ER_NO_DB_ERROR, got %d", code)
+	}
+}
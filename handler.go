@@ -0,0 +1,386 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"io"
+)
+
+// QueryHandler executes the queries qld doesn't answer itself. It is set with
+// Config.QueryHandler and called from the goroutine running the query, so calls for
+// different sessions can run at the same time.
+type QueryHandler interface {
+	// HandleQuery runs a single SQL statement. It returns either a Result, which has
+	// Rows for statements that produce a result set, or an error. Errors that are not
+	// a *SQLError are sent to the client as ER_UNKNOWN_ERROR. ctx is canceled if the
+	// query is killed.
+	HandleQuery(ctx context.Context, session Session, sql string) (*Result, error)
+}
+
+// QueryHandlerFunc adapts a function to the QueryHandler interface
+type QueryHandlerFunc func(ctx context.Context, session Session, sql string) (*Result, error)
+
+func (this QueryHandlerFunc) HandleQuery(ctx context.Context, session Session, sql string) (*Result, error) {
+	return this(ctx, session, sql)
+}
+
+// CommandHandler answers a command sent by a client, with payload holding the packet
+// after the command byte. Handlers are set with Config.Commands. A handler either
+// writes a response with w or returns an error, which is sent to the client as an ERR
+// packet. Errors that are not a *SQLError are sent as ER_UNKNOWN_ERROR.
+// http://dev.mysql.com/doc/internals/en/text-protocol.html
+type CommandHandler func(ctx context.Context, session Session, payload []byte, w ResponseWriter) error
+
+// ResponseWriter sends the response to a command
+type ResponseWriter interface {
+	// WriteOK sends an OK packet
+	WriteOK(affectedRows, lastInsertId uint64, info string) error
+
+	// WriteEOF sends an EOF packet, as some commands expect instead of an OK
+	WriteEOF() error
+
+	// WriteResult sends an OK packet or a result set, as for a query
+	WriteResult(res *Result) error
+
+	// WritePacket sends p as it is, for commands with their own response format
+	WritePacket(p []byte) error
+}
+
+// ColumnLister is implemented by query handlers that can describe the columns of
+// their tables, as old clients ask for with COM_FIELD_LIST
+type ColumnLister interface {
+	// ListColumns returns the columns of schema.table, or nil if there is no such
+	// table
+	ListColumns(ctx context.Context, session Session, schema, table string) ([]Column, error)
+}
+
+// SessionResetter is implemented by query handlers that keep state for sessions,
+// such as temporary tables, user locks or prepared statements. ResetSession is
+// called when a client resets its session with COM_RESET_CONNECTION or
+// COM_CHANGE_USER, after any open transaction has been rolled back, and should drop
+// all of it.
+type SessionResetter interface {
+	ResetSession(ctx context.Context, session Session) error
+}
+
+// TableFlusher is implemented by query handlers that keep tables open or cached.
+// FlushTables is called for FLUSH TABLES and should close all of them.
+type TableFlusher interface {
+	FlushTables(ctx context.Context) error
+}
+
+// StateDumper is implemented by query handlers with state worth seeing when
+// debugging, such as open tables, lock waits or cache usage. DumpState is called for
+// COM_DEBUG, as sent by mysqladmin debug, and its output goes to the server log.
+type StateDumper interface {
+	DumpState(w io.Writer) error
+}
+
+// Session is what handlers can see of the client connection a query came in on
+type Session interface {
+	// The connection id, as shown in the process list
+	ID() uint32
+
+	// The user name the client logged in with, and its host:port
+	User() string
+	Host() string
+
+	// The default database, empty if none was selected
+	Schema() string
+
+	// True between BEGIN or START TRANSACTION and COMMIT or ROLLBACK
+	InTransaction() bool
+}
+
+// Result is the outcome of a statement. Statements that don't return rows leave
+// Rows nil and the client receives an OK packet with AffectedRows, LastInsertId and
+// Info. Otherwise Rows is streamed to the client as a result set.
+type Result struct {
+	AffectedRows uint64
+	LastInsertId uint64
+	Info         string
+
+	Rows Rows
+}
+
+// Rows is a result set read one row at a time, so results don't need to be held in
+// memory in full
+type Rows interface {
+	Columns() []Column
+
+	// Next returns the values of the next row, one per column, or io.EOF after the
+	// last row. A nil value is NULL. Other values are sent in their text form:
+	// strings and []byte as they are, numbers in decimal, bool as 1 or 0, and
+	// time.Time according to the column type.
+	Next() ([]interface{}, error)
+
+	// Close is called once the result set has been sent, or sending it failed
+	Close() error
+}
+
+// ColumnType is the MySQL type of a column
+// http://dev.mysql.com/doc/internals/en/com-query-response.html#column-type
+type ColumnType byte
+
+const (
+	TypeDecimal   = ColumnType(fieldTypeNewDecimal)
+	TypeTiny      = ColumnType(fieldTypeTiny)
+	TypeShort     = ColumnType(fieldTypeShort)
+	TypeLong      = ColumnType(fieldTypeLong)
+	TypeLongLong  = ColumnType(fieldTypeLongLong)
+	TypeFloat     = ColumnType(fieldTypeFloat)
+	TypeDouble    = ColumnType(fieldTypeDouble)
+	TypeNull      = ColumnType(fieldTypeNull)
+	TypeTimestamp = ColumnType(fieldTypeTimestamp)
+	TypeDate      = ColumnType(fieldTypeDate)
+	TypeTime      = ColumnType(fieldTypeTime)
+	TypeDateTime  = ColumnType(fieldTypeDateTime)
+	TypeYear      = ColumnType(fieldTypeYear)
+	TypeBit       = ColumnType(fieldTypeBit)
+	TypeEnum      = ColumnType(fieldTypeEnum)
+	TypeSet       = ColumnType(fieldTypeSet)
+	TypeBlob      = ColumnType(fieldTypeBlob)
+	TypeVarChar   = ColumnType(fieldTypeVarString)
+	TypeChar      = ColumnType(fieldTypeString)
+)
+
+// Column describes a column of a result set
+type Column struct {
+	Name string
+
+	// Where the column comes from, if anywhere
+	Schema string
+	Table  string
+
+	Type ColumnType
+
+	// Maximum display length in characters, 0 for a default based on Type
+	Length uint32
+
+	// Digits after the decimal point, for TypeDecimal, TypeFloat and TypeDouble
+	Decimals byte
+
+	Unsigned bool
+	NotNull  bool
+
+	// The column's default value in its text form, nil if it has none. Only sent for
+	// COM_FIELD_LIST.
+	Default *string
+}
+
+// Default display lengths in characters, by type
+var columnLengths map[ColumnType]uint32 = map[ColumnType]uint32{
+	TypeDecimal:   65,
+	TypeTiny:      4,
+	TypeShort:     6,
+	TypeLong:      11,
+	TypeLongLong:  20,
+	TypeFloat:     12,
+	TypeDouble:    22,
+	TypeTimestamp: 19,
+	TypeDate:      10,
+	TypeTime:      10,
+	TypeDateTime:  19,
+	TypeYear:      4,
+	TypeBit:       1,
+	TypeBlob:      65535,
+	TypeVarChar:   255,
+	TypeChar:      255,
+}
+
+// isTextType returns true for types whose values are character strings
+func isTextType(t ColumnType) bool {
+	switch t {
+	case TypeVarChar, TypeChar, TypeEnum, TypeSet:
+		return true
+	}
+	return false
+}
+
+// columnDef converts a Column to the definition sent to clients
+func (this *Column) columnDef() *columnDef {
+	col := &columnDef{
+		schema:   this.Schema,
+		table:    this.Table,
+		orgTable: this.Table,
+		name:     this.Name,
+		orgName:  this.Name,
+		length:   this.Length,
+		typ:      fieldType(this.Type),
+		decimals: this.Decimals,
+	}
+
+	if col.length == 0 {
+		col.length = columnLengths[this.Type]
+	}
+
+	if isTextType(this.Type) {
+		col.charset = collationUtf8General
+		col.length *= 3
+	} else {
+		col.charset = collationBinary
+		col.flags |= uint16(flagBinary)
+	}
+
+	if this.Unsigned {
+		col.flags |= uint16(flagUnsigned)
+	}
+	if this.NotNull {
+		col.flags |= uint16(flagNotNull)
+		if this.Default == nil {
+			col.flags |= uint16(flagNoDefaultValue)
+		}
+	}
+
+	col.defaultValue = this.Default
+
+	return col
+}
+
+func (this *connection) ID() uint32 {
+	return this.id
+}
+
+func (this *connection) User() string {
+	return this.username
+}
+
+func (this *connection) Host() string {
+	return this.snapshot().Host
+}
+
+func (this *connection) Schema() string {
+	return this.schema
+}
+
+func (this *connection) InTransaction() bool {
+	return this.status&serverStatusInTrans != 0
+}
+
+// commandFunc adapts the handler to the commands of a server
+func (this CommandHandler) commandFunc() commandFunc {
+	return func(ctx context.Context, c *connection, cmd *command) error {
+		w := &responseWriter{c: c}
+		err := this(ctx, c, cmd.payload, w)
+
+		// Failing to write means the connection is no longer usable
+		if w.err != nil {
+			return w.err
+		} else if err != nil {
+			return handlerError(err)
+		}
+
+		return nil
+	}
+}
+
+// responseWriter writes to a connection, remembering the first write error
+type responseWriter struct {
+	c   *connection
+	err error
+}
+
+func (this *responseWriter) check(err error) error {
+	if err != nil && this.err == nil {
+		if _, ok := err.(*SQLError); !ok {
+			this.err = err
+		}
+	}
+	return err
+}
+
+func (this *responseWriter) WriteOK(affectedRows, lastInsertId uint64, info string) error {
+	return this.check(this.c.writeOkResult(affectedRows, lastInsertId, info))
+}
+
+func (this *responseWriter) WriteEOF() error {
+	return this.check(this.c.writeEOFPacket())
+}
+
+func (this *responseWriter) WriteResult(res *Result) error {
+	err := this.c.writeResult(res)
+	if _, ok := err.(*SQLError); ok {
+		// The result set was cut short by its rows, end it with an ERR packet
+		return this.check(this.c.writeErrPacket(err))
+	}
+	return this.check(err)
+}
+
+func (this *responseWriter) WritePacket(p []byte) error {
+	this.c.buf.Reset()
+	this.c.buf.Write(p)
+	return this.check(this.c.writePacket())
+}
+
+// callQueryHandler passes q to the configured query handler
+func (this *connection) callQueryHandler(ctx context.Context, q string) (*Result, error) {
+	res, err := this.srv.cfg.QueryHandler.HandleQuery(ctx, this, q)
+	if err != nil {
+		return nil, handlerError(err)
+	}
+
+	return res, nil
+}
+
+// writeResult sends the client a statement's result, an OK packet if there are no
+// rows. A nil result is a plain OK.
+func (this *connection) writeResult(res *Result) error {
+	if res == nil {
+		return this.writeOkPacket()
+	}
+
+	if res.Rows == nil {
+		return this.writeOkResult(res.AffectedRows, res.LastInsertId, res.Info)
+	}
+
+	return this.streamRows(res.Rows)
+}
+
+// handlerError turns an error from a handler into one to send to the client
+func handlerError(err error) error {
+	if _, ok := err.(*SQLError); ok {
+		return err
+	}
+	return newSQLError(1105, "%s", err.Error())
+}
+
+// streamRows sends a result set, writing each row as soon as it is read. An error
+// from rows after the columns have been sent ends the result set with an ERR
+// packet, which clients accept in place of the closing EOF.
+func (this *connection) streamRows(rows Rows) error {
+	defer rows.Close()
+
+	columns := rows.Columns()
+	cols := make([]*columnDef, len(columns))
+	for i := range columns {
+		cols[i] = columns[i].columnDef()
+	}
+
+	if err := this.writeResultSetHeader(cols); err != nil {
+		return err
+	}
+
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return handlerError(err)
+		}
+
+		if len(row) != len(cols) {
+			return newSQLError(1105, "Query handler returned %d values for %d columns", len(row), len(cols))
+		}
+
+		if err := this.writeTextRow(cols, row); err != nil {
+			return err
+		}
+	}
+
+	return this.writeEOFPacket()
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sliceRows serves rows from memory, failing with err after the last one if set
+type sliceRows struct {
+	cols []Column
+	rows [][]interface{}
+	err  error
+}
+
+func (this *sliceRows) Columns() []Column {
+	return this.cols
+}
+
+func (this *sliceRows) Next() ([]interface{}, error) {
+	if len(this.rows) == 0 {
+		if this.err != nil {
+			return nil, this.err
+		}
+		return nil, io.EOF
+	}
+
+	row := this.rows[0]
+	this.rows = this.rows[1:]
+	return row, nil
+}
+
+func (this *sliceRows) Close() error {
+	return nil
+}
+
+func TestQueryHandler(t *testing.T) {
+	created := time.Date(2013, 6, 1, 12, 30, 0, 0, time.UTC)
+	cols := []Column{
+		{Name: "id", Type: TypeLongLong, Unsigned: true, NotNull: true},
+		{Name: "name", Type: TypeVarChar},
+		{Name: "created", Type: TypeDateTime},
+	}
+
+	var mu sync.Mutex
+	var inTransaction []bool
+
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.QueryHandler = QueryHandlerFunc(func(ctx context.Context, session Session, q string) (*Result, error) {
+		switch {
+		case strings.HasPrefix(q, "SELECT"):
+			return &Result{Rows: &sliceRows{cols: cols, rows: [][]interface{}{
+				{1, "a", created},
+				{2, nil, nil},
+			}}}, nil
+
+		case strings.HasPrefix(q, "INSERT"):
+			return &Result{AffectedRows: 2, LastInsertId: 7}, nil
+
+		case q == "SCHEMA":
+			return &Result{Rows: &sliceRows{
+				cols: []Column{{Name: "user", Type: TypeVarChar}, {Name: "schema", Type: TypeVarChar}},
+				rows: [][]interface{}{{session.User(), session.Schema()}},
+			}}, nil
+
+		case q == "MISSING":
+			return nil, newSQLError(1146, "Table 'testdb.missing' doesn't exist")
+
+		case q == "BROKEN":
+			return &Result{Rows: &sliceRows{cols: cols, err: errors.New("backend went away")}}, nil
+
+		case q == "COMMIT" || q == "START TRANSACTION":
+			mu.Lock()
+			inTransaction = append(inTransaction, session.InTransaction())
+			mu.Unlock()
+			return nil, nil
+		}
+
+		return nil, errors.New("no idea")
+	})
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	db, err := sql.Open("mysql", testDSN(s, "testuser", "?parseTime=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name, created FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for rows.Next() {
+		var id uint64
+		var name sql.NullString
+		var ts sql.NullTime
+		if err := rows.Scan(&id, &name, &ts); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, name.String)
+
+		if id == 1 && (!ts.Valid || !ts.Time.Equal(created)) {
+			t.Errorf("Wrong time %v", ts)
+		} else if id == 2 && (name.Valid || ts.Valid) {
+			t.Errorf("Expecting NULLs, got %v, %v", name, ts)
+		}
+	}
+	rows.Close()
+
+	if len(got) != 2 || got[0] != "a" {
+		t.Errorf("Wrong rows %q", got)
+	}
+
+	res, err := db.Exec("INSERT INTO t VALUES (1), (2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("Expecting 2 affected rows, got %d", n)
+	}
+	if id, _ := res.LastInsertId(); id != 7 {
+		t.Errorf("Expecting insert id 7, got %d", id)
+	}
+
+	var user, schema string
+	if err := db.QueryRow("SCHEMA").Scan(&user, &schema); err != nil || user != "testuser" || schema != "testdb" {
+		t.Errorf("Wrong session %s, %s, %v", user, schema, err)
+	}
+
+	for q, code := range map[string]string{"MISSING": "1146", "BROKEN": "1105", "OTHER": "1105"} {
+		rows, err := db.Query(q)
+		if err == nil {
+			for rows.Next() {
+			}
+			err = rows.Err()
+			rows.Close()
+		}
+
+		if err == nil || !strings.Contains(err.Error(), code) {
+			t.Errorf("%s: expecting error %s, got %v", q, code, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler sees the state from before each statement
+	mu.Lock()
+	defer mu.Unlock()
+	if len(inTransaction) != 2 || inTransaction[0] || !inTransaction[1] {
+		t.Errorf("Wrong transaction state %v", inTransaction)
+	}
+}
+
+func TestCommandHandlers(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Commands = map[byte]CommandHandler{
+		// Overrides the built-in handler
+		byte(comPing): func(ctx context.Context, session Session, payload []byte, w ResponseWriter) error {
+			return newSQLError(1053, "Server shutdown in progress")
+		},
+
+		// Removes the built-in handler
+		byte(comStatistics): nil,
+
+		byte(comFieldList): func(ctx context.Context, session Session, payload []byte, w ResponseWriter) error {
+			if string(payload) != "t\x00%" {
+				return errors.New("bad payload")
+			}
+			return w.WriteEOF()
+		},
+
+		// A vendor command
+		0xfa: func(ctx context.Context, session Session, payload []byte, w ResponseWriter) error {
+			return w.WritePacket(append([]byte(session.User()+":"), payload...))
+		},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	c := dialRaw(t, s, "cmds")
+	defer c.Close()
+
+	tests := []struct {
+		cmd  serverCommand
+		args string
+		code int
+		resp string
+	}{
+		{comPing, "", 1053, ""},
+		{comStatistics, "", 1047, ""},
+		{comFieldList, "t\x00%", 0, "\xfe\x00\x00\x02\x00"},
+		{comFieldList, "u\x00", 1105, ""},
+		{0xfa, "hello", 0, "cmds:hello"},
+		{0xfb, "", 1047, ""},
+		{comComQuery, "SET @a = 1", 0, ""},
+	}
+
+	for _, test := range tests {
+		p, err := c.command(test.cmd, []byte(test.args))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code := errCode(p); code != test.code {
+			t.Errorf("%#x: expecting error %d, got %q", test.cmd, test.code, p)
+		} else if test.resp != "" && string(p) != test.resp {
+			t.Errorf("%#x: expecting %q, got %q", test.cmd, test.resp, p)
+		}
+	}
+}
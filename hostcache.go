@@ -0,0 +1,252 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"github.com/golang/glog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HostCacheEntry is what the server remembers about a client IP address. The
+// counters follow the columns of performance_schema.host_cache.
+// http://dev.mysql.com/doc/refman/5.6/en/host-cache-table.html
+type HostCacheEntry struct {
+	IP string
+
+	// Consecutive handshake failures since the last successful login. The host is
+	// blocked once this reaches max_connect_errors.
+	SumConnectErrors uint64
+
+	// Connections refused because the host was blocked
+	CountHostBlockedErrors uint64
+
+	// Handshakes that were aborted or broke the protocol, and ones that failed to
+	// authenticate
+	CountHandshakeErrors      uint64
+	CountAuthenticationErrors uint64
+
+	// Logins refused because of max_connections, max_user_connections and
+	// MAX_CONNECTIONS_PER_HOUR. These don't count towards blocking the host, since
+	// the client did nothing wrong.
+	CountMaxConnectionErrors             uint64
+	CountMaxUserConnectionErrors         uint64
+	CountMaxUserConnectionsPerHourErrors uint64
+
+	FirstSeen      time.Time
+	LastSeen       time.Time
+	FirstErrorSeen time.Time
+	LastErrorSeen  time.Time
+}
+
+// hostCache tracks connection errors by client IP address, so hosts that keep
+// failing the handshake can be blocked. Unlike MySQL, failed authentication counts
+// towards blocking as well as aborted handshakes.
+type hostCache struct {
+	mu      sync.Mutex
+	entries map[string]*HostCacheEntry
+}
+
+func newHostCache() *hostCache {
+	return &hostCache{
+		entries: make(map[string]*HostCacheEntry),
+	}
+}
+
+// entry returns the entry for ip, adding it if needed. When the cache already has
+// size entries, the least recently seen one makes room. Returns nil if size is 0,
+// which disables the cache. Must be called with mu held.
+func (this *hostCache) entry(ip string, size uint64, now time.Time) *HostCacheEntry {
+	if e, ok := this.entries[ip]; ok {
+		return e
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	for uint64(len(this.entries)) >= size {
+		var oldest *HostCacheEntry
+		for _, e := range this.entries {
+			if oldest == nil || e.LastSeen.Before(oldest.LastSeen) {
+				oldest = e
+			}
+		}
+		delete(this.entries, oldest.IP)
+	}
+
+	e := &HostCacheEntry{IP: ip, FirstSeen: now}
+	this.entries[ip] = e
+	return e
+}
+
+// check records a connection attempt from ip, and refuses it with ER_HOST_IS_BLOCKED
+// if the host has had maxErrors handshake failures in a row.
+func (this *hostCache) check(ip string, size, maxErrors uint64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	e := this.entry(ip, size, now)
+	if e == nil {
+		return nil
+	}
+	e.LastSeen = now
+
+	if e.SumConnectErrors >= maxErrors {
+		e.CountHostBlockedErrors++
+		return newSQLError(1129, "Host '%s' is blocked because of many connection errors; unblock with 'FLUSH HOSTS'", ip)
+	}
+
+	return nil
+}
+
+// connectError records why a handshake from ip failed
+func (this *hostCache) connectError(ip string, size uint64, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	e := this.entry(ip, size, now)
+	if e == nil {
+		return
+	}
+
+	code := 0
+	if sqlerr, ok := err.(*SQLError); ok {
+		code = sqlerr.Code
+	}
+
+	switch code {
+	case 1129:
+		// Already counted by check()
+		return
+	case 1040:
+		e.CountMaxConnectionErrors++
+		return
+	case 1203:
+		e.CountMaxUserConnectionErrors++
+		return
+	case 1226:
+		e.CountMaxUserConnectionsPerHourErrors++
+		return
+	case 1044, 1049, 1227, 3159:
+		// Refused by the listener's options or for the initial database, after the
+		// client authenticated
+		return
+	case 1045:
+		e.CountAuthenticationErrors++
+	default:
+		e.CountHandshakeErrors++
+	}
+
+	e.SumConnectErrors++
+	if e.FirstErrorSeen.IsZero() {
+		e.FirstErrorSeen = now
+	}
+	e.LastErrorSeen = now
+}
+
+// connectSuccess clears the consecutive error count of ip after a successful login
+func (this *hostCache) connectSuccess(ip string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if e, ok := this.entries[ip]; ok {
+		e.SumConnectErrors = 0
+	}
+}
+
+// unblock clears the consecutive error count of ip, returning false if the host
+// isn't in the cache
+func (this *hostCache) unblock(ip string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	e, ok := this.entries[ip]
+	if ok {
+		e.SumConnectErrors = 0
+	}
+	return ok
+}
+
+// flush empties the cache, which unblocks every host
+func (this *hostCache) flush() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.entries = make(map[string]*HostCacheEntry)
+}
+
+// snapshot returns a copy of every entry, ordered by IP
+func (this *hostCache) snapshot() []HostCacheEntry {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	entries := make([]HostCacheEntry, 0, len(this.entries))
+	for _, e := range this.entries {
+		entries = append(entries, *e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].IP < entries[j].IP
+	})
+
+	return entries
+}
+
+// checkHost refuses connections from blocked hosts. Clients on Unix domain sockets
+// are never blocked.
+func (this *Server) checkHost(ip string) error {
+	if ip == "localhost" {
+		return nil
+	}
+
+	size, _ := this.globals.get("host_cache_size")
+	maxErrors, _ := this.globals.get("max_connect_errors")
+
+	if err := this.hosts.check(ip, size, maxErrors); err != nil {
+		atomic.AddUint64(&this.stats.hostBlockedErrors, 1)
+		return err
+	}
+	return nil
+}
+
+func (this *Server) hostConnectError(ip string, err error) {
+	if ip == "localhost" {
+		return
+	}
+
+	size, _ := this.globals.get("host_cache_size")
+	this.hosts.connectError(ip, size, err)
+}
+
+func (this *Server) hostConnectSuccess(ip string) {
+	this.hosts.connectSuccess(ip)
+}
+
+// HostCache returns the current contents of the host cache, ordered by IP. The
+// same information is in performance_schema.host_cache.
+func (this *Server) HostCache() []HostCacheEntry {
+	return this.hosts.snapshot()
+}
+
+// FlushHosts empties the host cache, which unblocks all hosts, the same as the
+// FLUSH HOSTS statement.
+func (this *Server) FlushHosts() {
+	glog.V(3).Info("Flushing host cache")
+	this.hosts.flush()
+}
+
+// UnblockHost clears the connection errors of a single host. It returns false if
+// the host isn't in the host cache.
+func (this *Server) UnblockHost(ip string) bool {
+	glog.V(3).Infof("Unblocking host %s", ip)
+	return this.hosts.unblock(ip)
+}
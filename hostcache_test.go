@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostBlocking(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.MaxConnectErrors = 2
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"ALL"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	dsn := func(user, password string) string {
+		return fmt.Sprintf("%s:%s@tcp(%s)/", user, password, s.Addrs()[0])
+	}
+
+	expectErr := func(dsn, code string) {
+		t.Helper()
+		if _, _, err := openConn(dsn); err == nil || !strings.Contains(err.Error(), code) {
+			t.Errorf("Expecting error %s, got %v", code, err)
+		}
+	}
+
+	ctx := context.Background()
+
+	admin, closeAdmin, err := openConn(dsn("admin", "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAdmin()
+
+	u, closeU, err := openConn(dsn("u", "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeU()
+
+	// An aborted handshake and a failed login block the host
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	for i := 0; i < 100 && (len(s.HostCache()) == 0 || s.HostCache()[0].CountHandshakeErrors == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expectErr(dsn("u", "wrong"), "1045")
+	expectErr(dsn("u", "p"), "1129")
+
+	var ip string
+	var sum, blocked uint64
+	row := admin.QueryRowContext(ctx, "SELECT IP, SUM_CONNECT_ERRORS, COUNT_HOST_BLOCKED_ERRORS FROM performance_schema.host_cache")
+	if err := row.Scan(&ip, &sum, &blocked); err != nil {
+		t.Fatal(err)
+	}
+	if ip != "127.0.0.1" || sum != 2 || blocked != 1 {
+		t.Errorf("Wrong host cache entry %s, %d, %d", ip, sum, blocked)
+	}
+
+	if _, err := u.QueryContext(ctx, "SELECT IP FROM performance_schema.host_cache"); err == nil || !strings.Contains(err.Error(), "1142") {
+		t.Errorf("Expecting ER_TABLEACCESS_DENIED_ERROR without PROCESS, got %v", err)
+	}
+
+	if _, err := u.ExecContext(ctx, "FLUSH HOSTS"); err == nil || !strings.Contains(err.Error(), "1227") {
+		t.Errorf("Expecting ER_SPECIFIC_ACCESS_DENIED_ERROR without RELOAD, got %v", err)
+	}
+
+	if _, err := admin.ExecContext(ctx, "FLUSH HOSTS"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A successful login clears the errors, so it takes two more to block again
+	expectErr(dsn("u", "wrong"), "1045")
+	if _, closeU2, err := openConn(dsn("u", "p")); err != nil {
+		t.Errorf("Expecting host to be unblocked, got %v", err)
+	} else {
+		closeU2()
+	}
+
+	expectErr(dsn("u", "wrong"), "1045")
+	expectErr(dsn("u", "wrong"), "1045")
+	expectErr(dsn("u", "p"), "1129")
+
+	if !s.UnblockHost("127.0.0.1") {
+		t.Error("Expecting host to be in the host cache")
+	}
+
+	if _, closeU3, err := openConn(dsn("u", "p")); err != nil {
+		t.Errorf("Expecting host to be unblocked, got %v", err)
+	} else {
+		closeU3()
+	}
+
+	// Counted since FLUSH HOSTS emptied the cache
+	if e := s.HostCache()[0]; e.CountAuthenticationErrors != 3 || e.CountHandshakeErrors != 0 || e.CountHostBlockedErrors != 1 || e.SumConnectErrors != 0 {
+		t.Errorf("Wrong host cache entry %+v", e)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"encoding/binary"
+)
+
+// kill cancels the command the connection is running, if any. Unless only the query
+// is killed, the connection is closed as well.
+func (this *connection) kill(query bool) {
+	this.mu.Lock()
+	if this.cancel != nil {
+		this.cancel()
+	}
+	if !query {
+		this.killed = true
+	}
+	this.mu.Unlock()
+
+	if !query {
+		this.sock.Close()
+	}
+}
+
+func (this *connection) isKilled() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.killed
+}
+
+// execKill answers KILL and COM_PROCESS_KILL. Users can kill their own connections,
+// and admins any connection.
+// http://dev.mysql.com/doc/refman/5.6/en/kill.html
+func (this *connection) execKill(id uint32, query bool) error {
+	target := this.srv.conns.get(id)
+	if target == nil {
+		return newSQLError(1094, "Unknown thread id: %d", id)
+	}
+
+	if target.snapshot().User != this.username && !this.srv.accounts.latest(this.account).isAdmin() {
+		return newSQLError(1095, "You are not owner of thread %d", id)
+	}
+
+	target.kill(query)
+	return nil
+}
+
+// handleProcessKill answers COM_PROCESS_KILL, which kills a whole connection
+// http://dev.mysql.com/doc/internals/en/com-process-kill.html
+func (this *connection) handleProcessKill(payload []byte) error {
+	if len(payload) < 4 {
+		return newSQLError(1835, "Malformed communication packet.")
+	}
+
+	if err := this.execKill(binary.LittleEndian.Uint32(payload), false); err != nil {
+		return err
+	}
+	return this.writeOkPacket()
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKill(t *testing.T) {
+	started := make(chan bool, 1)
+
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "v", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"SUPER"}},
+	}
+	cfg.QueryHandler = QueryHandlerFunc(func(ctx context.Context, session Session, q string) (*Result, error) {
+		switch q {
+		case "SLEEP":
+			started <- true
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "ID":
+			return &Result{Info: fmt.Sprint(session.ID())}, nil
+		}
+		return nil, nil
+	})
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	ctx := context.Background()
+	conns := make(map[string]*sql.Conn)
+	for _, user := range []string{"u", "u2", "v", "admin"} {
+		conn, closeConn, err := openConn(fmt.Sprintf("%s:p@tcp(%s)/", strings.TrimSuffix(user, "2"), s.Addrs()[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeConn()
+		conns[user] = conn
+	}
+
+	// The victim's id, from the process list
+	var id uint32
+	if err := conns["u"].QueryRowContext(ctx, "SELECT ID FROM information_schema.processlist").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	kill := func(user, q string) error {
+		_, err := conns[user].ExecContext(ctx, fmt.Sprintf(q, id))
+		return err
+	}
+
+	// Runs SLEEP on the victim until it is killed
+	sleep := func() chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := conns["u"].ExecContext(ctx, "SLEEP")
+			done <- err
+		}()
+		<-started
+		return done
+	}
+
+	done := sleep()
+	if err := kill("v", "KILL QUERY %d"); err == nil || !strings.Contains(err.Error(), "1095") {
+		t.Errorf("Expecting ER_KILL_DENIED_ERROR, got %v", err)
+	}
+	if err := kill("u2", "KILL QUERY %d"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "1317") {
+			t.Errorf("Expecting ER_QUERY_INTERRUPTED, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query not interrupted")
+	}
+
+	// Only the query was killed
+	if _, err := conns["u"].ExecContext(ctx, "SET @a = 1"); err != nil {
+		t.Errorf("Expecting connection to survive KILL QUERY, got %v", err)
+	}
+
+	if err := kill("admin", "KILL 4000000000 /* %d */"); err == nil || !strings.Contains(err.Error(), "1094") {
+		t.Errorf("Expecting ER_NO_SUCH_THREAD, got %v", err)
+	}
+
+	done = sleep()
+	if err := kill("admin", "KILL CONNECTION %d"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expecting killed connection to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not killed")
+	}
+
+	for i := 0; s.conns.get(id) != nil; i++ {
+		if i == 50 {
+			t.Fatal("Killed connection still registered")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProcessKill(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	victim := dialRaw(t, s, "u")
+	defer victim.Close()
+	c := dialRaw(t, s, "u")
+	defer c.Close()
+
+	// The connection id follows the protocol version and the server version
+	i := bytes.IndexByte(victim.greeting, 0) + 1
+	id := victim.greeting[i : i+4]
+
+	if p, err := c.command(comProcessKill, id); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+
+	// The idle victim's socket is closed
+	if _, err := victim.readPacket(); err == nil {
+		t.Error("Expecting killed connection to be closed")
+	}
+
+	if p, err := c.command(comProcessKill, id[:2]); err != nil || errCode(p) != 1835 {
+		t.Errorf("Expecting ER_MALFORMED_PACKET, got %q, %v", p, err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"sync"
+)
+
+// connLimits enforces max_connections and max_user_connections. As in mysqld,
+// connections count against max_connections as soon as they are accepted, and
+// against max_user_connections once they have logged in.
+// http://dev.mysql.com/doc/refman/5.6/en/too-many-connections.html
+type connLimits struct {
+	mu sync.Mutex
+
+	// Accepted connections, and logged in connections by account
+	connected uint64
+	accounts  map[string]uint64
+
+	// Highest value connected has reached since the server started, or since FLUSH
+	// STATUS
+	maxUsed uint64
+
+	// Connections refused because of max_connections
+	maxConnectionsErrors uint64
+}
+
+func newConnLimits() *connLimits {
+	return &connLimits{
+		accounts: make(map[string]uint64),
+	}
+}
+
+// connect counts a newly accepted connection, unless there already are
+// maxConnections+1 of them. The last one is kept for an admin account, which admit
+// checks once the account is known.
+func (this *connLimits) connect(maxConnections uint64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.connected >= maxConnections+1 {
+		this.maxConnectionsErrors++
+		return newSQLError(1040, "Too many connections")
+	}
+
+	this.connected++
+	if this.connected > this.maxUsed {
+		this.maxUsed = this.connected
+	}
+
+	return nil
+}
+
+// admit counts a connection that was counted by connect for a, unless it takes the
+// server past maxConnections or the account past its limit. Only admin accounts may
+// use the connection beyond maxConnections.
+func (this *connLimits) admit(a *account, maxConnections, maxUserConnections uint64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.connected > maxConnections && !a.isAdmin() {
+		this.maxConnectionsErrors++
+		return newSQLError(1040, "Too many connections")
+	}
+
+	if a.maxUserConnections != 0 {
+		maxUserConnections = a.maxUserConnections
+	}
+
+	key := a.String()
+	if maxUserConnections != 0 && this.accounts[key] >= maxUserConnections {
+		return newSQLError(1203, "User %s already has more than 'max_user_connections' active connections", a.user)
+	}
+
+	this.accounts[key]++
+
+	return nil
+}
+
+// release undoes admit, such as when the connection changes user. It still counts
+// against max_connections.
+func (this *connLimits) release(a *account) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.releaseAccount(a)
+}
+
+func (this *connLimits) releaseAccount(a *account) {
+	key := a.String()
+	if this.accounts[key]--; this.accounts[key] == 0 {
+		delete(this.accounts, key)
+	}
+}
+
+// disconnect undoes connect once the connection has ended, and admit too if a is
+// set
+func (this *connLimits) disconnect(a *account) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.connected--
+	if a != nil {
+		this.releaseAccount(a)
+	}
+}
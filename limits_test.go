@@ -0,0 +1,165 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openConn opens a single connection, so each call is one more connection on the
+// server
+func openConn(dsn string) (*sql.Conn, func(), error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return conn, func() {
+		conn.Close()
+		db.Close()
+	}, nil
+}
+
+func TestConnectionLimits(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.MaxConnections = 2
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p", MaxUserConnections: 1},
+		{User: "other", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"SUPER"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	dsn := func(user, password string) string {
+		return fmt.Sprintf("%s:%s@tcp(%s)/", user, password, s.Addrs()[0])
+	}
+
+	expectErr := func(dsn, code string) {
+		t.Helper()
+		if _, _, err := openConn(dsn); err == nil || !strings.Contains(err.Error(), code) {
+			t.Errorf("Expecting error %s, got %v", code, err)
+		}
+	}
+
+	expectErr(dsn("u", "wrong"), "1045")
+	expectErr(dsn("nobody", "p"), "1045")
+
+	u, closeU, err := openConn(dsn("u", "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeU()
+
+	expectErr(dsn("u", "p"), "1203")
+
+	_, closeOther, err := openConn(dsn("other", "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeOther()
+
+	expectErr(dsn("other", "p"), "1040")
+
+	// The extra connection reserved for admins
+	_, closeAdmin, err := openConn(dsn("admin", "p"))
+	if err != nil {
+		t.Fatalf("Expecting admin to get the reserved connection, got %v", err)
+	}
+	defer closeAdmin()
+
+	expectErr(dsn("admin", "p"), "1040")
+
+	rows, err := u.QueryContext(context.Background(), "SHOW GLOBAL STATUS LIKE '%connect%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	status := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			t.Fatal(err)
+		}
+		status[name] = value
+	}
+
+	expected := map[string]string{
+		"Aborted_connects":                  "5",
+		"Connection_errors_max_connections": "2",
+		"Max_used_connections":              "3",
+		"Threads_connected":                 "3",
+	}
+
+	for name, value := range expected {
+		if status[name] != value {
+			t.Errorf("Expecting %s = %s, got %q", name, value, status[name])
+		}
+	}
+}
+
+func TestConnectionLimitsHandshake(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.MaxConnections = 1
+	cfg.Accounts = []AccountConfig{
+		{User: "admin", Password: "p", Privileges: []string{"SUPER"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	// Connections that never finish the handshake count too
+	var socks []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		c := &rawClient{Conn: conn}
+		if _, err := c.readPacket(); err != nil {
+			t.Fatal(err)
+		}
+		socks = append(socks, conn)
+	}
+
+	c, p := dialRawWith(t, s, rawLogin{user: "admin", password: "p"})
+	c.Close()
+	if errCode(p) != 1040 {
+		t.Errorf("Expecting ER_CON_COUNT_ERROR, got %q", p)
+	}
+
+	// Once one of them is gone, the admin gets the reserved connection
+	socks[0].Close()
+	for i := 0; ; i++ {
+		c, p := dialRawWith(t, s, rawLogin{user: "admin", password: "p"})
+		c.Close()
+		if p[0] == okPacket {
+			break
+		} else if i == 50 {
+			t.Fatalf("Expecting OK, got %q", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"os"
+	"time"
+)
+
+type ListenerConfig struct {
+	// "tcp", "tcp4", "tcp6" or "unix"
+	Network string
+
+	// host:port for TCP, such as ":3306", "127.0.0.1:3306" or "[::1]:3307". Port 0
+	// picks a free port, see Server.Addrs() for the one chosen. For Unix domain
+	// sockets this is the path of the socket file.
+	Address string
+
+	// Permissions of the socket file for Unix domain sockets. Defaults to 0777, the
+	// same as mysqld.
+	Mode os.FileMode
+
+	// Reject clients that don't switch to TLS during the handshake. Unix domain
+	// sockets are considered secure already.
+	RequireTLS bool
+
+	// Only admin users may connect, like MySQL's admin_address and admin_port
+	AdminOnly bool
+}
+
+func (this *ListenerConfig) String() string {
+	return this.Network + ":" + this.Address
+}
+
+// listener is a bound listener together with the options it was configured with
+type listener struct {
+	net.Listener
+	cfg *ListenerConfig
+}
+
+func listen(lc *ListenerConfig) (*listener, error) {
+	switch lc.Network {
+	case "tcp", "tcp4", "tcp6":
+		ln, err := net.Listen(lc.Network, lc.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &listener{Listener: ln, cfg: lc}, nil
+
+	case "unix":
+		if err := removeStaleSocket(lc.Address); err != nil {
+			return nil, err
+		}
+
+		ln, err := net.Listen("unix", lc.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		mode := lc.Mode
+		if mode == 0 {
+			mode = 0777
+		}
+
+		if err := os.Chmod(lc.Address, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+
+		return &listener{Listener: ln, cfg: lc}, nil
+	}
+
+	return nil, fmt.Errorf("Server/listen: Unsupported network %q for listener %s", lc.Network, lc.Address)
+}
+
+// removeStaleSocket removes a socket file left behind by a server that didn't shut
+// down cleanly. A socket that still accepts connections belongs to a running server
+// and is left alone, so the listen that follows fails.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Server/listen: %s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("Server/listen: %s is in use by another server", path)
+	}
+
+	glog.V(3).Infof("Removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// isSecure returns true for connections that are either encrypted or never leave
+// the host. This goes by the listener's own socket, since the addresses of a
+// connection can come from a PROXY header.
+func isSecure(lc *ListenerConfig, encrypted bool) bool {
+	return encrypted || lc.Network == "unix"
+}
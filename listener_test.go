@@ -0,0 +1,141 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func execOnce(dsn, q string) error {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(q)
+	return err
+}
+
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "qld test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestListeners(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "qld.sock")
+
+	cfg, _ := NewConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeTestCert(t, dir)
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"CONNECTION_ADMIN"}},
+	}
+	cfg.Listeners = []ListenerConfig{
+		{Network: "tcp", Address: "127.0.0.1:0"},
+		{Network: "unix", Address: sock, Mode: 0700},
+		{Network: "tcp", Address: "127.0.0.1:0", RequireTLS: true},
+		{Network: "tcp", Address: "127.0.0.1:0", AdminOnly: true},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	addrs := s.Addrs()
+	if len(addrs) != 4 {
+		t.Fatalf("Expecting 4 listeners, got %v", addrs)
+	}
+
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("Expecting socket with mode 0700, got %v, %v", fi, err)
+	}
+
+	for i, addr := range addrs {
+		if tcp, ok := addr.(*net.TCPAddr); ok && tcp.Port == 0 {
+			t.Errorf("Listener %d has no port assigned", i)
+		}
+	}
+
+	q := "SET @x = 1"
+
+	if err := execOnce("u:p@tcp("+addrs[0].String()+")/", q); err != nil {
+		t.Errorf("Plain TCP: %v", err)
+	}
+
+	if err := execOnce("u:p@unix("+sock+")/", q); err != nil {
+		t.Errorf("Unix socket: %v", err)
+	}
+
+	if err := execOnce("u:p@tcp("+addrs[2].String()+")/", q); err == nil || !strings.Contains(err.Error(), "3159") {
+		t.Errorf("Expecting ER_SECURE_TRANSPORT_REQUIRED without TLS, got %v", err)
+	}
+
+	if err := execOnce("u:p@tcp("+addrs[2].String()+")/?tls=skip-verify", q); err != nil {
+		t.Errorf("TLS: %v", err)
+	}
+
+	if err := execOnce("u:p@tcp("+addrs[3].String()+")/", q); err == nil || !strings.Contains(err.Error(), "1227") {
+		t.Errorf("Expecting ER_SPECIFIC_ACCESS_DENIED_ERROR for non admin user, got %v", err)
+	}
+
+	if err := execOnce("admin:p@tcp("+addrs[3].String()+")/", q); err != nil {
+		t.Errorf("Admin listener: %v", err)
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	ln, err := listen(&ListenerConfig{Network: "tcp", Address: "[::1]:0"})
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer ln.Close()
+
+	if tcp := ln.Addr().(*net.TCPAddr); tcp.IP.To4() != nil || tcp.Port == 0 {
+		t.Errorf("Expecting IPv6 address with a port, got %s", tcp)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMultiStatements(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	q := "SET @a = 1; SET @b = 2"
+
+	db, err := sql.Open("mysql", testDSN(s, "testuser", "?multiStatements=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(q); err != nil {
+		t.Errorf("Expecting multi-statements to work, got %v", err)
+	}
+
+	if err := execOnce(testDSN(s, "testuser", ""), q); err == nil || !strings.Contains(err.Error(), "1064") {
+		t.Errorf("Expecting syntax error without multi-statements, got %v", err)
+	}
+}
+
+func TestSetOption(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	c := dialRaw(t, s, "u")
+	defer c.Close()
+
+	if c.serverCapabilities()&clientMultiStatements == 0 {
+		t.Errorf("Expecting CLIENT_MULTI_STATEMENTS to be advertised")
+	}
+
+	option := func(opt uint16) []byte {
+		p, err := c.command(comSetOption, []byte{byte(opt), byte(opt >> 8)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	if p := option(optionMultiStatementsOn); p[0] != eofPacket {
+		t.Fatalf("Expecting EOF, got %q", p)
+	}
+
+	// Every result but the last says more are coming
+	p, err := c.command(comComQuery, []byte("SET @a = 1; SET @b = 2"))
+	if err != nil || p[0] != okPacket || serverStatusFlag(p[3])&serverMoreResultsExists == 0 {
+		t.Fatalf("Expecting OK with more results, got %q, %v", p, err)
+	}
+	if p, err = c.readPacket(); err != nil || p[0] != okPacket || serverStatusFlag(p[3])&serverMoreResultsExists != 0 {
+		t.Fatalf("Expecting last OK, got %q, %v", p, err)
+	}
+
+	// An error ends the results
+	p, err = c.command(comComQuery, []byte("SET @a = 1; SET nope = 2; SET @b = 2"))
+	if err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+	if p, err = c.readPacket(); err != nil || errCode(p) != 1193 {
+		t.Fatalf("Expecting ER_UNKNOWN_SYSTEM_VARIABLE, got %q, %v", p, err)
+	}
+
+	if p := option(optionMultiStatementsOff); p[0] != eofPacket {
+		t.Fatalf("Expecting EOF, got %q", p)
+	}
+	if p, err := c.command(comComQuery, []byte("SET @a = 1; SET @b = 2")); err != nil || errCode(p) != 1064 {
+		t.Errorf("Expecting syntax error, got %q, %v", p, err)
+	}
+
+	if p := option(2); errCode(p) != 1047 {
+		t.Errorf("Expecting ER_UNKNOWN_COM_ERROR, got %q", p)
+	}
+}
+
+func TestMultiStatementsStoredProgram(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.QueryHandler = QueryHandlerFunc(func(ctx context.Context, session Session, q string) (*Result, error) {
+		mu.Lock()
+		queries = append(queries, q)
+		mu.Unlock()
+		return nil, nil
+	})
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	create := "CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END"
+
+	// The body's statements stay with the CREATE, with and without multi-statements
+	if err := execOnce(testDSN(s, "testuser", "?multiStatements=true"), create+"; CALL p()"); err != nil {
+		t.Errorf("Expecting multi-statements to work, got %v", err)
+	}
+	if err := execOnce(testDSN(s, "testuser", ""), create); err != nil {
+		t.Errorf("Expecting a single statement, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if expected := []string{create, "CALL p()", create}; !reflect.DeepEqual(queries, expected) {
+		t.Errorf("Expecting %q, got %q", expected, queries)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"time"
+)
+
+// Without FULL, SHOW PROCESSLIST cuts statements down to this many characters
+const processInfoLength = 100
+
+// processList returns the connections the session may see. Accounts with the
+// PROCESS privilege see all of them, others only their own.
+func (this *connection) processList() []connInfo {
+	infos := this.srv.conns.snapshot()
+	if this.srv.accounts.latest(this.account).has(privProcess) {
+		return infos
+	}
+
+	var own []connInfo
+	for _, info := range infos {
+		if info.User == this.username {
+			own = append(own, info)
+		}
+	}
+	return own
+}
+
+// processRows returns the process list as rows of Id, User, Host, db, Command,
+// Time, State and Info
+func (this *connection) processRows(full bool) [][]interface{} {
+	now := time.Now()
+
+	var rows [][]interface{}
+	for _, info := range this.processList() {
+		user := info.User
+		if user == "" {
+			user = "unauthenticated user"
+		}
+
+		row := []interface{}{info.Id, user, info.Host, nil, info.Command, uint64(now.Sub(info.CommandStart) / time.Second), info.State, nil}
+		if info.Schema != "" {
+			row[3] = info.Schema
+		}
+		if info.Info != "" {
+			if r := []rune(info.Info); !full && len(r) > processInfoLength {
+				info.Info = string(r[:processInfoLength])
+			}
+			row[7] = info.Info
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// execProcessList answers SHOW [FULL] PROCESSLIST, and COM_PROCESS_INFO which is the
+// same as SHOW PROCESSLIST
+// http://dev.mysql.com/doc/refman/5.6/en/show-processlist.html
+// http://dev.mysql.com/doc/internals/en/com-process-info.html
+func (this *connection) execProcessList(full bool) error {
+	infoLength := uint32(processInfoLength)
+	if full {
+		infoLength = 65535
+	}
+
+	cols := []*columnDef{
+		systemColumn("", "", "Id", fieldTypeLongLong, 21),
+		varcharColumn("User", 32),
+		varcharColumn("Host", 261),
+		varcharColumn("db", 64),
+		varcharColumn("Command", 16),
+		systemColumn("", "", "Time", fieldTypeLong, 7),
+		varcharColumn("State", 30),
+		varcharColumn("Info", infoLength),
+	}
+
+	return this.writeResultSet(cols, this.processRows(full))
+}
+
+// http://dev.mysql.com/doc/refman/5.6/en/processlist-table.html
+func processListTable(c *connection) ([]*columnDef, [][]interface{}, error) {
+	column := func(name string, typ fieldType, length uint32) *columnDef {
+		return systemColumn("information_schema", "PROCESSLIST", name, typ, length)
+	}
+
+	cols := []*columnDef{
+		column("ID", fieldTypeLongLong, 21),
+		column("USER", fieldTypeVarString, 32),
+		column("HOST", fieldTypeVarString, 261),
+		column("DB", fieldTypeVarString, 64),
+		column("COMMAND", fieldTypeVarString, 16),
+		column("TIME", fieldTypeLong, 7),
+		column("STATE", fieldTypeVarString, 64),
+		column("INFO", fieldTypeVarString, 65535),
+	}
+
+	return cols, c.processRows(true), nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+// processUsers returns the User column of every row of the process list query q
+func processUsers(t *testing.T, conn *sql.Conn, q string) map[string]int {
+	rows, err := conn.QueryContext(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	cols, _ := rows.Columns()
+	users := make(map[string]int)
+	for rows.Next() {
+		values := make([]sql.RawBytes, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatal(err)
+		}
+		users[string(values[1])]++
+	}
+
+	return users
+}
+
+func TestProcessList(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "v", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"PROCESS"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	dsn := func(user string) string {
+		return fmt.Sprintf("%s:p@tcp(%s)/", user, s.Addrs()[0])
+	}
+
+	conns := make(map[string]*sql.Conn)
+	for _, user := range []string{"u", "v", "admin"} {
+		conn, closeConn, err := openConn(dsn(user))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeConn()
+		conns[user] = conn
+	}
+
+	// A second connection for u
+	if _, closeConn, err := openConn(dsn("u")); err != nil {
+		t.Fatal(err)
+	} else {
+		defer closeConn()
+	}
+
+	for _, q := range []string{"SHOW PROCESSLIST", "SHOW FULL PROCESSLIST", "SELECT * FROM INFORMATION_SCHEMA.PROCESSLIST"} {
+		if users := processUsers(t, conns["u"], q); len(users) != 1 || users["u"] != 2 {
+			t.Errorf("%s: expecting u to see its own 2 connections, got %v", q, users)
+		}
+
+		if users := processUsers(t, conns["admin"], q); users["u"] != 2 || users["v"] != 1 || users["admin"] != 1 {
+			t.Errorf("%s: expecting admin to see all connections, got %v", q, users)
+		}
+	}
+
+	// The statement running the process list shows up in it
+	var info string
+	if err := conns["v"].QueryRowContext(context.Background(), "SELECT INFO FROM information_schema.processlist").Scan(&info); err != nil || info != "SELECT INFO FROM information_schema.processlist" {
+		t.Errorf("Wrong Info %q, %v", info, err)
+	}
+
+	c, p := dialRawWith(t, s, rawLogin{user: "v", password: "p"})
+	defer c.Close()
+	if p[0] != okPacket {
+		t.Fatalf("Handshake failed: %q", p)
+	}
+
+	// A result set with 8 columns
+	if p, err := c.command(comProcessInfo, nil); err != nil || string(p) != "\x08" {
+		t.Errorf("Expecting result set for COM_PROCESS_INFO, got %q, %v", p, err)
+	}
+}
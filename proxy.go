@@ -0,0 +1,292 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol support, so that connections coming through HAProxy or a load
+// balancer carry the real client address.
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+	proxyV2SigLength = 12
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types
+const (
+	proxyTLVALPN      byte = 0x01
+	proxyTLVAuthority byte = 0x02
+	proxyTLVCRC32C    byte = 0x03
+	proxyTLVNoop      byte = 0x04
+	proxyTLVUniqueID  byte = 0x05
+	proxyTLVSSL       byte = 0x20
+	proxyTLVNetNS     byte = 0x30
+)
+
+type proxyTLV struct {
+	typ   byte
+	value []byte
+}
+
+type proxyHeader struct {
+	version int
+
+	// Both are nil if the proxy didn't forward any addresses, such as for a v1
+	// UNKNOWN or a v2 LOCAL header. The connection then keeps the proxy's addresses.
+	src, dst net.Addr
+
+	tlvs []proxyTLV
+}
+
+func (this *proxyHeader) tlv(typ byte) ([]byte, bool) {
+	for _, t := range this.tlvs {
+		if t.typ == typ {
+			return t.value, true
+		}
+	}
+	return nil, false
+}
+
+// proxyConn is an accepted connection whose addresses come from a PROXY header
+type proxyConn struct {
+	net.Conn
+	header *proxyHeader
+}
+
+func (this *proxyConn) RemoteAddr() net.Addr {
+	if this.header.src != nil {
+		return this.header.src
+	}
+	return this.Conn.RemoteAddr()
+}
+
+func (this *proxyConn) LocalAddr() net.Addr {
+	if this.header.dst != nil {
+		return this.header.dst
+	}
+	return this.Conn.LocalAddr()
+}
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, s := range cidrs {
+		// Allow plain addresses as a single host network
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Server/parseTrustedProxies: Invalid proxy network %q: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func isTrustedProxy(addr net.Addr, nets []*net.IPNet) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from r. MySQL clients wait for the
+// server greeting before sending anything, so the header is read exactly and no
+// bytes beyond it are consumed.
+func readProxyHeader(r io.Reader) (*proxyHeader, error) {
+	var sig [proxyV2SigLength]byte
+
+	// Both versions are at least this long, "PROXY UNKNOWN\r\n" is the shortest v1
+	if _, err := io.ReadFull(r, sig[:]); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig[:], proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	if bytes.HasPrefix(sig[:], []byte(proxyV1Prefix)) {
+		return readProxyV1(r, sig[:])
+	}
+
+	return nil, fmt.Errorf("Server/readProxyHeader: Missing PROXY protocol header")
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 3306\r\n
+func readProxyV1(r io.Reader, prefix []byte) (*proxyHeader, error) {
+	line := append([]byte(nil), prefix...)
+
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("Server/readProxyV1: Header longer than %d bytes", proxyV1MaxLength)
+		}
+
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	hdr := &proxyHeader{version: 1}
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return hdr, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Server/readProxyV1: Malformed header %q", line)
+	}
+
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	if src == nil || dst == nil || (src.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("Server/readProxyV1: Invalid address in %q", line)
+	}
+
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("Server/readProxyV1: Invalid port in %q", line)
+	}
+
+	hdr.src = &net.TCPAddr{IP: src, Port: int(sport)}
+	hdr.dst = &net.TCPAddr{IP: dst, Port: int(dport)}
+
+	return hdr, nil
+}
+
+func readProxyV2(r io.Reader) (*proxyHeader, error) {
+	/*
+		12 bytes  signature
+		1 byte    version (high nibble) and command (low nibble)
+		1 byte    address family (high nibble) and transport (low nibble)
+		2 bytes   length of the rest of the header, network byte order
+	*/
+	var fixed [4]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+
+	if fixed[0]>>4 != 2 {
+		return nil, fmt.Errorf("Server/readProxyV2: Unsupported version %d", fixed[0]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	hdr := &proxyHeader{version: 2}
+
+	var addrLen int
+	switch fixed[1] {
+	case 0x00: // AF_UNSPEC
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		addrLen = 12
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		addrLen = 36
+	case 0x31, 0x32: // AF_UNIX
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("Server/readProxyV2: Unsupported address family 0x%02x", fixed[1])
+	}
+
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("Server/readProxyV2: Header too short for address family 0x%02x", fixed[1])
+	}
+
+	switch cmd := fixed[0] & 0x0f; cmd {
+	case 0x00:
+		// LOCAL, sent by the proxy itself such as for health checks. Keep the
+		// connection's own addresses.
+	case 0x01:
+		// PROXY
+		switch addrLen {
+		case 12:
+			hdr.src = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+			hdr.dst = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+		case 36:
+			hdr.src = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+			hdr.dst = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+		case 216:
+			// AF_UNIX, as from a proxy on the same host as its clients. The socket
+			// paths say nothing about who the client is, and taking them as the
+			// client's address would make it a local client of this server. Keep
+			// the proxy's address, the same as for LOCAL.
+		}
+	default:
+		return nil, fmt.Errorf("Server/readProxyV2: Unsupported command 0x%x", cmd)
+	}
+
+	// Type-length-value vectors fill the rest of the header
+	// 1 byte type, 2 bytes length in network byte order, value
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("Server/readProxyV2: Truncated TLV")
+		}
+
+		n := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			return nil, fmt.Errorf("Server/readProxyV2: Truncated TLV 0x%02x", tlvs[0])
+		}
+
+		hdr.tlvs = append(hdr.tlvs, proxyTLV{typ: tlvs[0], value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+
+	// The checksum covers the whole header with the checksum value itself zeroed
+	if sum, ok := hdr.tlv(proxyTLVCRC32C); ok {
+		if len(sum) != 4 {
+			return nil, fmt.Errorf("Server/readProxyV2: Invalid CRC32C length %d", len(sum))
+		}
+
+		expected := binary.BigEndian.Uint32(sum)
+		for i := range sum {
+			sum[i] = 0
+		}
+
+		h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		h.Write(proxyV2Signature)
+		h.Write(fixed[:])
+		h.Write(body)
+		if h.Sum32() != expected {
+			return nil, fmt.Errorf("Server/readProxyV2: CRC32C checksum mismatch")
+		}
+		binary.BigEndian.PutUint32(sum, expected)
+	}
+
+	return hdr, nil
+}
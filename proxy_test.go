@@ -0,0 +1,157 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+)
+
+func TestProxyV1(t *testing.T) {
+	hdr, err := readProxyHeader(bytes.NewReader([]byte("PROXY TCP4 192.168.0.1 10.0.0.2 56324 3306\r\nrest")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.src.String() != "192.168.0.1:56324" || hdr.dst.String() != "10.0.0.2:3306" {
+		t.Errorf("Wrong addresses %s, %s", hdr.src, hdr.dst)
+	}
+
+	hdr, err = readProxyHeader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n")))
+	if err != nil || hdr.src != nil {
+		t.Errorf("Expecting UNKNOWN header without addresses, got %#v, %v", hdr, err)
+	}
+
+	for _, bad := range []string{
+		"PROXY TCP4 192.168.0.1 10.0.0.2 56324\r\n",
+		"PROXY TCP6 192.168.0.1 10.0.0.2 56324 3306\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.2 99999 3306\r\n",
+		"\x0a5.6.0\x00 not a proxy header",
+	} {
+		if _, err := readProxyHeader(bytes.NewReader([]byte(bad))); err == nil {
+			t.Errorf("Expecting error for %q", bad)
+		}
+	}
+}
+
+func proxyV2Header(cmd, fam byte, addrs []byte, tlvs []byte, crc bool) []byte {
+	if crc {
+		tlvs = append(tlvs, proxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+
+	var b []byte
+	b = append(b, proxyV2Signature...)
+	b = append(b, 0x20|cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)+len(tlvs)))
+	b = append(b, addrs...)
+	b = append(b, tlvs...)
+
+	if crc {
+		sum := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+		binary.BigEndian.PutUint32(b[len(b)-4:], sum)
+	}
+
+	return b
+}
+
+func TestProxyV2(t *testing.T) {
+	addrs := []byte{192, 168, 0, 1, 10, 0, 0, 2, 0xdc, 0x04, 0x0c, 0xea}
+	tlvs := []byte{proxyTLVAuthority, 0, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e'}
+
+	hdr, err := readProxyHeader(bytes.NewReader(proxyV2Header(0x01, 0x11, addrs, tlvs, true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.src.String() != "192.168.0.1:56324" || hdr.dst.String() != "10.0.0.2:3306" {
+		t.Errorf("Wrong addresses %s, %s", hdr.src, hdr.dst)
+	}
+
+	if v, ok := hdr.tlv(proxyTLVAuthority); !ok || string(v) != "example" {
+		t.Errorf("Wrong authority TLV %q", v)
+	}
+
+	// Corrupt the checksum
+	b := proxyV2Header(0x01, 0x11, addrs, tlvs, true)
+	b[len(b)-1] ^= 0xff
+	if _, err := readProxyHeader(bytes.NewReader(b)); err == nil {
+		t.Error("Expecting checksum error")
+	}
+
+	// LOCAL keeps the connection's own addresses
+	hdr, err = readProxyHeader(bytes.NewReader(proxyV2Header(0x00, 0x00, nil, nil, false)))
+	if err != nil || hdr.src != nil {
+		t.Errorf("Expecting LOCAL header without addresses, got %#v, %v", hdr, err)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, trusted := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"fd00::1":     true,
+		"127.0.0.1":   false,
+	} {
+		if isTrustedProxy(&net.TCPAddr{IP: net.ParseIP(addr), Port: 1000}, nets) != trusted {
+			t.Errorf("Expecting trusted(%s) = %t", addr, trusted)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expecting error for invalid network")
+	}
+}
+
+func TestProxyUnixAddress(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{
+		{Network: "tcp", Address: "127.0.0.1:0"},
+		{Network: "tcp", Address: "127.0.0.1:0", RequireTLS: true},
+	}
+	cfg.ProxyProtocolNetworks = []string{"127.0.0.1"}
+	cfg.Accounts = []AccountConfig{
+		{User: "local", Host: "localhost", Password: "p"},
+		{User: "u", Password: "p"},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	addrs := make([]byte, 216)
+	copy(addrs, "/run/proxy/client.sock")
+	copy(addrs[108:], "/run/proxy/server.sock")
+	hdr := proxyV2Header(0x01, 0x31, addrs, nil, false)
+
+	// The client keeps the proxy's address rather than becoming a local one
+	c, p := dialRawWith(t, s, rawLogin{user: "local", password: "p", preamble: hdr})
+	c.Close()
+	if errCode(p) != 1045 {
+		t.Errorf("Expecting ER_ACCESS_DENIED_ERROR, got %q", p)
+	}
+
+	c, p = dialRawWith(t, s, rawLogin{user: "u", password: "p", preamble: hdr})
+	c.Close()
+	if p[0] != okPacket {
+		t.Errorf("Expecting OK, got %q", p)
+	}
+
+	// Nor does it count as a secure transport
+	c, p = dialRawWith(t, s, rawLogin{user: "u", password: "p", preamble: hdr, addr: s.Addrs()[1]})
+	c.Close()
+	if errCode(p) != 3159 {
+		t.Errorf("Expecting ER_SECURE_TRANSPORT_REQUIRED, got %q", p)
+	}
+}
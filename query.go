@@ -0,0 +1,410 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	"strconv"
+	"strings"
+)
+
+// handleQuery runs the statements of a COM_QUERY. Several statements separated by
+// semicolons are only allowed if the client enabled multi-statements, and each of
+// them gets its own result.
+// http://dev.mysql.com/doc/internals/en/multi-statement.html
+func (this *connection) handleQuery(ctx context.Context, q string) error {
+	stmts := splitStatements(q)
+	if len(stmts) == 0 {
+		// Let execQuery complain about the empty query
+		stmts = []string{q}
+	}
+
+	if len(stmts) > 1 && this.clientCapabilities&clientMultiStatements == 0 {
+		return newSQLError(1064, "You have an error in your SQL syntax near '%s'", stmts[1])
+	}
+
+	for i, stmt := range stmts {
+		if i < len(stmts)-1 {
+			this.status |= serverMoreResultsExists
+		} else {
+			this.status &^= serverMoreResultsExists
+		}
+
+		if err := this.execQuery(ctx, stmt); err != nil {
+			// An error ends the results, the remaining statements don't run
+			this.status &^= serverMoreResultsExists
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleSetOption answers COM_SET_OPTION, which turns multi-statements on or off for
+// the session
+// http://dev.mysql.com/doc/internals/en/com-set-option.html
+func (this *connection) handleSetOption(payload []byte) error {
+	if len(payload) < 2 {
+		return newSQLError(1835, "Malformed communication packet.")
+	}
+
+	switch binary.LittleEndian.Uint16(payload) {
+	case optionMultiStatementsOn:
+		this.clientCapabilities |= clientMultiStatements
+	case optionMultiStatementsOff:
+		this.clientCapabilities &^= clientMultiStatements
+	default:
+		return newSQLError(1047, "Unknown command")
+	}
+
+	return this.writeEOFPacket()
+}
+
+// execQuery runs a single statement
+func (this *connection) execQuery(ctx context.Context, q string) error {
+	// The limits may have changed since the session logged in
+	acct := this.srv.accounts.latest(this.account)
+	if err := this.srv.resources.query(acct, isUpdateStatement(q)); err != nil {
+		return err
+	}
+
+	stmt, err := parseStatement(q)
+	if err != nil {
+		return err
+	}
+
+	switch stmt := stmt.(type) {
+	case *setStmt:
+		if err := this.execSet(stmt); err != nil {
+			return err
+		}
+		return this.writeOkPacket()
+
+	case *showStmt:
+		return this.execShow(stmt)
+
+	case *binlogEventsStmt:
+		return this.execShowBinlogEvents(stmt)
+
+	case *useStmt:
+		if err := this.changeSchema(stmt.db); err != nil {
+			return err
+		}
+		return this.writeOkPacket()
+
+	case *txnStmt:
+		// The query handler gets to see transaction statements too, since it is what
+		// holds the data
+		var res *Result
+		if this.srv.cfg.QueryHandler != nil {
+			if res, err = this.callQueryHandler(ctx, q); err != nil {
+				return err
+			}
+		}
+
+		if stmt.begin {
+			this.status |= serverStatusInTrans
+		} else {
+			this.status &^= serverStatusInTrans
+		}
+		return this.writeResult(res)
+
+	case *shutdownStmt:
+		if err := this.execShutdown(); err != nil {
+			return err
+		}
+		return this.writeOkPacket()
+
+	case *killStmt:
+		if err := this.execKill(stmt.id, stmt.query); err != nil {
+			return err
+		}
+		return this.writeOkPacket()
+
+	case *flushStmt:
+		if err := this.execFlush(ctx, stmt); err != nil {
+			return err
+		}
+		return this.writeOkPacket()
+
+	case *userStmt:
+		if err := this.execUser(stmt); err != nil {
+			return err
+		}
+		return this.writeOkPacket()
+
+	case *selectStmt:
+		if table, ok := lookupSystemTable(stmt.schema, stmt.table); ok {
+			return this.execSelect(stmt, table)
+		}
+
+	case *selectVarsStmt:
+		// System variables the server doesn't have may be known to the query handler
+		err := this.execSelectVars(stmt)
+		if e, ok := err.(*SQLError); !ok || e.Code != 1193 || this.srv.cfg.QueryHandler == nil {
+			return err
+		}
+	}
+
+	if this.srv.cfg.QueryHandler != nil {
+		res, err := this.callQueryHandler(ctx, q)
+		if err != nil {
+			return err
+		}
+		return this.writeResult(res)
+	}
+
+	glog.V(3).Infof("Unsupported statement: %s", q)
+	return newSQLError(1235, "This version of qld doesn't yet support '%s'", q)
+}
+
+func (this *connection) execSet(stmt *setStmt) error {
+	// Validate everything first so a bad assignment doesn't leave the rest half applied
+	for i, a := range stmt.assigns {
+		if a.value.kind == valueVariable {
+			value, err := this.variable(a.value.ref)
+			if err != nil {
+				return err
+			}
+			stmt.assigns[i].value, a.value = value, value
+		}
+
+		if a.scope == 0 {
+			continue
+		}
+
+		if _, ok := readOnlyVars[a.name]; ok {
+			return newSQLError(1238, "Variable '%s' is a read only variable", a.name)
+		}
+
+		v, err := lookupSysVar(a.name)
+		if err != nil {
+			return err
+		}
+
+		if a.scope&v.scope == 0 {
+			if a.scope == scopeGlobal {
+				return newSQLError(1228, "Variable '%s' is a SESSION variable and can't be used with SET GLOBAL", v.name)
+			}
+			return newSQLError(1229, "Variable '%s' is a GLOBAL variable and should be set with SET GLOBAL", v.name)
+		}
+
+		if a.value.kind != valueNumber && a.value.kind != valueDefault {
+			return newSQLError(1232, "Incorrect argument type to variable '%s'", v.name)
+		}
+	}
+
+	for _, a := range stmt.assigns {
+		if a.scope == 0 {
+			this.userVars[a.name] = a.value
+			continue
+		}
+
+		v := sysVars[a.name]
+
+		var n uint64
+		if a.value.kind == valueDefault {
+			if a.scope == scopeGlobal {
+				n = v.clamp(v.def(this.srv.cfg))
+			} else {
+				n, _ = this.srv.globals.get(v.name)
+			}
+		} else {
+			n = v.clamp(a.value.num)
+		}
+
+		if a.scope == scopeGlobal {
+			this.srv.globals.set(v.name, n)
+		} else {
+			this.vars.set(v.name, n)
+		}
+		glog.V(3).Infof("Set variable %s = %d", v.name, n)
+	}
+
+	return nil
+}
+
+// sysVarValue returns the value of the system variable as seen by this session
+func (this *connection) sysVarValue(name string) uint64 {
+	if n, ok := this.vars.get(name); ok {
+		return n
+	}
+
+	n, _ := this.srv.globals.get(name)
+	return n
+}
+
+// variable returns the value of a variable read in a statement. User variables that
+// were never set are NULL.
+func (this *connection) variable(ref varRef) (setValue, error) {
+	if !ref.sys {
+		if v, ok := this.userVars[ref.name]; ok {
+			return v, nil
+		}
+		return setValue{kind: valueNull}, nil
+	}
+
+	if value, ok := readOnlyVars[ref.name]; ok {
+		if ref.scope == scopeSession {
+			return setValue{}, newSQLError(1238, "Variable '%s' is a GLOBAL variable", ref.name)
+		}
+		return setValue{kind: valueString, str: value(this.srv)}, nil
+	}
+
+	v, err := lookupSysVar(ref.name)
+	if err != nil {
+		return setValue{}, err
+	}
+
+	var n uint64
+	switch {
+	case ref.scope == scopeGlobal:
+		n, _ = this.srv.globals.get(v.name)
+	case ref.scope == scopeSession && v.scope&scopeSession == 0:
+		return setValue{}, newSQLError(1238, "Variable '%s' is a GLOBAL variable", v.name)
+	default:
+		n = this.sysVarValue(v.name)
+	}
+
+	return setValue{kind: valueNumber, num: n, str: strconv.FormatUint(n, 10)}, nil
+}
+
+// execSelectVars answers a SELECT of variables with a single row, each column named
+// after the variable as written
+func (this *connection) execSelectVars(stmt *selectVarsStmt) error {
+	var cols []*columnDef
+	var row []interface{}
+
+	for _, ref := range stmt.vars {
+		v, err := this.variable(ref)
+		if err != nil {
+			return err
+		}
+
+		switch v.kind {
+		case valueNumber:
+			cols = append(cols, systemColumn("", "", ref.text, fieldTypeLongLong, 20))
+			row = append(row, v.num)
+		case valueString:
+			cols = append(cols, varcharColumn(ref.text, 1024))
+			row = append(row, v.str)
+		default:
+			cols = append(cols, varcharColumn(ref.text, 1024))
+			row = append(row, nil)
+		}
+	}
+
+	return this.writeResultSet(cols, [][]interface{}{row})
+}
+
+// checkPrivilege returns ER_SPECIFIC_ACCESS_DENIED_ERROR unless the session's account
+// has the privilege p, called name in the message
+func (this *connection) checkPrivilege(p privilege, name string) error {
+	if !this.account.has(p) {
+		return newSQLError(1227, "Access denied; you need (at least one of) the %s privilege(s) for this operation", name)
+	}
+	return nil
+}
+
+// execUser runs CREATE USER and ALTER USER. Either every account listed is created
+// or changed, or none is.
+func (this *connection) execUser(stmt *userStmt) error {
+	if err := this.checkPrivilege(privCreateUser, "CREATE USER"); err != nil {
+		return err
+	}
+
+	store := this.srv.accounts
+	if store.skipGrants {
+		return newSQLError(1290, "The server has no accounts configured, like --skip-grant-tables, so it cannot execute this statement")
+	}
+
+	op := "CREATE USER"
+	if stmt.alter {
+		op = "ALTER USER"
+	}
+
+	var accounts []*account
+	var failed []string
+
+	for _, spec := range stmt.users {
+		old := store.get(spec.user, spec.host)
+
+		var a *account
+		switch {
+		case stmt.alter && old == nil, !stmt.alter && old != nil:
+			if !stmt.ifExists {
+				failed = append(failed, fmt.Sprintf("'%s'@'%s'", spec.user, spec.host))
+			}
+			continue
+
+		case stmt.alter:
+			copied := *old
+			a = &copied
+
+		default:
+			a = &account{user: spec.user, host: spec.host}
+		}
+
+		if spec.identified {
+			if spec.plugin != "" && !strings.EqualFold(spec.plugin, "mysql_native_password") {
+				return newSQLError(1524, "Plugin '%s' is not loaded", spec.plugin)
+			}
+
+			switch {
+			case spec.hash != "":
+				authString, err := parsePasswordHash(spec.hash)
+				if err != nil {
+					return newSQLError(1372, "Password hash should be a 41-digit hexadecimal number")
+				}
+				a.authString = authString
+			case spec.password != "":
+				a.authString = nativePasswordHash(spec.password)
+			default:
+				a.authString = nil
+			}
+		}
+
+		for name, n := range stmt.resources {
+			switch name {
+			case "MAX_QUERIES_PER_HOUR":
+				a.maxQueriesPerHour = n
+			case "MAX_UPDATES_PER_HOUR":
+				a.maxUpdatesPerHour = n
+			case "MAX_CONNECTIONS_PER_HOUR":
+				a.maxConnectionsPerHour = n
+			case "MAX_USER_CONNECTIONS":
+				a.maxUserConnections = n
+			}
+		}
+
+		accounts = append(accounts, a)
+	}
+
+	if len(failed) > 0 {
+		return newSQLError(1396, "Operation %s failed for %s", op, strings.Join(failed, ","))
+	}
+
+	for _, a := range accounts {
+		if stmt.alter {
+			store.replace(a)
+		} else if err := store.add(a); err != nil {
+			return newSQLError(1396, "Operation %s failed for %s", op, a)
+		}
+
+		// Changing the limits starts the counting over
+		if stmt.resources != nil {
+			this.srv.resources.reset(a)
+		}
+
+		glog.V(3).Infof("%s %s", op, a)
+	}
+
+	return nil
+}
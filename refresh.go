@@ -0,0 +1,206 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"strings"
+)
+
+// refreshAction is what COM_REFRESH does for one of its flags, and FLUSH for the
+// matching option
+type refreshAction struct {
+	flag refreshFlag
+
+	// FLUSH options that map to the flag
+	options []string
+
+	// nil if the server doesn't support the action
+	run func(ctx context.Context, c *connection) error
+}
+
+// Actions in the order they run when several are asked for at once
+var refreshActions []refreshAction = []refreshAction{
+	// Accounts are held in memory and changes apply right away, so there is nothing
+	// to reload
+	{refreshGrant, []string{"PRIVILEGES"}, func(ctx context.Context, c *connection) error {
+		return nil
+	}},
+
+	// The server has its own log and the binary log, which FLUSH LOGS starts anew
+	{refreshLog, []string{"LOGS"}, func(ctx context.Context, c *connection) error {
+		if err := flushLogs(ctx, c); err != nil {
+			return err
+		}
+		return flushBinaryLogs(ctx, c)
+	}},
+	{refreshErrorLog, []string{"ERROR LOGS"}, flushLogs},
+	{refreshEngineLog, []string{"ENGINE LOGS"}, noRefresh},
+	{refreshBinaryLog, []string{"BINARY LOGS"}, flushBinaryLogs},
+	{refreshRelayLog, []string{"RELAY LOGS"}, noRefresh},
+	{refreshGeneralLog, []string{"GENERAL LOGS"}, noRefresh},
+	{refreshSlowLog, []string{"SLOW LOGS"}, noRefresh},
+
+	{refreshTables, []string{"TABLES"}, flushTables},
+
+	{refreshHosts, []string{"HOSTS"}, func(ctx context.Context, c *connection) error {
+		c.srv.FlushHosts()
+		return nil
+	}},
+
+	{refreshStatus, []string{"STATUS"}, func(ctx context.Context, c *connection) error {
+		c.srv.flushStatus()
+		return nil
+	}},
+
+	// Connections don't keep threads around for later
+	{refreshThreads, nil, noRefresh},
+
+	{refreshUserResources, []string{"USER_RESOURCES"}, func(ctx context.Context, c *connection) error {
+		c.srv.resources.flush()
+		return nil
+	}},
+
+	// There is no query cache
+	{refreshQueryCache, []string{"QUERY CACHE"}, noRefresh},
+	{refreshQueryCacheFree, nil, noRefresh},
+
+	{refreshSlave, nil, nil},
+	{refreshMaster, nil, nil},
+	{refreshReadLock, []string{"TABLES WITH READ LOCK"}, nil},
+	{refreshDesKeyFile, []string{"DES_KEY_FILE"}, nil},
+	{refreshForExport, nil, nil},
+}
+
+// Names used for the flags in errors, for those without a FLUSH option
+var refreshNames map[refreshFlag]string = map[refreshFlag]string{
+	refreshThreads:        "THREADS",
+	refreshQueryCacheFree: "QUERY CACHE FREE",
+	refreshSlave:          "SLAVE",
+	refreshMaster:         "MASTER",
+	refreshForExport:      "TABLES FOR EXPORT",
+}
+
+func noRefresh(ctx context.Context, c *connection) error {
+	return nil
+}
+
+func flushLogs(ctx context.Context, c *connection) error {
+	glog.Flush()
+	return nil
+}
+
+// flushBinaryLogs starts a new binary log file, if binary logging is on
+func flushBinaryLogs(ctx context.Context, c *connection) error {
+	if c.srv.binlog != nil {
+		if err := c.srv.binlog.rotate(); err != nil {
+			return handlerError(err)
+		}
+	}
+	return nil
+}
+
+// flushTables lets the query handler close the tables it holds open
+func flushTables(ctx context.Context, c *connection) error {
+	if flusher, ok := c.srv.cfg.QueryHandler.(TableFlusher); ok {
+		if err := flusher.FlushTables(ctx); err != nil {
+			return handlerError(err)
+		}
+	}
+	return nil
+}
+
+func (this *refreshAction) name() string {
+	if len(this.options) > 0 {
+		return this.options[0]
+	}
+	return refreshNames[this.flag]
+}
+
+// refresh runs the actions, which all need the RELOAD privilege. Nothing runs unless
+// every action is supported, and the error names all of those that aren't.
+func (this *connection) refresh(ctx context.Context, actions []*refreshAction) error {
+	if err := this.checkPrivilege(privReload, "RELOAD"); err != nil {
+		return err
+	}
+
+	var unsupported []string
+	for _, a := range actions {
+		if a.run == nil {
+			unsupported = append(unsupported, a.name())
+		}
+	}
+	if len(unsupported) > 0 {
+		return newSQLError(1235, "This version of qld doesn't yet support 'FLUSH %s'", strings.Join(unsupported, ", "))
+	}
+
+	var flags refreshFlag
+	for _, a := range actions {
+		flags |= a.flag
+	}
+
+	for _, a := range actions {
+		// The binary log is only rotated once when asked for along with all logs
+		if a.flag == refreshBinaryLog && flags&refreshLog != 0 {
+			continue
+		}
+
+		glog.V(3).Infof("Connection #%d: FLUSH %s", this.id, a.name())
+		if err := a.run(ctx, this); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execFlush runs a FLUSH statement
+// http://dev.mysql.com/doc/refman/5.6/en/flush.html
+func (this *connection) execFlush(ctx context.Context, stmt *flushStmt) error {
+	var actions []*refreshAction
+
+	for _, opt := range stmt.options {
+		var action *refreshAction
+		for i := range refreshActions {
+			for _, name := range refreshActions[i].options {
+				if name == opt {
+					action = &refreshActions[i]
+				}
+			}
+		}
+
+		if action == nil {
+			return newSQLError(1235, "This version of qld doesn't yet support 'FLUSH %s'", opt)
+		}
+		actions = append(actions, action)
+	}
+
+	return this.refresh(ctx, actions)
+}
+
+// handleRefresh answers COM_REFRESH, as sent by mysqladmin flush-hosts, reload and
+// the like
+// http://dev.mysql.com/doc/internals/en/com-refresh.html
+func (this *connection) handleRefresh(ctx context.Context, payload []byte) error {
+	if len(payload) < 1 {
+		return newSQLError(1835, "Malformed communication packet.")
+	}
+	flags := refreshFlag(payload[0])
+
+	var actions []*refreshAction
+	for i := range refreshActions {
+		if flags&refreshActions[i].flag != 0 {
+			actions = append(actions, &refreshActions[i])
+		}
+	}
+
+	if err := this.refresh(ctx, actions); err != nil {
+		return err
+	}
+	return this.writeOkPacket()
+}
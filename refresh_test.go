@@ -0,0 +1,141 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type flushHandler struct {
+	QueryHandlerFunc
+	flushes int32
+}
+
+func (this *flushHandler) FlushTables(ctx context.Context) error {
+	atomic.AddInt32(&this.flushes, 1)
+	return nil
+}
+
+func TestRefresh(t *testing.T) {
+	h := &flushHandler{}
+
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.QueryHandler = h
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"RELOAD"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	login := func(user string) *rawClient {
+		c, p := dialRawWith(t, s, rawLogin{user: user, password: "p"})
+		if p[0] != okPacket {
+			t.Fatalf("Handshake failed: %q", p)
+		}
+		return c
+	}
+
+	u := login("u")
+	defer u.Close()
+	admin := login("admin")
+	defer admin.Close()
+
+	questions := func() string {
+		rows, err := admin.query("SHOW GLOBAL STATUS LIKE 'Questions'")
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("Expecting 1 row, got %v, %v", rows, err)
+		}
+		return rows[0][1]
+	}
+
+	refresh := func(c *rawClient, flags refreshFlag) []byte {
+		p, err := c.command(comRefresh, []byte{byte(flags)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	if p := refresh(u, refreshHosts); errCode(p) != 1227 {
+		t.Errorf("Expecting ER_SPECIFIC_ACCESS_DENIED_ERROR, got %q", p)
+	}
+
+	// Nothing is flushed if one of the flags isn't supported, and all of those
+	// are named
+	if p := refresh(admin, refreshStatus|refreshSlave|refreshMaster); errCode(p) != 1235 || !strings.Contains(string(p), "'FLUSH SLAVE, MASTER'") {
+		t.Errorf("Expecting ER_NOT_SUPPORTED_YET for SLAVE and MASTER, got %q", p)
+	}
+	if q := questions(); q == "1" {
+		t.Errorf("Expecting Questions not to be reset")
+	}
+
+	if p := refresh(admin, refreshGrant|refreshLog|refreshTables|refreshHosts|refreshStatus|refreshThreads); p[0] != okPacket {
+		t.Errorf("Expecting OK, got %q", p)
+	}
+	if q := questions(); q != "1" {
+		t.Errorf("Expecting Questions to be reset, got %s", q)
+	}
+
+	for q, code := range map[string]int{
+		"FLUSH PRIVILEGES":            0,
+		"FLUSH LOCAL TABLES, LOGS":    0,
+		"FLUSH ERROR LOGS":            0,
+		"FLUSH QUERY CACHE":           0,
+		"FLUSH TABLES WITH READ LOCK": 1235,
+		"FLUSH OPTIMIZER_COSTS":       1235,
+	} {
+		if p, err := admin.command(comComQuery, []byte(q)); err != nil || errCode(p) != code {
+			t.Errorf("%s: expecting error %d, got %q, %v", q, code, p, err)
+		}
+	}
+
+	if p, err := u.command(comComQuery, []byte("FLUSH TABLES")); err != nil || errCode(p) != 1227 {
+		t.Errorf("Expecting ER_SPECIFIC_ACCESS_DENIED_ERROR, got %q, %v", p, err)
+	}
+
+	// Once for COM_REFRESH, once for FLUSH LOCAL TABLES
+	if n := atomic.LoadInt32(&h.flushes); n != 2 {
+		t.Errorf("Expecting 2 table flushes, got %d", n)
+	}
+}
+
+func TestRefreshLogs(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.LogBin = filepath.Join(t.TempDir(), "binlog")
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	c := dialRaw(t, s, "root")
+	defer c.Close()
+
+	// As sent by mysqladmin flush-logs. The binary log moves on to a new file, once
+	// even if asked for twice.
+	for i, flags := range []refreshFlag{refreshLog, refreshLog | refreshBinaryLog} {
+		if p, err := c.command(comRefresh, []byte{byte(flags)}); err != nil || p[0] != okPacket {
+			t.Fatalf("Expecting OK, got %q, %v", p, err)
+		}
+		if n := len(s.binlog.logs()); n != i+2 {
+			t.Errorf("Expecting %d binary log files, got %d", i+2, n)
+		}
+	}
+
+	if p, err := c.command(comComQuery, []byte("FLUSH LOGS")); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+	if n := len(s.binlog.logs()); n != 4 {
+		t.Errorf("Expecting 4 binary log files, got %d", n)
+	}
+}
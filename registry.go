@@ -0,0 +1,115 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// connInfo is what the server knows about a connection at a point in time. It is
+// the source for the process list.
+type connInfo struct {
+	Id   uint32
+	User string
+
+	// host:port of the client, or "localhost" for Unix domain sockets
+	Host   string
+	Schema string
+
+	// Name of the command being executed, "Sleep" if there is none
+	Command string
+	State   string
+
+	// The statement being executed, if any
+	Info string
+
+	// When the connection was accepted, and when it entered its current command
+	Start        time.Time
+	CommandStart time.Time
+}
+
+// registry keeps track of the live connections by connection id. Ids are handed
+// out in increasing order and are the ones sent to clients in the handshake.
+type registry struct {
+	mu     sync.RWMutex
+	lastId uint32
+	conns  map[uint32]*connection
+}
+
+func newRegistry() *registry {
+	return &registry{
+		conns: make(map[uint32]*connection),
+	}
+}
+
+// add assigns the next connection id to c and registers it. Once the 32 bit ids
+// wrap around, 0 and ids of connections that are still around are skipped.
+func (this *registry) add(c *connection) uint32 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for {
+		this.lastId++
+		if _, ok := this.conns[this.lastId]; this.lastId != 0 && !ok {
+			break
+		}
+	}
+
+	c.id = this.lastId
+	c.info.Id = c.id
+	this.conns[c.id] = c
+
+	return c.id
+}
+
+func (this *registry) remove(id uint32) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.conns, id)
+}
+
+func (this *registry) get(id uint32) *connection {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.conns[id]
+}
+
+func (this *registry) count() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return len(this.conns)
+}
+
+// each calls fn for every registered connection. fn must not add or remove
+// connections.
+func (this *registry) each(fn func(c *connection)) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for _, c := range this.conns {
+		fn(c)
+	}
+}
+
+// snapshot returns the current information of every connection, ordered by id
+func (this *registry) snapshot() []connInfo {
+	var infos []connInfo
+	this.each(func(c *connection) {
+		infos = append(infos, c.snapshot())
+	})
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+
+	return infos
+}
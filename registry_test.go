@@ -0,0 +1,86 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestRegistryIds(t *testing.T) {
+	r := newRegistry()
+
+	a, b := &connection{}, &connection{}
+	if r.add(a) != 1 || r.add(b) != 2 {
+		t.Fatalf("Expecting ids 1 and 2, got %d and %d", a.id, b.id)
+	}
+
+	r.remove(a.id)
+	if r.count() != 1 || r.get(1) != nil || r.get(2) != b {
+		t.Error("Wrong registry content after remove")
+	}
+
+	// Ids are not reused right away
+	if c := (&connection{}); r.add(c) != 3 {
+		t.Errorf("Expecting id 3, got %d", c.id)
+	}
+
+	if infos := r.snapshot(); len(infos) != 2 || infos[0].Id != 2 || infos[1].Id != 3 {
+		t.Errorf("Wrong snapshot %#v", infos)
+	}
+}
+
+func TestRegistryWrapAround(t *testing.T) {
+	r := newRegistry()
+	r.add(&connection{})
+	r.lastId = 1<<32 - 2
+
+	if c := (&connection{}); r.add(c) != 1<<32-1 {
+		t.Errorf("Expecting id %d, got %d", uint32(1<<32-1), c.id)
+	}
+
+	// 0 is never used and 1 is still taken
+	if c := (&connection{}); r.add(c) != 2 {
+		t.Errorf("Expecting id 2, got %d", c.id)
+	}
+}
+
+func TestHandshakeConnectionId(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	a := dialRaw(t, s, "a")
+	defer a.Close()
+	b := dialRaw(t, s, "b")
+	defer b.Close()
+
+	infos := s.conns.snapshot()
+	if len(infos) != 2 {
+		t.Fatalf("Expecting 2 connections, got %#v", infos)
+	}
+
+	if infos[0].User != "a" || infos[1].User != "b" || infos[1].Id != infos[0].Id+1 {
+		t.Errorf("Wrong connection info %#v", infos)
+	}
+
+	if infos[0].Command != "Sleep" || infos[0].Start.IsZero() {
+		t.Errorf("Wrong connection info %#v", infos[0])
+	}
+
+	if a.greeting == nil || binary.LittleEndian.Uint32(a.greeting[7:]) != infos[0].Id {
+		t.Errorf("Handshake connection id doesn't match registry id %d", infos[0].Id)
+	}
+
+	a.Close()
+	for i := 0; i < 50 && s.conns.count() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.conns.count() != 1 {
+		t.Error("Closed connection was not removed from the registry")
+	}
+}
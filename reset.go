@@ -0,0 +1,45 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"github.com/golang/glog"
+)
+
+// resetSession returns the session to the state of a new connection, keeping the
+// user and the default database. The open transaction, if any, is rolled back, and
+// the query handler gets to drop what it holds for the session.
+func (this *connection) resetSession(ctx context.Context) error {
+	if this.InTransaction() && this.srv.cfg.QueryHandler != nil {
+		if _, err := this.callQueryHandler(ctx, "ROLLBACK"); err != nil {
+			glog.Errorf("Connection #%d: Error rolling back transaction: %v", this.id, err)
+		}
+	}
+	this.status = serverStatusAutocommit
+
+	this.vars = this.newSessionVars()
+	this.userVars = make(map[string]setValue)
+
+	if resetter, ok := this.srv.cfg.QueryHandler.(SessionResetter); ok {
+		if err := resetter.ResetSession(ctx, this); err != nil {
+			return handlerError(err)
+		}
+	}
+
+	return nil
+}
+
+// handleResetConnection answers COM_RESET_CONNECTION, which resets the session
+// without logging in again
+// http://dev.mysql.com/doc/internals/en/com-reset-connection.html
+func (this *connection) handleResetConnection(ctx context.Context) error {
+	if err := this.resetSession(ctx); err != nil {
+		return err
+	}
+	return this.writeOkPacket()
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// query sends a query that returns a result set and returns its rows, with NULL as
+// "NULL"
+func (this *rawClient) query(q string) ([][]string, error) {
+	p, err := this.command(comComQuery, []byte(q))
+	if err != nil {
+		return nil, err
+	} else if p[0] == errPacket {
+		return nil, newSQLError(errCode(p), "%s", p[9:])
+	}
+
+	// Column definitions up to the first EOF
+	for p[0] != eofPacket {
+		if p, err = this.readPacket(); err != nil {
+			return nil, err
+		}
+	}
+
+	var rows [][]string
+	for {
+		if p, err = this.readPacket(); err != nil {
+			return nil, err
+		} else if p[0] == eofPacket {
+			return rows, nil
+		}
+
+		var row []string
+		buf := bytes.NewBuffer(p)
+		for buf.Len() > 0 {
+			if buf.Bytes()[0] == 0xfb {
+				buf.Next(1)
+				row = append(row, "NULL")
+				continue
+			}
+
+			s, err := readLenencString(buf)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, s)
+		}
+		rows = append(rows, row)
+	}
+}
+
+type resetHandler struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (this *resetHandler) HandleQuery(ctx context.Context, session Session, q string) (*Result, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if session.InTransaction() {
+		q += " in transaction"
+	}
+	this.calls = append(this.calls, q)
+	return nil, nil
+}
+
+func (this *resetHandler) ResetSession(ctx context.Context, session Session) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.calls = append(this.calls, "reset "+session.Schema())
+	return nil
+}
+
+func TestResetConnection(t *testing.T) {
+	h := &resetHandler{}
+
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.QueryHandler = h
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	c, p := dialRawWith(t, s, rawLogin{user: "u", schema: "testdb"})
+	defer c.Close()
+	if p[0] != okPacket {
+		t.Fatalf("Handshake failed: %q", p)
+	}
+
+	for _, q := range []string{"SET SESSION wait_timeout = 5", "SET @a = 1", "BEGIN"} {
+		if p, err := c.command(comComQuery, []byte(q)); err != nil || p[0] != okPacket {
+			t.Fatalf("%s: expecting OK, got %q, %v", q, p, err)
+		}
+	}
+
+	if p, err := c.command(comResetConnection, nil); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+
+	// The session variable is back to its global value
+	rows, err := c.query("SHOW VARIABLES LIKE 'wait_timeout'")
+	if err != nil || len(rows) != 1 || rows[0][1] != "28800" {
+		t.Errorf("Expecting default wait_timeout, got %v, %v", rows, err)
+	}
+
+	if _, err := c.command(comComQuery, []byte("SELECT 1")); err != nil {
+		t.Fatal(err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	expected := []string{"BEGIN", "ROLLBACK in transaction", "reset testdb", "SELECT 1"}
+	if !reflect.DeepEqual(h.calls, expected) {
+		t.Errorf("Expecting calls %q, got %q", expected, h.calls)
+	}
+}
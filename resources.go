@@ -0,0 +1,121 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"sync"
+	"time"
+)
+
+// Length of the window the per hour resource limits are counted in
+const resourceWindow = time.Hour
+
+// accountUsage counts what an account has done since the start of its current
+// window
+type accountUsage struct {
+	windowStart time.Time
+	questions   uint64
+	updates     uint64
+	connections uint64
+}
+
+// userResources enforces MAX_QUERIES_PER_HOUR, MAX_UPDATES_PER_HOUR and
+// MAX_CONNECTIONS_PER_HOUR. Usage is only tracked for accounts with at least one
+// of the limits set. A window starts with the first counted use, and the counters
+// start over once it is an hour old.
+// http://dev.mysql.com/doc/refman/5.6/en/user-resources.html
+type userResources struct {
+	mu    sync.Mutex
+	usage map[string]*accountUsage
+}
+
+func newUserResources() *userResources {
+	return &userResources{
+		usage: make(map[string]*accountUsage),
+	}
+}
+
+// current returns the usage of the account in the current window. Must be called
+// with mu held.
+func (this *userResources) current(a *account) *accountUsage {
+	now := time.Now()
+	key := a.String()
+
+	u, ok := this.usage[key]
+	if !ok || now.Sub(u.windowStart) >= resourceWindow {
+		u = &accountUsage{windowStart: now}
+		this.usage[key] = u
+	}
+
+	return u
+}
+
+// connect counts a login, unless the account has reached MAX_CONNECTIONS_PER_HOUR
+func (this *userResources) connect(a *account) error {
+	if !a.hasHourlyLimits() {
+		return nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	u := this.current(a)
+	if a.maxConnectionsPerHour != 0 && u.connections >= a.maxConnectionsPerHour {
+		return limitReached(a, "max_connections_per_hour", u.connections)
+	}
+
+	u.connections++
+	return nil
+}
+
+// query counts a statement, unless the account has reached MAX_QUERIES_PER_HOUR or,
+// for statements that change data, MAX_UPDATES_PER_HOUR
+func (this *userResources) query(a *account, update bool) error {
+	if !a.hasHourlyLimits() {
+		return nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	u := this.current(a)
+	if a.maxQueriesPerHour != 0 && u.questions >= a.maxQueriesPerHour {
+		return limitReached(a, "max_questions", u.questions)
+	}
+
+	if update && a.maxUpdatesPerHour != 0 && u.updates >= a.maxUpdatesPerHour {
+		return limitReached(a, "max_updates", u.updates)
+	}
+
+	u.questions++
+	if update {
+		u.updates++
+	}
+
+	return nil
+}
+
+// reset starts the counting over for a single account, as happens when its limits
+// are changed
+func (this *userResources) reset(a *account) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.usage, a.String())
+}
+
+// flush starts the counting over for every account, for FLUSH USER_RESOURCES
+func (this *userResources) flush() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.usage = make(map[string]*accountUsage)
+}
+
+func limitReached(a *account, resource string, current uint64) error {
+	return newSQLError(1226, "User '%s' has exceeded the '%s' resource (current value: %d)", a.user, resource, current)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUserResources(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Accounts = []AccountConfig{
+		{User: "root", Password: "p", Privileges: []string{"ALL"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	dsn := func(user, password string) string {
+		return fmt.Sprintf("%s:%s@tcp(%s)/", user, password, s.Addrs()[0])
+	}
+
+	ctx := context.Background()
+
+	expectErr := func(err error, code string) {
+		t.Helper()
+		if err == nil || !strings.Contains(err.Error(), code) {
+			t.Errorf("Expecting error %s, got %v", code, err)
+		}
+	}
+
+	root, closeRoot, err := openConn(dsn("root", "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRoot()
+
+	if _, err := root.ExecContext(ctx, "CREATE USER 'svc'@'%' IDENTIFIED BY 'pw' WITH MAX_QUERIES_PER_HOUR 3 MAX_CONNECTIONS_PER_HOUR 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = root.ExecContext(ctx, "CREATE USER svc IDENTIFIED BY 'other'")
+	expectErr(err, "1396")
+
+	svc, closeSvc, err := openConn(dsn("svc", "pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSvc()
+
+	for i := 0; i < 2; i++ {
+		if _, err := svc.ExecContext(ctx, "SET @a = 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = svc.ExecContext(ctx, "CREATE USER x")
+	expectErr(err, "1227")
+
+	_, err = svc.ExecContext(ctx, "SET @a = 1")
+	expectErr(err, "1226")
+
+	_, closeSvc2, err := openConn(dsn("svc", "pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSvc2()
+
+	_, _, err = openConn(dsn("svc", "pw"))
+	expectErr(err, "1226")
+
+	if _, err := root.ExecContext(ctx, "FLUSH USER_RESOURCES"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.ExecContext(ctx, "SET @a = 1"); err != nil {
+		t.Errorf("Expecting counters to be reset, got %v", err)
+	}
+
+	if _, err := root.ExecContext(ctx, "ALTER USER svc WITH MAX_UPDATES_PER_HOUR 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not supported, but it still counts as an update
+	_, err = svc.ExecContext(ctx, "INSERT INTO t VALUES (1)")
+	expectErr(err, "1235")
+
+	_, err = svc.ExecContext(ctx, "INSERT INTO t VALUES (2)")
+	expectErr(err, "1226")
+
+	if _, err := svc.ExecContext(ctx, "SET @a = 1"); err != nil {
+		t.Errorf("Expecting queries to still be allowed, got %v", err)
+	}
+}
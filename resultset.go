@@ -0,0 +1,245 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// http://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnDefinition41
+type columnDef struct {
+	schema   string
+	table    string
+	orgTable string
+	name     string
+	orgName  string
+	charset  byte
+	length   uint32
+	typ      fieldType
+	flags    uint16
+	decimals byte
+
+	// Only sent in response to COM_FIELD_LIST, where nil is sent as NULL
+	defaultValue *string
+}
+
+// varcharColumn returns the definition of a string column not backed by a table, as
+// used for the results of SHOW statements
+func varcharColumn(name string, length uint32) *columnDef {
+	return &columnDef{
+		name:    name,
+		charset: collationUtf8General,
+		length:  length * 3,
+		typ:     fieldTypeVarString,
+	}
+}
+
+// http://dev.mysql.com/doc/internals/en/integer.html#packet-Protocol::LengthEncodedInteger
+func writeLenencInt(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 251:
+		buf.WriteByte(byte(n))
+	case n < 1<<16:
+		buf.WriteByte(0xfc)
+		binary.Write(buf, binary.LittleEndian, uint16(n))
+	case n < 1<<24:
+		buf.WriteByte(0xfd)
+		buf.Write([]byte{byte(n), byte(n >> 8), byte(n >> 16)})
+	default:
+		buf.WriteByte(0xfe)
+		binary.Write(buf, binary.LittleEndian, n)
+	}
+}
+
+func writeLenencString(buf *bytes.Buffer, s string) {
+	writeLenencInt(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func readLenencInt(buf *bytes.Buffer) (uint64, error) {
+	first, err := buf.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	switch first {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	default:
+		return uint64(first), nil
+	}
+
+	b := buf.Next(size)
+	if len(b) != size {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	return n, nil
+}
+
+func readLenencString(buf *bytes.Buffer) (string, error) {
+	n, err := readLenencInt(buf)
+	if err != nil {
+		return "", err
+	}
+
+	if uint64(buf.Len()) < n {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(buf.Next(int(n))), nil
+}
+
+func (this *connection) writeColumnDef(col *columnDef) error {
+	this.buf.Reset()
+	appendColumnDef(&this.buf, col)
+	return this.writePacket()
+}
+
+func appendColumnDef(buf *bytes.Buffer, col *columnDef) {
+	/*
+		lenenc_str     catalog
+		lenenc_str     schema
+		lenenc_str     table
+		lenenc_str     org_table
+		lenenc_str     name
+		lenenc_str     org_name
+		lenenc_int     length of fixed-length fields [0c]
+		2              character set
+		4              column length
+		1              type
+		2              flags
+		1              decimals
+		2              filler [00] [00]
+	*/
+
+	writeLenencString(buf, "def")
+	writeLenencString(buf, col.schema)
+	writeLenencString(buf, col.table)
+	writeLenencString(buf, col.orgTable)
+	writeLenencString(buf, col.name)
+	writeLenencString(buf, col.orgName)
+	writeLenencInt(buf, 0x0c)
+	binary.Write(buf, binary.LittleEndian, uint16(col.charset))
+	binary.Write(buf, binary.LittleEndian, col.length)
+	buf.WriteByte(byte(col.typ))
+	binary.Write(buf, binary.LittleEndian, col.flags)
+	buf.WriteByte(col.decimals)
+	buf.Write([]byte{0, 0})
+}
+
+// http://dev.mysql.com/doc/internals/en/packet-EOF_Packet.html
+func (this *connection) writeEOFPacket() error {
+	this.buf.Reset()
+
+	/*
+		1              [fe] the EOF header
+		2              warning count
+		2              status flags
+	*/
+
+	this.buf.Write([]byte{eofPacket, 0, 0, byte(this.status), byte(this.status >> 8)})
+
+	return this.writePacket()
+}
+
+// writeResultSet sends a complete text protocol result set. nil values are NULL.
+// http://dev.mysql.com/doc/internals/en/com-query-response.html#packet-ProtocolText::Resultset
+func (this *connection) writeResultSet(cols []*columnDef, rows [][]interface{}) error {
+	if err := this.writeResultSetHeader(cols); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := this.writeTextRow(cols, row); err != nil {
+			return err
+		}
+	}
+
+	return this.writeEOFPacket()
+}
+
+// writeResultSetHeader sends the column count and definitions that start a result
+// set. The rows and a closing EOF packet follow.
+func (this *connection) writeResultSetHeader(cols []*columnDef) error {
+	this.buf.Reset()
+	writeLenencInt(&this.buf, uint64(len(cols)))
+	if err := this.writePacket(); err != nil {
+		return err
+	}
+
+	for _, col := range cols {
+		if err := this.writeColumnDef(col); err != nil {
+			return err
+		}
+	}
+
+	return this.writeEOFPacket()
+}
+
+// http://dev.mysql.com/doc/internals/en/com-query-response.html#packet-ProtocolText::ResultsetRow
+func (this *connection) writeTextRow(cols []*columnDef, row []interface{}) error {
+	this.buf.Reset()
+
+	for i, v := range row {
+		switch v := v.(type) {
+		case nil:
+			this.buf.WriteByte(0xfb)
+		case string:
+			writeLenencString(&this.buf, v)
+		case []byte:
+			writeLenencInt(&this.buf, uint64(len(v)))
+			this.buf.Write(v)
+		case bool:
+			if v {
+				writeLenencString(&this.buf, "1")
+			} else {
+				writeLenencString(&this.buf, "0")
+			}
+		case float32:
+			writeLenencString(&this.buf, strconv.FormatFloat(float64(v), 'f', -1, 32))
+		case float64:
+			writeLenencString(&this.buf, strconv.FormatFloat(v, 'f', -1, 64))
+		case time.Time:
+			writeLenencString(&this.buf, formatTime(v, cols[i].typ))
+		default:
+			writeLenencString(&this.buf, fmt.Sprint(v))
+		}
+	}
+
+	return this.writePacket()
+}
+
+// formatTime formats t the way MySQL shows a value of type typ
+func formatTime(t time.Time, typ fieldType) string {
+	switch typ {
+	case fieldTypeDate, fieldTypeNewDate:
+		return t.Format("2006-01-02")
+	case fieldTypeTime:
+		return t.Format("15:04:05")
+	case fieldTypeYear:
+		return t.Format("2006")
+	}
+
+	if t.Nanosecond() != 0 {
+		return t.Format(defaultTimeFormat + ".999999")
+	}
+	return t.Format(defaultTimeFormat)
+}
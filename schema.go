@@ -0,0 +1,75 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"strings"
+)
+
+// Databases provided by the server itself
+var systemDatabases []string = []string{"information_schema", "performance_schema"}
+
+// databaseExists returns true if db can be selected. Names are case sensitive, except
+// for the system databases.
+func (this *Server) databaseExists(db string) bool {
+	for _, name := range systemDatabases {
+		if strings.EqualFold(name, db) {
+			return true
+		}
+	}
+
+	if len(this.cfg.Databases) == 0 {
+		return true
+	}
+
+	for _, name := range this.cfg.Databases {
+		if name == db {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkSchema returns why the session can't use db as its default database, if it
+// can't. Access is checked first, so users can't find out about databases they
+// have no access to.
+func (this *connection) checkSchema(acct *account, db string) error {
+	if !acct.canUseDatabase(db) {
+		return newSQLError(1044, "Access denied for user '%s'@'%s' to database '%s'", acct.user, acct.host, db)
+	}
+
+	if !this.srv.databaseExists(db) {
+		return newSQLError(1049, "Unknown database '%s'", db)
+	}
+
+	return nil
+}
+
+// changeSchema switches the default database of the session, for COM_INIT_DB and
+// USE. The change is reported to clients that track the session state.
+// http://dev.mysql.com/doc/internals/en/com-init-db.html
+func (this *connection) changeSchema(db string) error {
+	if db == "" {
+		return SQLErrors[1046]
+	}
+
+	if err := this.checkSchema(this.account, db); err != nil {
+		return err
+	}
+
+	this.schema = db
+	if this.sysVarValue("session_track_schema") != 0 {
+		this.schemaChanged = true
+	}
+
+	this.mu.Lock()
+	this.info.Schema = db
+	this.mu.Unlock()
+
+	return nil
+}
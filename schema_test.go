@@ -0,0 +1,85 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestChangeSchema(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Databases = []string{"app", "other"}
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p", Databases: []string{"ap%"}},
+		{User: "root", Password: "p", Privileges: []string{"ALL"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	logins := []struct {
+		login rawLogin
+		code  int
+	}{
+		{rawLogin{user: "u", password: "p", schema: "app"}, 0},
+		{rawLogin{user: "u", password: "p", schema: "other"}, 1044},
+		{rawLogin{user: "u", password: "p", schema: "apps"}, 1049},
+		{rawLogin{user: "u", password: "p", schema: "missing"}, 1044},
+		{rawLogin{user: "root", password: "p", schema: "missing"}, 1049},
+		{rawLogin{user: "root", password: "p", schema: "other"}, 0},
+	}
+
+	for _, l := range logins {
+		c, p := dialRawWith(t, s, l.login)
+		c.Close()
+
+		if errCode(p) != l.code {
+			t.Errorf("%s to %s: expecting error %d, got %q", l.login.user, l.login.schema, l.code, p)
+		}
+	}
+
+	c, p := dialRawWith(t, s, rawLogin{user: "u", password: "p", caps: clientSessionTrack})
+	if p[0] != okPacket {
+		t.Fatalf("Handshake failed: %q", p)
+	}
+	defer c.Close()
+
+	p, err := c.command(comInitDB, []byte("information_schema"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OK, no affected rows or insert id, status, no warnings, empty info, then
+	// the session state
+	if p[0] != okPacket || serverStatusFlag(binary.LittleEndian.Uint16(p[3:]))&serverSessionStateChanged == 0 {
+		t.Fatalf("Expecting OK with session state, got %q", p)
+	}
+
+	state := append([]byte{byte(sessionTrackSchema), 19, 18}, "information_schema"...)
+	if string(p[7:]) != string(append([]byte{0, byte(len(state))}, state...)) {
+		t.Errorf("Wrong session state %q", p[7:])
+	}
+
+	for db, code := range map[string]int{"other": 1044, "": 1046, "app": 0} {
+		if p, err := c.command(comInitDB, []byte(db)); err != nil || errCode(p) != code {
+			t.Errorf("COM_INIT_DB %q: expecting error %d, got %q, %v", db, code, p, err)
+		}
+	}
+
+	if p, err := c.command(comComQuery, []byte("USE missing")); err != nil || errCode(p) != 1044 {
+		t.Errorf("Expecting ER_DBACCESS_DENIED_ERROR, got %q, %v", p, err)
+	}
+
+	// Connections turned away above may still be closing, but they never logged in
+	for _, info := range s.conns.snapshot() {
+		if info.User == "u" && info.Schema != "app" {
+			t.Errorf("Expecting schema app in the process list, got %+v", info)
+		}
+	}
+}
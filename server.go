@@ -7,100 +7,271 @@
 package qld
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/dustin/randbo"
 	"github.com/golang/glog"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var _ = log.Ldate
 
-type server struct {
-	cfg *config
+type Server struct {
+	cfg *Config
 
-	connId      int
-	connIdMutex sync.RWMutex
+	// When the server was created, for the Uptime status variable
+	started time.Time
 
-	lns     []net.Listener
-	netQuit chan bool
+	// Global system variables
+	globals *variables
 
-	// We will keep track of all the connections in this slice. However, this means
-	// this slice could potentially grow large. If there's a million connections created
-	// over time, it means this slice will be 4MB. So a potentialy memory "leak" here.
-	conns []net.Conn
+	// Connections from these networks must start with a PROXY protocol header
+	trustedProxies []*net.IPNet
+
+	accounts *accountStore
+	limits   *connLimits
+	hosts    *hostCache
+
+	// Per hour usage of the accounts with resource limits
+	resources *userResources
+
+	// Runs the commands of all connections
+	sched scheduler
+	stats serverStats
+
+	// Handlers for the commands the server answers
+	commands map[serverCommand]commandFunc
+
+	// nil unless binary logging is on
+	binlog *binlog
+
+	// Replicas that registered with COM_REGISTER_SLAVE
+	replicas *replicas
+
+	// Only set if the server has a certificate configured
+	tlsConfig *tls.Config
+
+	lns      []*listener
+	netQuit  chan bool
+	quitOnce sync.Once
+	acceptWg sync.WaitGroup
+
+	// Closed when a graceful shutdown starts. Connections finish the command they
+	// are running and are then told the server is going away.
+	draining  chan bool
+	drainOnce sync.Once
+
+	// All live connections by connection id
+	conns *registry
+
+	// Tracks the connection goroutines so Serve() and Shutdown() can wait for them
+	connsWg sync.WaitGroup
 }
 
-func newServer(cfg *config) (*server, error) {
-	s := &server{
-		cfg: cfg,
+// How often Shutdown() checks for connections that became idle
+const drainInterval = 100 * time.Millisecond
+
+// How long a connection waits for its next command while the server is shutting
+// down, in case it's a COM_PING
+const drainPingWait = 100 * time.Millisecond
+
+func NewServer(cfg *Config) (*Server, error) {
+	if cfg == nil {
+		var err error
+		if cfg, err = NewConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		cfg:      cfg,
+		started:  time.Now(),
+		globals:  newGlobalVariables(cfg),
+		netQuit:  make(chan bool),
+		draining: make(chan bool),
+		conns:    newRegistry(),
+		limits:   newConnLimits(),
+		hosts:    newHostCache(),
+
+		resources: newUserResources(),
+		commands:  newCommands(cfg.Commands),
+		replicas:  newReplicas(),
+	}
+
+	var err error
+	if s.accounts, err = newAccountStore(cfg.Accounts); err != nil {
+		return nil, err
+	}
+
+	if s.sched, err = newScheduler(cfg); err != nil {
+		return nil, err
+	}
+
+	if s.trustedProxies, err = parseTrustedProxies(cfg.ProxyProtocolNetworks); err != nil {
+		return nil, err
+	}
+
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if cfg.LogBin != "" {
+		if s.binlog, err = newBinlog(cfg, s.globals); err != nil {
+			return nil, err
+		}
 	}
 
 	return s, nil
 }
 
-func (this *server) run() error {
-	this.netQuit = make(chan bool)
-
-	tcp, err := net.Listen("tcp", ":3306")
-	if err != nil {
+// Run binds all the configured listeners and serves connections until the server is
+// closed or shut down
+func (this *Server) Run() error {
+	if err := this.Listen(); err != nil {
 		return err
 	}
-	defer tcp.Close()
-
-	this.lns = append(this.lns, tcp)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	return this.Serve()
+}
 
-	go func() {
-		defer func() {
-			glog.V(3).Info("Quitting Accept() goroutine")
-			for _, conn := range this.conns {
-				conn.Close()
+// Listen binds all the configured listeners. If any of them fails, the ones already
+// bound are closed again.
+func (this *Server) Listen() error {
+	for i := range this.cfg.Listeners {
+		ln, err := listen(&this.cfg.Listeners[i])
+		if err != nil {
+			for _, l := range this.lns {
+				l.Close()
 			}
+			this.lns = nil
+			return err
+		}
+
+		glog.V(3).Infof("Listening on %s (%s)", ln.Addr(), ln.cfg)
+		this.lns = append(this.lns, ln)
+	}
+
+	return nil
+}
 
-			wg.Done()
-		}()
+// Addrs returns the addresses the server is listening on, in the order of the
+// configured listeners. This is where to find the port chosen for port 0.
+func (this *Server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, ln := range this.lns {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Serve accepts connections on the listeners bound by Listen(). It returns once the
+// server has been closed or shut down and all of its connections have ended.
+func (this *Server) Serve() error {
+	this.sched.start()
+	defer this.sched.stop()
+
+	for _, ln := range this.lns {
+		this.acceptWg.Add(1)
+		go func(ln *listener) {
+			defer this.acceptWg.Done()
+			defer ln.Close()
+			this.acceptLoop(ln)
+		}(ln)
+	}
+
+	this.acceptWg.Wait()
+	this.connsWg.Wait()
+
+	if this.binlog != nil {
+		this.binlog.close()
+	}
+
+	return nil
+}
 
-		for {
-			glog.V(3).Info("Listening for connections")
-			conn, err := tcp.Accept()
-			if err != nil {
-				select {
-				case <-this.netQuit:
-					return
-				default:
-				}
+func (this *Server) acceptLoop(ln *listener) {
+	defer glog.V(3).Infof("Quitting Accept() goroutine for %s", ln.Addr())
 
-				continue
+	for {
+		glog.V(3).Info("Listening for connections")
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-this.netQuit:
+				return
+			default:
 			}
 
-			this.conns = append(this.conns, conn)
-			go this.handleConnection(conn, len(this.conns)-1)
+			continue
 		}
-	}()
 
-	wg.Wait()
+		atomic.AddUint64(&this.stats.connections, 1)
 
-	return nil
+		c := &connection{sock: conn}
+		c.info.Host = clientHost(conn.RemoteAddr())
+		c.info.Command = commandName[comConnect]
+		c.info.State = "login"
+		c.info.Start = time.Now()
+		c.info.CommandStart = c.info.Start
+
+		this.conns.add(c)
+
+		this.connsWg.Add(1)
+		go this.handleConnection(c, conn, ln.cfg)
+	}
 }
 
-func (this *server) handleConnection(conn net.Conn, id int) error {
+func (this *Server) handleConnection(c *connection, conn net.Conn, lc *ListenerConfig) error {
+	id := c.id
+
 	defer func() {
 		glog.V(3).Infof("Closing connection #%d", id)
 		conn.Close()
-		this.conns[id] = nil
+		this.conns.remove(id)
+		this.replicas.remove(id)
+		this.connsWg.Done()
 	}()
 
 	glog.V(3).Infof("Starting connection #%d", id)
 
-	c := &connection{}
+	if isTrustedProxy(conn.RemoteAddr(), this.trustedProxies) {
+		pc, err := this.acceptProxy(conn)
+		if err != nil {
+			glog.Errorf("Connection #%d: Error reading PROXY header from %s: %v", id, conn.RemoteAddr(), err)
+			atomic.AddUint64(&this.stats.abortedConnects, 1)
+			return err
+		}
+		conn = pc
+
+		c.mu.Lock()
+		c.info.Host = clientHost(conn.RemoteAddr())
+		c.mu.Unlock()
+	}
+
 	c.rand = randbo.New()
 	c.cfg = this.cfg
+	c.srv = this
 	c.Conn = conn
-	c.id = id
+	c.listener = lc
+	c.vars = this.globals.sessionCopy()
+	c.userVars = make(map[string]setValue)
+	c.status = serverStatusAutocommit
+
+	if this.cfg.TraceDir != "" {
+		if err := c.startTrace(this.cfg.TraceDir); err != nil {
+			glog.Errorf("Connection #%d: Error starting trace: %v", id, err)
+		}
+		defer c.stopTrace()
+	}
 
 	if n, err := c.rand.Read(c.cipher[:]); err != nil {
 		return err
@@ -108,6 +279,13 @@ func (this *server) handleConnection(conn net.Conn, id int) error {
 		return fmt.Errorf("Connection/NewConnection: Error generating 20 bytes for random cipher. Only generated %d", n)
 	}
 
+	// The account is set once it has been admitted by the connection limits
+	defer func() {
+		if c.counted {
+			this.limits.disconnect(c.account)
+		}
+	}()
+
 	if err := c.handleConnectionPhase(); err != nil {
 		return err
 	}
@@ -119,9 +297,111 @@ func (this *server) handleConnection(conn net.Conn, id int) error {
 	return nil
 }
 
-func (this *server) quit() {
-	close(this.netQuit)
-	for _, ln := range this.lns {
-		ln.Close()
+// acceptProxy reads the PROXY protocol header sent by a trusted proxy. The returned
+// connection reports the client and server addresses given by the proxy.
+func (this *Server) acceptProxy(conn net.Conn) (net.Conn, error) {
+	timeout, _ := this.globals.get("connect_timeout")
+	conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	hdr, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{Conn: conn, header: hdr}
+	glog.V(3).Infof("PROXY v%d header from %s, client address %s", hdr.version, conn.RemoteAddr(), pc.RemoteAddr())
+
+	return pc, nil
+}
+
+func (this *Server) isShuttingDown() bool {
+	select {
+	case <-this.draining:
+		return true
+	default:
+	}
+	return false
+}
+
+// stopAccepting closes all the listeners, so new connections are refused
+func (this *Server) stopAccepting() {
+	this.quitOnce.Do(func() {
+		close(this.netQuit)
+		for _, ln := range this.lns {
+			ln.Close()
+		}
+	})
+}
+
+// Close stops the server immediately. Listeners are closed and every connection is
+// dropped, even in the middle of a command.
+func (this *Server) Close() {
+	this.stopAccepting()
+
+	glog.V(3).Info("Closing all connections")
+	this.conns.each(func(c *connection) {
+		c.sock.Close()
+	})
+}
+
+// requestShutdown starts a graceful shutdown in the background, for clients that ask
+// for one. It can't wait for the shutdown to complete, since that waits for the
+// client's own command.
+func (this *Server) requestShutdown() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(this.cfg.ShutdownTimeout)*time.Second)
+		defer cancel()
+
+		if err := this.Shutdown(ctx); err != nil {
+			glog.Warningf("Shutdown did not complete cleanly: %v", err)
+		}
+	}()
+}
+
+// Shutdown stops the server gracefully. New connections are refused, commands that
+// are running are allowed to finish, and idle clients receive ER_SERVER_SHUTDOWN
+// before being disconnected. If ctx is done before all connections have ended,
+// the remaining ones are closed as Close() does and ctx.Err() is returned.
+func (this *Server) Shutdown(ctx context.Context) error {
+	this.stopAccepting()
+
+	this.drainOnce.Do(func() {
+		close(this.draining)
+	})
+
+	// No new connections can be added once the accept loops are gone
+	this.acceptWg.Wait()
+
+	done := make(chan bool)
+	go func() {
+		this.connsWg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		// Connections blocked waiting for their next command are woken up so they
+		// can see the server is shutting down. Keep doing it, since busy ones only
+		// become idle once their command is done.
+		this.conns.each(func(c *connection) {
+			c.interruptIfIdle()
+		})
+
+		select {
+		case <-done:
+			glog.V(3).Info("All connections drained")
+			return nil
+
+		case <-ctx.Done():
+			glog.V(3).Info("Shutdown deadline reached, closing remaining connections")
+			this.Close()
+			<-done
+			return ctx.Err()
+
+		case <-ticker.C:
+		}
 	}
 }
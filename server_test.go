@@ -7,44 +7,72 @@
 package qld
 
 import (
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/binary"
+	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/golang/glog"
+	"github.com/reducedb/qld/trace"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
-func TestClient(t *testing.T) {
+// startTestServer runs a server in the background on a free port of 127.0.0.1
+// unless cfg says otherwise. Calling the returned function stops it and waits for
+// it to exit.
+func startTestServer(t *testing.T, cfg *Config) (*Server, func()) {
 	var wg sync.WaitGroup
-	quitChan := make(chan bool)
 
-	s, err := newServer(nil)
+	if cfg == nil {
+		cfg, _ = NewConfig()
+		cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	}
+
+	s, err := NewServer(cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		<-quitChan
-		glog.V(3).Info("Received quit signal")
-		s.quit()
-	}()
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		if err := s.run(); err != nil {
-			t.Fatal(err)
+		if err := s.Serve(); err != nil {
+			t.Error(err)
 		}
 		glog.V(3).Info("Server exited")
 	}()
 
-	time.Sleep(time.Second)
+	return s, func() {
+		glog.V(3).Info("Sending quit signal")
+		s.Close()
+		wg.Wait()
+	}
+}
+
+// testDSN returns the DSN for connecting to the first listener of s
+func testDSN(s *Server, user, params string) string {
+	addr := s.Addrs()[0]
+	return fmt.Sprintf("%s:testpass@%s(%s)/testdb%s", user, addr.Network(), addr, params)
+}
+
+func TestClient(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
 
-	db, err := sql.Open("mysql", "testuser:testpass@tcp(127.0.0.1:3306)/testdb")
+	db, err := sql.Open("mysql", testDSN(s, "testuser", ""))
 	if err != nil {
 		t.Error(err.Error())
 	} else {
@@ -55,7 +83,404 @@ func TestClient(t *testing.T) {
 			t.Error(err.Error()) // proper error handling instead of panic in your app
 		}
 	}
-	close(quitChan)
+}
+
+func TestGreeting(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	c := dialRaw(t, s, "testuser")
+	defer c.Close()
+
+	if caps := c.serverCapabilities(); caps&clientProtocol41 == 0 || caps&clientSessionTrack == 0 {
+		t.Errorf("Expecting CLIENT_PROTOCOL_41 and CLIENT_SESSION_TRACK, got %032b", caps)
+	}
+	if status := serverStatusFlag(binary.LittleEndian.Uint16(c.greeting[23:])); status != serverStatusAutocommit {
+		t.Errorf("Expecting SERVER_STATUS_AUTOCOMMIT, got %b", status)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
 
-	wg.Wait()
+	db, err := sql.Open("mysql", testDSN(s, "testuser", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET SESSION wait_timeout = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.ExecContext(ctx, "SET SESSION connect_timeout = 5"); err == nil {
+		t.Error("connect_timeout should only be settable globally")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	// The server should have dropped the idle connection by now
+	if _, err := conn.ExecContext(ctx, "SET @@session.net_read_timeout = 10"); err == nil {
+		t.Error("Expecting idle connection to be closed")
+	}
+}
+
+func TestInteractiveTimeout(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.InteractiveTimeout = 100
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	c, p := dialRawWith(t, s, rawLogin{user: "testuser", caps: clientInteractive})
+	if p[0] != okPacket {
+		t.Fatalf("Handshake failed: %q", p)
+	}
+	defer c.Close()
+
+	// Interactive clients start with wait_timeout set to interactive_timeout, and
+	// can change it like any other
+	if rows, err := c.query("SHOW VARIABLES LIKE 'wait_timeout'"); err != nil || len(rows) != 1 || rows[0][1] != "100" {
+		t.Errorf("Expecting wait_timeout 100, got %q, %v", rows, err)
+	}
+
+	if p, err := c.command(comComQuery, []byte("SET SESSION wait_timeout = 1")); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	// The server says why before closing the connection
+	if p, err := c.readPacket(); err != nil || errCode(p) != 4031 {
+		t.Errorf("Expecting ER_CLIENT_INTERACTION_TIMEOUT, got %q, %v", p, err)
+	}
+}
+
+func TestTraceRestart(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.TraceDir = t.TempDir()
+
+	// The first connection of each server has the same id
+	for i := 0; i < 2; i++ {
+		s, stop := startTestServer(t, cfg)
+		c := dialRaw(t, s, "testuser")
+		c.Close()
+		stop()
+	}
+
+	files, err := filepath.Glob(filepath.Join(cfg.TraceDir, "qld-1-*.trace"))
+	if err != nil || len(files) != 2 {
+		t.Errorf("Expecting 2 capture files, got %v, %v", files, err)
+	}
+}
+
+func TestTraceCapture(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.TraceDir = t.TempDir()
+
+	s, stop := startTestServer(t, cfg)
+
+	db, err := sql.Open("mysql", testDSN(s, "testuser", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SET @x = 1"); err != nil {
+		t.Error(err)
+	}
+	db.Close()
+	stop()
+
+	files, err := filepath.Glob(filepath.Join(cfg.TraceDir, "*.trace"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expecting 1 capture file, got %v, %v", files, err)
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := trace.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for {
+		pkt, err := r.Next()
+		if err != nil {
+			break
+		}
+		if pkt.Direction == trace.ClientToServer && string(pkt.Payload) == "\x03SET @x = 1" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("Query not found in capture")
+	}
+}
+
+// rawClient speaks just enough of the protocol to send commands that
+// database/sql has no way of sending
+type rawClient struct {
+	net.Conn
+	seq      byte
+	greeting []byte
+}
+
+func dialRaw(t *testing.T, s *Server, user string) *rawClient {
+	c, p := dialRawWith(t, s, rawLogin{user: user})
+	if p[0] != okPacket {
+		t.Fatalf("Handshake failed: %q", p)
+	}
+	return c
+}
+
+type rawLogin struct {
+	user     string
+	password string
+	schema   string
+
+	// Added to the capabilities the client always sends. Like real clients, it
+	// only keeps the ones the server has.
+	caps clientFlag
+
+	// The auth plugin the client says it used, mysql_native_password if not set
+	plugin string
+
+	// The listener to connect to, the first one if not set
+	addr net.Addr
+
+	// Sent before the handshake, such as a PROXY protocol header
+	preamble []byte
+}
+
+// dialRawWith connects and logs in, returning the server's reply to the handshake
+// response
+func dialRawWith(t *testing.T, s *Server, login rawLogin) (*rawClient, []byte) {
+	addr := login.addr
+	if addr == nil {
+		addr = s.Addrs()[0]
+	}
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write(login.preamble); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &rawClient{Conn: conn}
+	if c.greeting, err = c.readPacket(); err != nil {
+		t.Fatal(err)
+	} else if c.greeting[0] == errPacket {
+		// Turned away before the handshake
+		return c, c.greeting
+	}
+
+	caps := clientProtocol41 | clientSecureConnection | clientTransactions | login.caps
+	if login.schema != "" {
+		caps |= clientConnectWithDB
+	}
+	caps &= c.serverCapabilities()
+
+	// HandshakeResponse41
+	resp := make([]byte, 4, 64)
+	binary.LittleEndian.PutUint32(resp, uint32(caps))
+	resp = append(resp, 0, 0, 0, 1, collationUtf8General)
+	resp = append(resp, make([]byte, 23)...)
+	resp = append(resp, login.user...)
+	resp = append(resp, 0)
+
+	if login.password == "" {
+		resp = append(resp, 0)
+	} else {
+		// The challenge is split in two parts around the capability flags and
+		// reserved bytes
+		challenge := append(append([]byte(nil), c.greeting[11:19]...), c.greeting[38:50]...)
+		resp = append(resp, sha1.Size)
+		resp = append(resp, scramble(challenge, login.password)...)
+	}
+
+	if login.schema != "" {
+		resp = append(resp, login.schema...)
+		resp = append(resp, 0)
+	}
+
+	if caps&clientPluginAuth != 0 {
+		plugin := login.plugin
+		if plugin == "" {
+			plugin = nativePasswordPlugin
+		}
+		resp = append(resp, plugin...)
+		resp = append(resp, 0)
+	}
+
+	if err := c.writePacket(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := c.readPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, p
+}
+
+// serverCapabilities returns the capability flags of the greeting, which are split
+// in two around the character set and status flags
+func (this *rawClient) serverCapabilities() clientFlag {
+	return clientFlag(binary.LittleEndian.Uint16(this.greeting[20:])) | clientFlag(binary.LittleEndian.Uint16(this.greeting[25:]))<<16
+}
+
+// scramble computes the mysql_native_password auth response
+func scramble(challenge []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+
+	h := sha1.New()
+	h.Write(challenge)
+	h.Write(stage2[:])
+	resp := h.Sum(nil)
+
+	for i := range resp {
+		resp[i] ^= stage1[i]
+	}
+	return resp
+}
+
+func (this *rawClient) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(this, header[:]); err != nil {
+		return nil, err
+	}
+
+	p := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(this, p); err != nil {
+		return nil, err
+	}
+
+	this.seq = header[3] + 1
+	return p, nil
+}
+
+func (this *rawClient) writePacket(p []byte) error {
+	_, err := this.Write(append([]byte{byte(len(p)), byte(len(p) >> 8), byte(len(p) >> 16), this.seq}, p...))
+	this.seq++
+	return err
+}
+
+// command sends a command and returns the first packet of the response
+func (this *rawClient) command(cmd serverCommand, args []byte) ([]byte, error) {
+	this.seq = 0
+	if err := this.writePacket(append([]byte{byte(cmd)}, args...)); err != nil {
+		return nil, err
+	}
+	return this.readPacket()
+}
+
+// errCode returns the error code of an ERR packet, or 0 for any other packet
+func errCode(p []byte) int {
+	if len(p) < 3 || p[0] != errPacket {
+		return 0
+	}
+	return int(p[1]) | int(p[2])<<8
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	idle := dialRaw(t, s, "idle")
+	defer idle.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+
+	// The idle client is told about the shutdown without sending anything
+	if p, err := idle.readPacket(); err != nil {
+		t.Fatal(err)
+	} else if errCode(p) != 1053 {
+		t.Errorf("Expecting ER_SERVER_SHUTDOWN, got %q", p)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Expecting clean shutdown, got %v", err)
+	}
+
+	if _, err := net.Dial("tcp", s.Addrs()[0].String()); err == nil {
+		t.Error("Expecting new connections to be refused")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	// A client stuck in the middle of the handshake never becomes idle
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expecting context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestPingAndStatistics(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	c := dialRaw(t, s, "stats")
+	defer c.Close()
+
+	if p, err := c.command(comPing, nil); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK for COM_PING, got %q, %v", p, err)
+	}
+
+	if _, err := c.command(comComQuery, []byte("SET @a = 1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.query("SELECT ID FROM information_schema.processlist"); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := c.command(comStatistics, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := string(p)
+	for _, s := range []string{"Uptime: ", "Threads: 1  ", "Questions: 2  ", "Slow queries: 0  ", "Opens: 1  ", "Queries per second avg: "} {
+		if !strings.Contains(stats, s) {
+			t.Errorf("Expecting %q in %q", s, stats)
+		}
+	}
 }
@@ -0,0 +1,35 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"github.com/golang/glog"
+)
+
+// execShutdown starts a graceful shutdown of the server, for SHUTDOWN and
+// COM_SHUTDOWN. The client gets its response before the server tells every
+// connection, including this one, that it is going away.
+// http://dev.mysql.com/doc/refman/5.7/en/shutdown.html
+func (this *connection) execShutdown() error {
+	if err := this.checkPrivilege(privShutdown, "SHUTDOWN"); err != nil {
+		return err
+	}
+
+	glog.Infof("Connection #%d: Shutdown requested by %s", this.id, this.account)
+	this.srv.requestShutdown()
+	return nil
+}
+
+// handleShutdown answers COM_SHUTDOWN, as sent by mysqladmin shutdown. The shutdown
+// type in the payload makes no difference.
+// http://dev.mysql.com/doc/internals/en/com-shutdown.html
+func (this *connection) handleShutdown() error {
+	if err := this.execShutdown(); err != nil {
+		return err
+	}
+	return this.writeEOFPacket()
+}
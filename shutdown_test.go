@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitRefused waits for the server to stop accepting connections
+func waitRefused(t *testing.T, s *Server) {
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", s.Addrs()[0].String())
+		if err != nil {
+			return
+		}
+		conn.Close()
+
+		if i == 50 {
+			t.Fatal("Expecting new connections to be refused")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestShutdownCommand(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.Accounts = []AccountConfig{
+		{User: "u", Password: "p"},
+		{User: "admin", Password: "p", Privileges: []string{"SHUTDOWN"}},
+	}
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	login := func(user string) *rawClient {
+		c, p := dialRawWith(t, s, rawLogin{user: user, password: "p"})
+		if p[0] != okPacket {
+			t.Fatalf("Handshake failed: %q", p)
+		}
+		return c
+	}
+
+	u := login("u")
+	defer u.Close()
+	admin := login("admin")
+	defer admin.Close()
+
+	if p, err := u.command(comShutdown, []byte{0}); err != nil || errCode(p) != 1227 {
+		t.Fatalf("Expecting ER_SPECIFIC_ACCESS_DENIED_ERROR, got %q, %v", p, err)
+	}
+
+	if p, err := admin.command(comShutdown, []byte{0}); err != nil || p[0] != eofPacket {
+		t.Fatalf("Expecting EOF, got %q, %v", p, err)
+	}
+
+	// Other clients are told the server is going away
+	if p, err := u.readPacket(); err != nil || errCode(p) != 1053 {
+		t.Errorf("Expecting ER_SERVER_SHUTDOWN, got %q, %v", p, err)
+	}
+
+	waitRefused(t, s)
+}
+
+func TestShutdownStatement(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	if err := execOnce(fmt.Sprintf("root@tcp(%s)/", s.Addrs()[0]), "SHUTDOWN"); err != nil {
+		t.Fatalf("Expecting OK, got %v", err)
+	}
+
+	waitRefused(t, s)
+}
+
+func TestShutdownPing(t *testing.T) {
+	s, stop := startTestServer(t, nil)
+	defer stop()
+
+	c := dialRaw(t, s, "root")
+	defer c.Close()
+
+	// The ping is sent along with the shutdown, so it's already waiting once the
+	// shutdown has started
+	c.seq = 0
+	c.writePacket([]byte{byte(comShutdown), 0})
+	c.seq = 0
+	c.writePacket([]byte{byte(comPing)})
+
+	if p, err := c.readPacket(); err != nil || p[0] != eofPacket {
+		t.Fatalf("Expecting EOF, got %q, %v", p, err)
+	}
+	if p, err := c.readPacket(); err != nil || p[0] != okPacket {
+		t.Fatalf("Expecting OK, got %q, %v", p, err)
+	}
+
+	// Pings keep working until the connection is closed, other commands don't
+	if p, err := c.command(comPing, nil); err != nil || p[0] != okPacket {
+		t.Errorf("Expecting OK, got %q, %v", p, err)
+	}
+	if p, err := c.command(comComQuery, []byte("SET @a = 1")); err != nil || errCode(p) != 1053 {
+		t.Errorf("Expecting ER_SERVER_SHUTDOWN, got %q, %v", p, err)
+	}
+
+	waitRefused(t, s)
+}
@@ -0,0 +1,1017 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This is not a SQL parser. It only recognizes the handful of statements that the
+// server itself has to act on, such as SET for session variables. Anything else is
+// reported as not being a server statement.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+}
+
+func tokenize(q string) ([]token, error) {
+	var toks []token
+
+	for i := 0; i < len(q); {
+		c := q[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+
+		case c == '#' || (c == '-' && strings.HasPrefix(q[i:], "-- ")):
+			for i < len(q) && q[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += end + 4
+
+		case isIdentChar(c) && !isDigit(c):
+			j := i
+			for j < len(q) && isIdentChar(q[j]) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, q[i:j]})
+			i = j
+
+		case isDigit(c):
+			j := i
+			for j < len(q) && (isDigit(q[j]) || q[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{tokNumber, q[i:j]})
+			i = j
+
+		case c == '`':
+			j := strings.IndexByte(q[i+1:], '`')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated quoted identifier")
+			}
+			toks = append(toks, token{tokIdent, q[i+1 : i+1+j]})
+			i += j + 2
+
+		case c == '\'' || c == '"':
+			var s []byte
+			j := i + 1
+			for ; j < len(q) && q[j] != c; j++ {
+				if q[j] == '\\' && j+1 < len(q) {
+					j++
+				}
+				s = append(s, q[j])
+			}
+			if j >= len(q) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, token{tokString, string(s)})
+			i = j + 1
+
+		case c == '@' && strings.HasPrefix(q[i:], "@@"):
+			toks = append(toks, token{tokPunct, "@@"})
+			i += 2
+
+		default:
+			toks = append(toks, token{tokPunct, string(c)})
+			i++
+		}
+	}
+
+	return toks, nil
+}
+
+// splitStatements splits q at the semicolons that end statements, leaving out empty
+// statements. Semicolons in strings, quoted identifiers and comments don't count,
+// and neither do those inside the BEGIN ... END body of a stored program. If q can't
+// be tokenized, it is returned as is for the parser to report the error.
+// http://dev.mysql.com/doc/refman/5.7/en/sql-syntax-compound-statements.html
+func splitStatements(q string) []string {
+	var stmts []string
+
+	// A CREATE statement is looked at until its first parenthesis for whether it
+	// creates a stored program. If it does, depth counts the BEGIN and CASE that
+	// still need their END.
+	var create, program bool
+	var words, depth int
+	var prev string
+
+	add := func(stmt string) {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		create, program, words, depth, prev = false, false, 0, 0, ""
+	}
+
+	start := 0
+	for i := 0; i < len(q); {
+		c := q[i]
+
+		switch {
+		case c == ';' && depth == 0:
+			add(q[start:i])
+			i++
+			start = i
+
+		case isIdentChar(c) && !isDigit(c):
+			j := i
+			for j < len(q) && isIdentChar(q[j]) {
+				j++
+			}
+			word := strings.ToUpper(q[i:j])
+			i = j
+
+			switch {
+			case words == 0:
+				create = word == "CREATE"
+			case create && !program:
+				program = word == "PROCEDURE" || word == "FUNCTION" || word == "TRIGGER" || word == "EVENT"
+				create = !program
+			case !program:
+			case word == "BEGIN" || (word == "CASE" && prev != "END"):
+				depth++
+			case word == "END" && depth > 0:
+				depth--
+			case prev == "END" && (word == "IF" || word == "LOOP" || word == "WHILE" || word == "REPEAT"):
+				// The blocks that END IF and the like close weren't counted
+				depth++
+			}
+			prev = word
+			words++
+
+		case c == '#' || (c == '-' && strings.HasPrefix(q[i:], "-- ")):
+			for i < len(q) && q[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				return []string{q}
+			}
+			i += end + 4
+
+		case c == '`' || c == '\'' || c == '"':
+			j := i + 1
+			for ; j < len(q) && q[j] != c; j++ {
+				if q[j] == '\\' && c != '`' {
+					j++
+				}
+			}
+			if j >= len(q) {
+				return []string{q}
+			}
+			i = j + 1
+
+		default:
+			if c == '(' {
+				create = false
+			}
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				prev = ""
+			}
+			i++
+		}
+	}
+	add(q[start:])
+
+	return stmts
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (this *parser) peek() token {
+	if this.pos >= len(this.toks) {
+		return token{kind: tokEOF}
+	}
+	return this.toks[this.pos]
+}
+
+func (this *parser) next() token {
+	t := this.peek()
+	if t.kind != tokEOF {
+		this.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the keyword or punctuation kw
+func (this *parser) accept(kw string) bool {
+	t := this.peek()
+	if (t.kind == tokIdent || t.kind == tokPunct) && strings.EqualFold(t.val, kw) {
+		this.pos++
+		return true
+	}
+	return false
+}
+
+func (this *parser) expect(kw string) error {
+	if !this.accept(kw) {
+		return this.errorf("expecting %s", kw)
+	}
+	return nil
+}
+
+func (this *parser) ident() (string, error) {
+	if t := this.next(); t.kind == tokIdent {
+		return t.val, nil
+	}
+	return "", this.errorf("expecting identifier")
+}
+
+// end succeeds if the whole statement has been consumed, ignoring a trailing ';'
+func (this *parser) end() error {
+	this.accept(";")
+	if this.peek().kind != tokEOF {
+		return this.errorf("unexpected input")
+	}
+	return nil
+}
+
+func (this *parser) errorf(format string, args ...interface{}) error {
+	near := ""
+	for _, t := range this.toks[minInt(this.pos, len(this.toks)):] {
+		near += t.val + " "
+	}
+
+	return newSQLError(1064, "You have an error in your SQL syntax (%s) near '%s'", fmt.Sprintf(format, args...), strings.TrimSpace(near))
+}
+
+type setValueKind int
+
+const (
+	valueNumber setValueKind = iota
+	valueString
+	valueDefault
+	valueNull
+
+	// Another variable, whose value is looked up when the statement runs
+	valueVariable
+)
+
+type setValue struct {
+	kind setValueKind
+	num  uint64
+	str  string
+	ref  varRef
+}
+
+// A variable read in a statement: @name, @@name, @@GLOBAL.name or @@SESSION.name
+type varRef struct {
+	// Whether it's a system variable, and its scope if one was given. @@name is the
+	// session value, or the global one for global variables.
+	sys   bool
+	scope varScope
+
+	// Lower case, and as written for column names
+	name string
+	text string
+}
+
+type setAssignment struct {
+	// Zero for user variables (@name). Otherwise the explicit or implied scope.
+	scope varScope
+	name  string
+	value setValue
+}
+
+// SET [GLOBAL | SESSION | LOCAL] var = value [, ...]
+type setStmt struct {
+	assigns []setAssignment
+}
+
+// SHOW [GLOBAL | SESSION | LOCAL] {STATUS | VARIABLES} [LIKE 'pattern']
+// SHOW [FULL] PROCESSLIST
+// SHOW MASTER STATUS
+// SHOW SLAVE HOSTS
+// SHOW {BINARY | MASTER} LOGS
+type showStmt struct {
+	object string
+	scope  varScope
+	full   bool
+
+	like    string
+	hasLike bool
+}
+
+// SHOW BINLOG EVENTS [IN 'log_name'] [FROM pos] [LIMIT [offset,] row_count]
+// http://dev.mysql.com/doc/refman/5.7/en/show-binlog-events.html
+type binlogEventsStmt struct {
+	// The first file if not set
+	log string
+	pos uint64
+
+	offset   uint64
+	limit    uint64
+	hasLimit bool
+}
+
+// FLUSH [NO_WRITE_TO_BINLOG | LOCAL] option [, option] ...
+// Options made of several words, such as USER_RESOURCES or BINARY LOGS, are kept
+// as one upper case string with single spaces.
+type flushStmt struct {
+	options []string
+}
+
+// SELECT var [, var] ...
+// Where each var is a user or system variable, as in varRef.
+type selectVarsStmt struct {
+	vars []varRef
+}
+
+// SELECT {* | column [, column] ...} FROM schema.table
+// Only for the tables the server provides itself, such as
+// performance_schema.host_cache.
+type selectStmt struct {
+	// nil for *
+	columns []string
+	schema  string
+	table   string
+}
+
+// CREATE USER [IF NOT EXISTS] user [auth] [, user [auth]] ... [WITH resource ...]
+// ALTER USER [IF EXISTS] user [auth] [, user [auth]] ... [WITH resource ...]
+// http://dev.mysql.com/doc/refman/5.7/en/create-user.html
+type userStmt struct {
+	alter bool
+
+	// IF NOT EXISTS for CREATE USER, IF EXISTS for ALTER USER
+	ifExists bool
+
+	users []userSpec
+
+	// Resource limits from the WITH clause, such as MAX_QUERIES_PER_HOUR, by upper
+	// case name
+	resources map[string]uint64
+}
+
+type userSpec struct {
+	user string
+	host string
+
+	// Set if there is an IDENTIFIED clause. Either password holds the password in
+	// clear text, or hash the value given with AS.
+	identified bool
+	plugin     string
+	password   string
+	hash       string
+}
+
+// BEGIN [WORK], START TRANSACTION [...], COMMIT [WORK], ROLLBACK [WORK]
+// Only tracked so the session knows whether a transaction is open.
+type txnStmt struct {
+	begin bool
+}
+
+// USE db
+type useStmt struct {
+	db string
+}
+
+// SHUTDOWN
+type shutdownStmt struct{}
+
+// KILL [CONNECTION | QUERY] processlist_id
+type killStmt struct {
+	id    uint32
+	query bool
+}
+
+// parseStatement returns the server statement in q, or nil if q is not one the server
+// handles itself.
+func parseStatement(q string) (interface{}, error) {
+	toks, err := tokenize(q)
+	if err != nil {
+		return nil, newSQLError(1064, "You have an error in your SQL syntax: %s", err.Error())
+	}
+
+	if len(toks) == 0 {
+		return nil, SQLErrors[1065]
+	}
+
+	p := &parser{toks: toks}
+
+	switch {
+	case p.accept("SET"):
+		return p.parseSet()
+	case p.accept("SHOW"):
+		return p.parseShow()
+	case p.accept("FLUSH"):
+		return p.parseFlush()
+	case p.accept("SELECT"):
+		return p.parseSelect()
+	case p.accept("USE"):
+		db, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		return &useStmt{db: db}, p.end()
+	case p.accept("SHUTDOWN"):
+		return &shutdownStmt{}, p.end()
+	case p.accept("KILL"):
+		return p.parseKill()
+	case p.accept("BEGIN"):
+		p.accept("WORK")
+		return &txnStmt{begin: true}, p.end()
+	case p.accept("START"):
+		if p.accept("TRANSACTION") {
+			// Characteristics such as READ ONLY don't matter here
+			return &txnStmt{begin: true}, nil
+		}
+	case p.accept("COMMIT"), p.accept("ROLLBACK"):
+		p.accept("WORK")
+		if p.peek().kind == tokIdent {
+			// ROLLBACK TO SAVEPOINT, or AND CHAIN and RELEASE which keep or end the
+			// session
+			return nil, nil
+		}
+		return &txnStmt{}, p.end()
+	case p.accept("CREATE"):
+		if p.accept("USER") {
+			return p.parseUser(false)
+		}
+	case p.accept("ALTER"):
+		if p.accept("USER") {
+			return p.parseUser(true)
+		}
+	}
+
+	return nil, nil
+}
+
+func (this *parser) parseSet() (*setStmt, error) {
+	stmt := &setStmt{}
+	scope := scopeSession
+
+	for {
+		a := setAssignment{scope: scope}
+
+		switch {
+		case this.accept("GLOBAL"):
+			a.scope = scopeGlobal
+		case this.accept("SESSION"), this.accept("LOCAL"):
+			a.scope = scopeSession
+
+		case this.accept("@@"):
+			// @@var is the session variable, @@global.var or @@session.var are explicit
+			var err error
+			if a.scope, err = this.sysVarScope(); err != nil {
+				return nil, err
+			} else if a.scope == 0 {
+				a.scope = scopeSession
+			}
+
+		case this.accept("@"):
+			a.scope = 0
+		}
+
+		// The first GLOBAL or SESSION keyword applies to the rest of the list
+		if len(stmt.assigns) == 0 && a.scope != 0 {
+			scope = a.scope
+		}
+
+		name, err := this.ident()
+		if err != nil {
+			return nil, err
+		}
+		a.name = strings.ToLower(name)
+
+		if !this.accept("=") {
+			if err := this.expect(":"); err != nil {
+				return nil, err
+			}
+			if err := this.expect("="); err != nil {
+				return nil, err
+			}
+		}
+
+		if a.value, err = this.parseSetValue(); err != nil {
+			return nil, err
+		}
+
+		stmt.assigns = append(stmt.assigns, a)
+
+		if !this.accept(",") {
+			break
+		}
+	}
+
+	return stmt, this.end()
+}
+
+// sysVarScope reads the GLOBAL. or SESSION. that may follow @@, and returns 0 if
+// there is none
+func (this *parser) sysVarScope() (varScope, error) {
+	t := this.peek()
+	if t.kind != tokIdent || this.pos+1 >= len(this.toks) || this.toks[this.pos+1].val != "." {
+		return 0, nil
+	}
+
+	var scope varScope
+	switch strings.ToLower(t.val) {
+	case "global":
+		scope = scopeGlobal
+	case "session", "local":
+		scope = scopeSession
+	default:
+		return 0, this.errorf("unknown variable scope %s", t.val)
+	}
+	this.pos += 2
+
+	return scope, nil
+}
+
+// parseVarRef reads a variable after its @ or @@
+func (this *parser) parseVarRef(sys bool) (varRef, error) {
+	ref := varRef{sys: sys}
+	start := this.pos - 1
+
+	if sys {
+		var err error
+		if ref.scope, err = this.sysVarScope(); err != nil {
+			return ref, err
+		}
+	}
+
+	name, err := this.ident()
+	if err != nil {
+		return ref, err
+	}
+	ref.name = strings.ToLower(name)
+
+	for _, t := range this.toks[start:this.pos] {
+		ref.text += t.val
+	}
+
+	return ref, nil
+}
+
+func (this *parser) parseSetValue() (setValue, error) {
+	t := this.next()
+
+	switch t.kind {
+	case tokPunct:
+		if t.val == "@" || t.val == "@@" {
+			ref, err := this.parseVarRef(t.val == "@@")
+			if err != nil {
+				return setValue{}, err
+			}
+			return setValue{kind: valueVariable, ref: ref}, nil
+		}
+
+	case tokNumber:
+		n, err := strconv.ParseUint(t.val, 10, 64)
+		if err != nil {
+			return setValue{}, newSQLError(1232, "Incorrect argument type to variable: %s", t.val)
+		}
+		return setValue{kind: valueNumber, num: n, str: t.val}, nil
+
+	case tokString:
+		return setValue{kind: valueString, str: t.val}, nil
+
+	case tokIdent:
+		if strings.EqualFold(t.val, "DEFAULT") {
+			return setValue{kind: valueDefault}, nil
+		}
+
+		switch strings.ToUpper(t.val) {
+		case "ON", "TRUE":
+			return setValue{kind: valueNumber, num: 1, str: t.val}, nil
+		case "OFF", "FALSE":
+			return setValue{kind: valueNumber, num: 0, str: t.val}, nil
+		}
+
+		return setValue{kind: valueString, str: t.val}, nil
+	}
+
+	if t.kind != tokEOF {
+		this.pos--
+	}
+	return setValue{}, this.errorf("expecting value")
+}
+
+func (this *parser) parseShow() (interface{}, error) {
+	stmt := &showStmt{scope: scopeSession}
+
+	if this.accept("FULL") {
+		if !this.accept("PROCESSLIST") {
+			// SHOW FULL COLUMNS, TABLES and so on
+			return nil, nil
+		}
+		stmt.object, stmt.full = "PROCESSLIST", true
+		return stmt, this.end()
+	}
+
+	switch {
+	case this.accept("GLOBAL"):
+		stmt.scope = scopeGlobal
+	case this.accept("SESSION"), this.accept("LOCAL"):
+	}
+
+	switch {
+	case this.accept("STATUS"):
+		stmt.object = "STATUS"
+	case this.accept("VARIABLES"):
+		stmt.object = "VARIABLES"
+	case this.accept("PROCESSLIST"):
+		stmt.object = "PROCESSLIST"
+		return stmt, this.end()
+	case this.accept("MASTER"):
+		switch {
+		case this.accept("STATUS"):
+			stmt.object = "MASTER STATUS"
+		case this.accept("LOGS"):
+			stmt.object = "BINARY LOGS"
+		default:
+			return nil, nil
+		}
+		return stmt, this.end()
+	case this.accept("BINARY"):
+		if err := this.expect("LOGS"); err != nil {
+			return nil, err
+		}
+		stmt.object = "BINARY LOGS"
+		return stmt, this.end()
+	case this.accept("BINLOG"):
+		events, err := this.parseBinlogEvents()
+		if err != nil {
+			return nil, err
+		}
+		return events, nil
+	case this.accept("SLAVE"):
+		if !this.accept("HOSTS") {
+			// SHOW SLAVE STATUS
+			return nil, nil
+		}
+		stmt.object = "SLAVE HOSTS"
+		return stmt, this.end()
+	default:
+		// Some other SHOW, not for the server to answer
+		return nil, nil
+	}
+
+	if this.accept("LIKE") {
+		t := this.next()
+		if t.kind != tokString {
+			if t.kind != tokEOF {
+				this.pos--
+			}
+			return nil, this.errorf("expecting pattern")
+		}
+		stmt.like, stmt.hasLike = t.val, true
+	}
+
+	return stmt, this.end()
+}
+
+func (this *parser) parseBinlogEvents() (*binlogEventsStmt, error) {
+	stmt := &binlogEventsStmt{}
+
+	if err := this.expect("EVENTS"); err != nil {
+		return nil, err
+	}
+
+	if this.accept("IN") {
+		t := this.next()
+		if t.kind != tokString {
+			if t.kind != tokEOF {
+				this.pos--
+			}
+			return nil, this.errorf("expecting log name")
+		}
+		stmt.log = t.val
+	}
+
+	var err error
+	if this.accept("FROM") {
+		if stmt.pos, err = this.number("position"); err != nil {
+			return nil, err
+		}
+	}
+
+	if this.accept("LIMIT") {
+		if stmt.limit, err = this.number("row count"); err != nil {
+			return nil, err
+		}
+		if this.accept(",") {
+			stmt.offset = stmt.limit
+			if stmt.limit, err = this.number("row count"); err != nil {
+				return nil, err
+			}
+		}
+		stmt.hasLimit = true
+	}
+
+	return stmt, this.end()
+}
+
+// number reads an unsigned integer, what it is being used in error messages
+func (this *parser) number(what string) (uint64, error) {
+	t := this.next()
+	n, err := strconv.ParseUint(t.val, 10, 64)
+	if t.kind != tokNumber || err != nil {
+		if t.kind != tokEOF {
+			this.pos--
+		}
+		return 0, this.errorf("expecting %s", what)
+	}
+	return n, nil
+}
+
+func (this *parser) parseKill() (*killStmt, error) {
+	stmt := &killStmt{}
+
+	if !this.accept("CONNECTION") {
+		stmt.query = this.accept("QUERY")
+	}
+
+	t := this.next()
+	id, err := strconv.ParseUint(t.val, 10, 32)
+	if t.kind != tokNumber || err != nil {
+		if t.kind != tokEOF {
+			this.pos--
+		}
+		return nil, this.errorf("expecting thread id")
+	}
+	stmt.id = uint32(id)
+
+	return stmt, this.end()
+}
+
+func (this *parser) parseFlush() (*flushStmt, error) {
+	stmt := &flushStmt{}
+
+	if !this.accept("NO_WRITE_TO_BINLOG") {
+		this.accept("LOCAL")
+	}
+
+	for {
+		var words []string
+		for this.peek().kind == tokIdent {
+			words = append(words, strings.ToUpper(this.next().val))
+		}
+
+		if len(words) == 0 {
+			return nil, this.errorf("expecting flush option")
+		}
+		stmt.options = append(stmt.options, strings.Join(words, " "))
+
+		if !this.accept(",") {
+			break
+		}
+	}
+
+	return stmt, this.end()
+}
+
+// parseSelect only recognizes the simple form of selectStmt. Any other SELECT is
+// not a server statement, so it is never a syntax error here.
+func (this *parser) parseSelect() (interface{}, error) {
+	if t := this.peek(); t.kind == tokPunct && (t.val == "@" || t.val == "@@") {
+		return this.parseSelectVars()
+	}
+
+	stmt := &selectStmt{}
+
+	if !this.accept("*") {
+		for {
+			t := this.next()
+			if t.kind != tokIdent {
+				return nil, nil
+			}
+			stmt.columns = append(stmt.columns, t.val)
+
+			if !this.accept(",") {
+				break
+			}
+		}
+	}
+
+	if !this.accept("FROM") {
+		return nil, nil
+	}
+
+	t := this.next()
+	if t.kind != tokIdent || !this.accept(".") {
+		return nil, nil
+	}
+	stmt.schema = t.val
+
+	if t = this.next(); t.kind != tokIdent {
+		return nil, nil
+	}
+	stmt.table = t.val
+
+	this.accept(";")
+	if this.peek().kind != tokEOF {
+		return nil, nil
+	}
+
+	return stmt, nil
+}
+
+// parseSelectVars recognizes selectVarsStmt, as replicas use to find out about the
+// server. Anything more to the SELECT makes it not a server statement.
+func (this *parser) parseSelectVars() (interface{}, error) {
+	stmt := &selectVarsStmt{}
+
+	for {
+		t := this.next()
+		if t.kind != tokPunct || (t.val != "@" && t.val != "@@") {
+			return nil, nil
+		}
+
+		ref, err := this.parseVarRef(t.val == "@@")
+		if err != nil {
+			return nil, nil
+		}
+		stmt.vars = append(stmt.vars, ref)
+
+		if !this.accept(",") {
+			break
+		}
+	}
+
+	this.accept(";")
+	if this.peek().kind != tokEOF {
+		return nil, nil
+	}
+
+	return stmt, nil
+}
+
+var userResourceOptions map[string]bool = map[string]bool{
+	"MAX_QUERIES_PER_HOUR":     true,
+	"MAX_UPDATES_PER_HOUR":     true,
+	"MAX_CONNECTIONS_PER_HOUR": true,
+	"MAX_USER_CONNECTIONS":     true,
+}
+
+func (this *parser) parseUser(alter bool) (*userStmt, error) {
+	stmt := &userStmt{alter: alter}
+
+	if this.accept("IF") {
+		if !alter {
+			if err := this.expect("NOT"); err != nil {
+				return nil, err
+			}
+		}
+		if err := this.expect("EXISTS"); err != nil {
+			return nil, err
+		}
+		stmt.ifExists = true
+	}
+
+	for {
+		spec, err := this.parseUserSpec()
+		if err != nil {
+			return nil, err
+		}
+		stmt.users = append(stmt.users, spec)
+
+		if !this.accept(",") {
+			break
+		}
+	}
+
+	if this.accept("WITH") {
+		stmt.resources = make(map[string]uint64)
+
+		for this.peek().kind == tokIdent {
+			name := strings.ToUpper(this.next().val)
+			if !userResourceOptions[name] {
+				this.pos--
+				return nil, this.errorf("unknown resource option %s", name)
+			}
+
+			t := this.next()
+			n, err := strconv.ParseUint(t.val, 10, 64)
+			if t.kind != tokNumber || err != nil {
+				return nil, this.errorf("expecting number for %s", name)
+			}
+			stmt.resources[name] = n
+		}
+
+		if len(stmt.resources) == 0 {
+			return nil, this.errorf("expecting resource option")
+		}
+	}
+
+	return stmt, this.end()
+}
+
+// 'user'[@'host'] [IDENTIFIED {BY 'password' | WITH plugin [BY 'password' | AS 'hash']}]
+func (this *parser) parseUserSpec() (userSpec, error) {
+	spec := userSpec{host: "%"}
+
+	t := this.next()
+	if t.kind != tokIdent && t.kind != tokString {
+		return spec, this.errorf("expecting user name")
+	}
+	spec.user = t.val
+
+	if this.accept("@") {
+		t := this.next()
+		if t.kind != tokIdent && t.kind != tokString {
+			return spec, this.errorf("expecting host name")
+		}
+		spec.host = t.val
+	}
+
+	if !this.accept("IDENTIFIED") {
+		return spec, nil
+	}
+	spec.identified = true
+
+	if this.accept("WITH") {
+		t := this.next()
+		if t.kind != tokIdent && t.kind != tokString {
+			return spec, this.errorf("expecting authentication plugin")
+		}
+		spec.plugin = t.val
+
+		if this.accept("AS") {
+			t := this.next()
+			if t.kind != tokString {
+				return spec, this.errorf("expecting password hash")
+			}
+			spec.hash = t.val
+			return spec, nil
+		}
+
+		if !this.accept("BY") {
+			return spec, nil
+		}
+	} else if err := this.expect("BY"); err != nil {
+		return spec, err
+	}
+
+	t = this.next()
+	if t.kind != tokString {
+		return spec, this.errorf("expecting password")
+	}
+	spec.password = t.val
+
+	return spec, nil
+}
+
+// Statements that count against MAX_UPDATES_PER_HOUR, by their first keyword
+var updateKeywords map[string]bool = map[string]bool{
+	"ALTER":    true,
+	"CREATE":   true,
+	"DELETE":   true,
+	"DROP":     true,
+	"GRANT":    true,
+	"INSERT":   true,
+	"LOAD":     true,
+	"RENAME":   true,
+	"REPLACE":  true,
+	"REVOKE":   true,
+	"TRUNCATE": true,
+	"UPDATE":   true,
+}
+
+// isUpdateStatement returns true if q changes data or the schema
+func isUpdateStatement(q string) bool {
+	toks, err := tokenize(q)
+	if err != nil || len(toks) == 0 || toks[0].kind != tokIdent {
+		return false
+	}
+
+	return updateKeywords[strings.ToUpper(toks[0].val)]
+}
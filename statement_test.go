@@ -0,0 +1,212 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSet(t *testing.T) {
+	stmt, err := parseStatement("SET GLOBAL wait_timeout = 10, @@session.net_read_timeout := DEFAULT, @a = 'x';")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, ok := stmt.(*setStmt)
+	if !ok {
+		t.Fatalf("Expecting *setStmt, got %T", stmt)
+	}
+
+	if len(set.assigns) != 3 {
+		t.Fatalf("Expecting 3 assignments, got %d", len(set.assigns))
+	}
+
+	if a := set.assigns[0]; a.scope != scopeGlobal || a.name != "wait_timeout" || a.value.num != 10 {
+		t.Errorf("Wrong first assignment %#v", a)
+	}
+
+	if a := set.assigns[1]; a.scope != scopeSession || a.name != "net_read_timeout" || a.value.kind != valueDefault {
+		t.Errorf("Wrong second assignment %#v", a)
+	}
+
+	if a := set.assigns[2]; a.scope != 0 || a.name != "a" || a.value.str != "x" {
+		t.Errorf("Wrong third assignment %#v", a)
+	}
+}
+
+func TestParseSelectVars(t *testing.T) {
+	stmt, err := parseStatement("SET @master_binlog_checksum= @@global.binlog_checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if set, ok := stmt.(*setStmt); !ok || len(set.assigns) != 1 || set.assigns[0].value.kind != valueVariable ||
+		set.assigns[0].value.ref != (varRef{true, scopeGlobal, "binlog_checksum", "@@global.binlog_checksum"}) {
+		t.Errorf("Wrong assignment %#v", stmt)
+	}
+
+	stmt, err = parseStatement("SELECT @@GLOBAL.SERVER_ID, @a;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &selectVarsStmt{[]varRef{{true, scopeGlobal, "server_id", "@@GLOBAL.SERVER_ID"}, {false, 0, "a", "@a"}}}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("Expecting %#v, got %#v", expected, stmt)
+	}
+
+	if stmt, err := parseStatement("SELECT @@version_comment LIMIT 1"); err != nil || stmt != nil {
+		t.Errorf("Expecting no server statement, got %#v, %v", stmt, err)
+	}
+}
+
+func TestParseNonServerStatement(t *testing.T) {
+	if stmt, err := parseStatement("SELECT * FROM t /* SET x = 1 */"); err != nil || stmt != nil {
+		t.Errorf("Expecting no server statement, got %#v, %v", stmt, err)
+	}
+
+	if _, err := parseStatement("SET wait_timeout"); err == nil {
+		t.Error("Expecting syntax error")
+	}
+}
+
+func TestParseShow(t *testing.T) {
+	stmt, err := parseStatement("SHOW GLOBAL STATUS LIKE 'Threads%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	show, ok := stmt.(*showStmt)
+	if !ok || show.object != "STATUS" || show.scope != scopeGlobal || !show.hasLike || show.like != "Threads%" {
+		t.Errorf("Wrong statement %#v", stmt)
+	}
+
+	if stmt, err := parseStatement("SHOW FULL PROCESSLIST"); err != nil || stmt.(*showStmt).object != "PROCESSLIST" || !stmt.(*showStmt).full {
+		t.Errorf("Wrong statement %#v, %v", stmt, err)
+	}
+
+	for q, object := range map[string]string{"SHOW MASTER STATUS": "MASTER STATUS", "show slave hosts": "SLAVE HOSTS", "SHOW BINARY LOGS": "BINARY LOGS", "SHOW MASTER LOGS": "BINARY LOGS"} {
+		if stmt, err := parseStatement(q); err != nil || stmt.(*showStmt).object != object {
+			t.Errorf("%s: wrong statement %#v, %v", q, stmt, err)
+		}
+	}
+
+	for _, q := range []string{"SHOW TABLES", "SHOW FULL TABLES", "SHOW SLAVE STATUS"} {
+		if stmt, err := parseStatement(q); err != nil || stmt != nil {
+			t.Errorf("%s: expecting no server statement, got %#v, %v", q, stmt, err)
+		}
+	}
+
+	stmt, err = parseStatement("SHOW BINLOG EVENTS IN 'binlog.000002' FROM 4 LIMIT 2, 10")
+	if events, ok := stmt.(*binlogEventsStmt); err != nil || !ok || events.log != "binlog.000002" || events.pos != 4 || events.offset != 2 || events.limit != 10 || !events.hasLimit {
+		t.Errorf("Wrong statement %#v, %v", stmt, err)
+	}
+
+	if stmt, err := parseStatement("SHOW BINLOG EVENTS"); err != nil || *stmt.(*binlogEventsStmt) != (binlogEventsStmt{}) {
+		t.Errorf("Wrong statement %#v, %v", stmt, err)
+	}
+
+	for _, q := range []string{"SHOW BINLOG EVENTS FROM x", "SHOW BINLOG EVENTS IN binlog", "SHOW BINLOG EVENTS LIMIT 1,", "SHOW BINARY STATUS"} {
+		if _, err := parseStatement(q); err == nil {
+			t.Errorf("%s: expecting syntax error", q)
+		}
+	}
+}
+
+func TestParseUser(t *testing.T) {
+	stmt, err := parseStatement("CREATE USER IF NOT EXISTS 'a'@'10.%' IDENTIFIED BY 'x', b IDENTIFIED WITH mysql_native_password AS '*00' WITH MAX_QUERIES_PER_HOUR 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, ok := stmt.(*userStmt)
+	if !ok || user.alter || !user.ifExists || len(user.users) != 2 || user.resources["MAX_QUERIES_PER_HOUR"] != 10 {
+		t.Fatalf("Wrong statement %#v", stmt)
+	}
+
+	if u := user.users[0]; u.user != "a" || u.host != "10.%" || u.password != "x" {
+		t.Errorf("Wrong first user %#v", u)
+	}
+
+	if u := user.users[1]; u.user != "b" || u.host != "%" || u.plugin != "mysql_native_password" || u.hash != "*00" {
+		t.Errorf("Wrong second user %#v", u)
+	}
+
+	if _, err := parseStatement("ALTER USER a WITH MAX_BYTES 1"); err == nil {
+		t.Error("Expecting syntax error")
+	}
+}
+
+func TestParseTransaction(t *testing.T) {
+	for q, begin := range map[string]bool{"BEGIN": true, "START TRANSACTION READ ONLY": true, "COMMIT WORK": false, "rollback": false} {
+		stmt, err := parseStatement(q)
+		if txn, ok := stmt.(*txnStmt); err != nil || !ok || txn.begin != begin {
+			t.Errorf("%s: got %#v, %v", q, stmt, err)
+		}
+	}
+
+	if stmt, err := parseStatement("ROLLBACK TO SAVEPOINT a"); err != nil || stmt != nil {
+		t.Errorf("Expecting no server statement, got %#v, %v", stmt, err)
+	}
+}
+
+func TestParseKill(t *testing.T) {
+	tests := map[string]killStmt{
+		"KILL 5":             {id: 5},
+		"KILL CONNECTION 6;": {id: 6},
+		"kill query 7":       {id: 7, query: true},
+	}
+
+	for q, expected := range tests {
+		stmt, err := parseStatement(q)
+		if kill, ok := stmt.(*killStmt); err != nil || !ok || *kill != expected {
+			t.Errorf("%s: expecting %#v, got %#v, %v", q, expected, stmt, err)
+		}
+	}
+
+	for _, q := range []string{"KILL", "KILL QUERY x", "KILL 4294967296"} {
+		if _, err := parseStatement(q); err == nil {
+			t.Errorf("%s: expecting syntax error", q)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := map[string][]string{
+		"SET @a = 1":                       {"SET @a = 1"},
+		"SET @a = 1; ":                     {"SET @a = 1"},
+		"SET @a = 1;SET @b = 2;;":          {"SET @a = 1", "SET @b = 2"},
+		"SELECT ';', `a;b`, \"\\\";\" ; X": {"SELECT ';', `a;b`, \"\\\";\"", "X"},
+		"SELECT 1 /* ; */ -- ;\n; X # ;":   {"SELECT 1 /* ; */ -- ;", "X # ;"},
+		"SELECT 'a; X":                     {"SELECT 'a; X"},
+		" ; ":                              nil,
+
+		"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END; CALL p()": {
+			"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END", "CALL p()",
+		},
+		"CREATE DEFINER = `u`@`%` FUNCTION f(a INT) RETURNS INT BEGIN IF a > 0 THEN RETURN 1; END IF; " +
+			"RETURN CASE a WHEN 0 THEN 0 ELSE -1 END; END; SELECT f(1)": {
+			"CREATE DEFINER = `u`@`%` FUNCTION f(a INT) RETURNS INT BEGIN IF a > 0 THEN RETURN 1; END IF; " +
+				"RETURN CASE a WHEN 0 THEN 0 ELSE -1 END; END",
+			"SELECT f(1)",
+		},
+		"CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW BEGIN lbl: LOOP LEAVE lbl; END LOOP lbl; " +
+			"BEGIN CASE WHEN 1 THEN SET @a = 1; END CASE; END; END": {
+			"CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW BEGIN lbl: LOOP LEAVE lbl; END LOOP lbl; " +
+				"BEGIN CASE WHEN 1 THEN SET @a = 1; END CASE; END; END",
+		},
+		"CREATE PROCEDURE p() SELECT 1; SELECT 2":      {"CREATE PROCEDURE p() SELECT 1", "SELECT 2"},
+		"CREATE TABLE t (a INT); BEGIN; SELECT 1; END": {"CREATE TABLE t (a INT)", "BEGIN", "SELECT 1", "END"},
+	}
+
+	for q, expected := range tests {
+		if stmts := splitStatements(q); !reflect.DeepEqual(stmts, expected) {
+			t.Errorf("%q: expecting %q, got %q", q, expected, stmts)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Counters behind the status variables that aren't kept anywhere else. Updated
+// with sync/atomic.
+type serverStats struct {
+	// Connection attempts, successful or not
+	connections uint64
+
+	// Connections that failed during the handshake
+	abortedConnects uint64
+
+	// Connections refused because their host was blocked
+	hostBlockedErrors uint64
+
+	// Commands run for clients, see command.isQuestion(), and queries that took
+	// longer than long_query_time
+	questions   uint64
+	slowQueries uint64
+
+	// Tables opened, which are the system tables and the tables whose columns the
+	// query handler is asked for
+	openedTables uint64
+}
+
+// http://dev.mysql.com/doc/refman/5.6/en/server-status-variables.html
+var statusVars map[string]func(s *Server) uint64 = map[string]func(s *Server) uint64{
+	"Aborted_connects": func(s *Server) uint64 {
+		return atomic.LoadUint64(&s.stats.abortedConnects)
+	},
+	"Connection_errors_host_blocked": func(s *Server) uint64 {
+		return atomic.LoadUint64(&s.stats.hostBlockedErrors)
+	},
+	"Connection_errors_max_connections": func(s *Server) uint64 {
+		s.limits.mu.Lock()
+		defer s.limits.mu.Unlock()
+		return s.limits.maxConnectionsErrors
+	},
+	"Connections": func(s *Server) uint64 {
+		return atomic.LoadUint64(&s.stats.connections)
+	},
+	"Max_used_connections": func(s *Server) uint64 {
+		s.limits.mu.Lock()
+		defer s.limits.mu.Unlock()
+		return s.limits.maxUsed
+	},
+	"Opened_tables": func(s *Server) uint64 {
+		return atomic.LoadUint64(&s.stats.openedTables)
+	},
+	"Questions": func(s *Server) uint64 {
+		return atomic.LoadUint64(&s.stats.questions)
+	},
+	"Slow_queries": func(s *Server) uint64 {
+		return atomic.LoadUint64(&s.stats.slowQueries)
+	},
+	"Threads_connected": func(s *Server) uint64 {
+		return uint64(s.conns.count())
+	},
+	"Threadpool_idle_threads": func(s *Server) uint64 {
+		if tp, ok := s.sched.(*threadPool); ok {
+			return uint64(atomic.LoadInt64(&tp.idle))
+		}
+		return 0
+	},
+	"Threadpool_stalls": func(s *Server) uint64 {
+		if tp, ok := s.sched.(*threadPool); ok {
+			return atomic.LoadUint64(&tp.stalls)
+		}
+		return 0
+	},
+	"Threadpool_threads": func(s *Server) uint64 {
+		if tp, ok := s.sched.(*threadPool); ok {
+			return uint64(atomic.LoadInt64(&tp.threads))
+		}
+		return 0
+	},
+	"Uptime": func(s *Server) uint64 {
+		return uint64(time.Since(s.started) / time.Second)
+	},
+}
+
+// flushStatus resets the counters FLUSH STATUS resets. Max_used_connections starts
+// over from the connections there are now.
+func (this *Server) flushStatus() {
+	atomic.StoreUint64(&this.stats.questions, 0)
+	atomic.StoreUint64(&this.stats.slowQueries, 0)
+	atomic.StoreUint64(&this.stats.openedTables, 0)
+
+	this.limits.mu.Lock()
+	this.limits.maxUsed = this.limits.connected
+	this.limits.mu.Unlock()
+
+	if tp, ok := this.sched.(*threadPool); ok {
+		atomic.StoreUint64(&tp.stalls, 0)
+	}
+}
+
+// statusValue returns the current value of a status variable
+func (this *Server) statusValue(name string) uint64 {
+	return statusVars[name](this)
+}
+
+// execShow answers SHOW STATUS and SHOW VARIABLES, with rows sorted by name, and
+// SHOW PROCESSLIST
+func (this *connection) execShow(stmt *showStmt) error {
+	switch stmt.object {
+	case "PROCESSLIST":
+		return this.execProcessList(stmt.full)
+	case "MASTER STATUS":
+		return this.execShowMasterStatus()
+	case "SLAVE HOSTS":
+		return this.execShowSlaveHosts()
+	case "BINARY LOGS":
+		return this.execShowBinaryLogs()
+	}
+
+	var names []string
+	var value func(name string) uint64
+
+	switch stmt.object {
+	case "STATUS":
+		for name := range statusVars {
+			names = append(names, name)
+		}
+		value = this.srv.statusValue
+
+	case "VARIABLES":
+		for name := range sysVars {
+			names = append(names, name)
+		}
+		for name := range readOnlyVars {
+			names = append(names, name)
+		}
+		value = this.sysVarValue
+		if stmt.scope == scopeGlobal {
+			value = func(name string) uint64 {
+				n, _ := this.srv.globals.get(name)
+				return n
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	var rows [][]interface{}
+	for _, name := range names {
+		if stmt.hasLike && !likeMatch(stmt.like, name) {
+			continue
+		}
+		if text, ok := readOnlyVars[name]; ok {
+			rows = append(rows, []interface{}{name, text(this.srv)})
+		} else {
+			rows = append(rows, []interface{}{name, strconv.FormatUint(value(name), 10)})
+		}
+	}
+
+	cols := []*columnDef{
+		varcharColumn("Variable_name", 64),
+		varcharColumn("Value", 1024),
+	}
+
+	return this.writeResultSet(cols, rows)
+}
+
+// handleStatistics answers COM_STATISTICS, as used by mysqladmin status, with a
+// single line of text rather than an OK packet
+// http://dev.mysql.com/doc/internals/en/com-statistics.html
+func (this *connection) handleStatistics() error {
+	uptime := this.srv.statusValue("Uptime")
+	questions := this.srv.statusValue("Questions")
+
+	// Questions per second over the whole uptime
+	qps := float64(questions)
+	if uptime > 0 {
+		qps /= float64(uptime)
+	}
+
+	this.buf.Reset()
+	fmt.Fprintf(&this.buf, "Uptime: %d  Threads: %d  Questions: %d  Slow queries: %d  Opens: %d  Queries per second avg: %.3f",
+		uptime,
+		this.srv.statusValue("Threads_connected"),
+		questions,
+		this.srv.statusValue("Slow_queries"),
+		this.srv.statusValue("Opened_tables"),
+		qps)
+
+	return this.writePacket()
+}
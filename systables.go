@@ -0,0 +1,155 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A table whose contents come from the server's own state. Returns all of the
+// table's columns and rows.
+type systemTable func(c *connection) ([]*columnDef, [][]interface{}, error)
+
+// Keyed by lower case schema.table
+var systemTables map[string]systemTable = map[string]systemTable{
+	"information_schema.processlist": processListTable,
+	"performance_schema.host_cache":  hostCacheTable,
+}
+
+func lookupSystemTable(schema, table string) (systemTable, bool) {
+	t, ok := systemTables[strings.ToLower(schema+"."+table)]
+	return t, ok
+}
+
+// execSelect answers a SELECT from a system table, keeping only the columns asked
+// for
+func (this *connection) execSelect(stmt *selectStmt, table systemTable) error {
+	atomic.AddUint64(&this.srv.stats.openedTables, 1)
+
+	cols, rows, err := table(this)
+	if err != nil {
+		return err
+	}
+
+	if stmt.columns == nil {
+		return this.writeResultSet(cols, rows)
+	}
+
+	var idx []int
+	for _, name := range stmt.columns {
+		found := false
+		for i, col := range cols {
+			if strings.EqualFold(col.name, name) {
+				idx = append(idx, i)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return newSQLError(1054, "Unknown column '%s' in 'field list'", name)
+		}
+	}
+
+	selected := make([]*columnDef, len(idx))
+	for i, j := range idx {
+		selected[i] = cols[j]
+	}
+
+	for r, row := range rows {
+		values := make([]interface{}, len(idx))
+		for i, j := range idx {
+			values[i] = row[j]
+		}
+		rows[r] = values
+	}
+
+	return this.writeResultSet(selected, rows)
+}
+
+// systemColumn returns the definition of a column of a system table
+func systemColumn(schema, table, name string, typ fieldType, length uint32) *columnDef {
+	col := &columnDef{
+		schema:   schema,
+		table:    table,
+		orgTable: table,
+		name:     name,
+		orgName:  name,
+		charset:  collationBinary,
+		length:   length,
+		typ:      typ,
+	}
+
+	if typ == fieldTypeVarString {
+		col.charset = collationUtf8General
+		col.length = length * 3
+	}
+
+	return col
+}
+
+// timeValue formats t for a DATETIME column, with the zero time as NULL
+func timeValue(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(defaultTimeFormat)
+}
+
+// hostCacheTable lists the client addresses the server has seen. Reading it takes
+// the PROCESS or SUPER privilege, or SELECT on performance_schema.
+// http://dev.mysql.com/doc/refman/5.6/en/host-cache-table.html
+func hostCacheTable(c *connection) ([]*columnDef, [][]interface{}, error) {
+	acct := c.srv.accounts.latest(c.account)
+	if !acct.has(privProcess) && !acct.has(privSuper) && !acct.canSelectFrom("performance_schema") {
+		return nil, nil, newSQLError(1142, "SELECT command denied to user '%s'@'%s' for table 'host_cache'", acct.user, acct.host)
+	}
+
+	column := func(name string, typ fieldType, length uint32) *columnDef {
+		return systemColumn("performance_schema", "host_cache", name, typ, length)
+	}
+
+	cols := []*columnDef{
+		column("IP", fieldTypeVarString, 64),
+		column("HOST", fieldTypeVarString, 255),
+		column("SUM_CONNECT_ERRORS", fieldTypeLongLong, 20),
+		column("COUNT_HOST_BLOCKED_ERRORS", fieldTypeLongLong, 20),
+		column("COUNT_HANDSHAKE_ERRORS", fieldTypeLongLong, 20),
+		column("COUNT_AUTHENTICATION_ERRORS", fieldTypeLongLong, 20),
+		column("COUNT_MAX_CONNECTION_ERRORS", fieldTypeLongLong, 20),
+		column("COUNT_MAX_USER_CONNECTIONS_ERRORS", fieldTypeLongLong, 20),
+		column("COUNT_MAX_USER_CONNECTIONS_PER_HOUR_ERRORS", fieldTypeLongLong, 20),
+		column("FIRST_SEEN", fieldTypeDateTime, 19),
+		column("LAST_SEEN", fieldTypeDateTime, 19),
+		column("FIRST_ERROR_SEEN", fieldTypeDateTime, 19),
+		column("LAST_ERROR_SEEN", fieldTypeDateTime, 19),
+	}
+
+	var rows [][]interface{}
+	for _, e := range c.srv.HostCache() {
+		// Host names aren't resolved, so HOST is always NULL
+		rows = append(rows, []interface{}{
+			e.IP,
+			nil,
+			e.SumConnectErrors,
+			e.CountHostBlockedErrors,
+			e.CountHandshakeErrors,
+			e.CountAuthenticationErrors,
+			e.CountMaxConnectionErrors,
+			e.CountMaxUserConnectionErrors,
+			e.CountMaxUserConnectionsPerHourErrors,
+			timeValue(e.FirstSeen),
+			timeValue(e.LastSeen),
+			timeValue(e.FirstErrorSeen),
+			timeValue(e.LastErrorSeen),
+		})
+	}
+
+	return cols, rows, nil
+}
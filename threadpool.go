@@ -0,0 +1,308 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A scheduler decides where and when the commands of a connection run. The
+// connection's own goroutine always reads the commands, so it is the only one
+// waiting on the network.
+type scheduler interface {
+	start()
+
+	// run executes fn on behalf of c and returns its error once it is done
+	run(c *connection, fn func() error) error
+
+	// stop ends the scheduler once no connection is using it anymore
+	stop()
+}
+
+// Values for Config.ThreadHandling
+const (
+	threadPerConnection = "one-thread-per-connection"
+	poolOfThreads       = "pool-of-threads"
+)
+
+// Values for Config.ThreadPoolHighPrioMode
+const (
+	highPrioTransactions = "transactions"
+	highPrioStatements   = "statements"
+	highPrioNone         = "none"
+)
+
+func newScheduler(cfg *Config) (scheduler, error) {
+	switch cfg.ThreadHandling {
+	case "", threadPerConnection:
+		return perConnection{}, nil
+	case poolOfThreads:
+		return newThreadPool(cfg)
+	}
+
+	return nil, fmt.Errorf("Server/newScheduler: Unknown thread handling %q", cfg.ThreadHandling)
+}
+
+// perConnection runs every command on the goroutine of its connection, with no
+// limit on how many run at once
+type perConnection struct{}
+
+func (perConnection) start() {}
+func (perConnection) stop()  {}
+
+func (perConnection) run(c *connection, fn func() error) error {
+	return fn()
+}
+
+type poolTask struct {
+	fn   func() error
+	err  error
+	done chan bool
+}
+
+// threadPool runs commands on a bounded set of workers, like the thread pool of
+// MariaDB and MySQL Enterprise. Connections are spread over groups by connection
+// id. Each group has a queue of connections with a command ready to run, and a
+// fixed number of workers taking commands from it, high priority ones first.
+//
+// A group is stalled when it has commands waiting but none of its workers took a
+// new one during a whole stall limit, because they are all busy with long running
+// commands. The group then gets an extra worker, up to the overall maximum, that
+// goes away again once the queue is empty.
+// https://mariadb.com/kb/en/thread-pool-in-mariadb/
+type threadPool struct {
+	groups []*poolGroup
+
+	stallLimit      time.Duration
+	maxThreads      int64
+	highPrioMode    string
+	highPrioTickets uint64
+
+	// Workers in total, and those waiting for a command
+	threads int64
+	idle    int64
+
+	// Number of times a group was found stalled
+	stalls uint64
+
+	quit chan bool
+	wg   sync.WaitGroup
+}
+
+type poolGroup struct {
+	pool *threadPool
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	high []*poolTask
+	low  []*poolTask
+
+	// Number of permanent workers
+	workers int
+
+	// Commands taken from the queue so far, and the count the stall detection saw
+	// the last time it looked
+	dequeued     uint64
+	lastDequeued uint64
+
+	quit bool
+}
+
+func newThreadPool(cfg *Config) (*threadPool, error) {
+	size := cfg.ThreadPoolSize
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+
+	switch cfg.ThreadPoolHighPrioMode {
+	case highPrioTransactions, highPrioStatements, highPrioNone:
+	default:
+		return nil, fmt.Errorf("Server/newThreadPool: Unknown high priority mode %q", cfg.ThreadPoolHighPrioMode)
+	}
+
+	if cfg.ThreadPoolStallLimit < 10 {
+		return nil, fmt.Errorf("Server/newThreadPool: Stall limit of %dms is below the minimum of 10ms", cfg.ThreadPoolStallLimit)
+	}
+
+	workers := 1 + cfg.ThreadPoolOversubscribe
+	if int64(size*workers) > int64(cfg.ThreadPoolMaxThreads) {
+		return nil, fmt.Errorf("Server/newThreadPool: %d groups of %d workers exceed the maximum of %d threads", size, workers, cfg.ThreadPoolMaxThreads)
+	}
+
+	this := &threadPool{
+		stallLimit:      time.Duration(cfg.ThreadPoolStallLimit) * time.Millisecond,
+		maxThreads:      int64(cfg.ThreadPoolMaxThreads),
+		highPrioMode:    cfg.ThreadPoolHighPrioMode,
+		highPrioTickets: cfg.ThreadPoolHighPrioTickets,
+		quit:            make(chan bool),
+	}
+
+	for i := 0; i < size; i++ {
+		g := &poolGroup{pool: this, workers: workers}
+		g.cond = sync.NewCond(&g.mu)
+		this.groups = append(this.groups, g)
+	}
+
+	return this, nil
+}
+
+func (this *threadPool) start() {
+	glog.V(3).Infof("Starting thread pool with %d groups", len(this.groups))
+
+	for _, g := range this.groups {
+		for i := 0; i < g.workers; i++ {
+			this.startWorker(g, false)
+		}
+	}
+
+	this.wg.Add(1)
+	go this.monitor()
+}
+
+func (this *threadPool) startWorker(g *poolGroup, extra bool) {
+	atomic.AddInt64(&this.threads, 1)
+	this.wg.Add(1)
+
+	go func() {
+		defer this.wg.Done()
+		defer atomic.AddInt64(&this.threads, -1)
+		g.work(extra)
+	}()
+}
+
+func (this *threadPool) stop() {
+	close(this.quit)
+
+	for _, g := range this.groups {
+		g.mu.Lock()
+		g.quit = true
+		g.cond.Broadcast()
+		g.mu.Unlock()
+	}
+
+	this.wg.Wait()
+}
+
+func (this *threadPool) run(c *connection, fn func() error) error {
+	task := &poolTask{fn: fn, done: make(chan bool)}
+	g := this.groups[int(c.id)%len(this.groups)]
+
+	g.mu.Lock()
+	if this.isHighPriority(c) {
+		g.high = append(g.high, task)
+	} else {
+		g.low = append(g.low, task)
+	}
+	g.cond.Signal()
+	g.mu.Unlock()
+
+	<-task.done
+	return task.err
+}
+
+// isHighPriority decides whether the next command of c jumps the queue. Each
+// connection only gets so many high priority commands in a row, so one that stays
+// in a transaction can't starve the others.
+func (this *threadPool) isHighPriority(c *connection) bool {
+	high := false
+	switch this.highPrioMode {
+	case highPrioStatements:
+		high = true
+	case highPrioTransactions:
+		high = c.status&serverStatusInTrans != 0
+	}
+
+	if high && c.highPrioRun < this.highPrioTickets {
+		c.highPrioRun++
+		return true
+	}
+
+	c.highPrioRun = 0
+	return false
+}
+
+// monitor looks for stalled groups every stall limit
+func (this *threadPool) monitor() {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(this.stallLimit)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+		case <-ticker.C:
+		}
+
+		for _, g := range this.groups {
+			if g.checkStall() && atomic.LoadInt64(&this.threads) < this.maxThreads {
+				atomic.AddUint64(&this.stalls, 1)
+				glog.V(3).Info("Thread pool group stalled, adding a worker")
+				this.startWorker(g, true)
+			}
+		}
+	}
+}
+
+// checkStall returns true if the group has commands waiting and hasn't started
+// any since the last check
+func (this *poolGroup) checkStall() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	stalled := len(this.high)+len(this.low) > 0 && this.dequeued == this.lastDequeued
+	this.lastDequeued = this.dequeued
+
+	return stalled
+}
+
+// next waits for the next command to run. Extra workers don't wait, they return
+// nil as soon as the queue is empty.
+func (this *poolGroup) next(extra bool) *poolTask {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for len(this.high) == 0 && len(this.low) == 0 {
+		if this.quit || extra {
+			return nil
+		}
+
+		atomic.AddInt64(&this.pool.idle, 1)
+		this.cond.Wait()
+		atomic.AddInt64(&this.pool.idle, -1)
+	}
+
+	var task *poolTask
+	if len(this.high) > 0 {
+		task, this.high = this.high[0], this.high[1:]
+	} else {
+		task, this.low = this.low[0], this.low[1:]
+	}
+
+	this.dequeued++
+
+	return task
+}
+
+func (this *poolGroup) work(extra bool) {
+	for {
+		task := this.next(extra)
+		if task == nil {
+			return
+		}
+
+		task.err = task.fn()
+		close(task.done)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestThreadPool(t *testing.T, stallLimit uint64) *threadPool {
+	cfg, _ := NewConfig()
+	cfg.ThreadHandling = poolOfThreads
+	cfg.ThreadPoolSize = 1
+	cfg.ThreadPoolOversubscribe = 0
+	cfg.ThreadPoolStallLimit = stallLimit
+
+	tp, err := newThreadPool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.start()
+
+	return tp
+}
+
+// block occupies the only worker of tp until the returned channel is closed
+func block(tp *threadPool) chan bool {
+	release := make(chan bool)
+	started := make(chan bool)
+
+	go tp.run(&connection{id: 1}, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	<-started
+	return release
+}
+
+// queued waits until the group has n commands waiting
+func queued(g *poolGroup, n int) {
+	for {
+		g.mu.Lock()
+		l := len(g.high) + len(g.low)
+		g.mu.Unlock()
+
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestThreadPoolPriority(t *testing.T) {
+	tp := newTestThreadPool(t, 10000)
+	defer tp.stop()
+
+	release := block(tp)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+
+	submit := func(c *connection, name string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tp.run(c, func() error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+
+	submit(&connection{id: 2}, "plain")
+	queued(tp.groups[0], 1)
+	submit(&connection{id: 3, status: serverStatusInTrans}, "transaction")
+	queued(tp.groups[0], 2)
+
+	close(release)
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "transaction" {
+		t.Errorf("Expecting the connection in a transaction to go first, got %v", order)
+	}
+}
+
+func TestThreadPoolStall(t *testing.T) {
+	tp := newTestThreadPool(t, 20)
+	defer tp.stop()
+
+	release := block(tp)
+	defer close(release)
+
+	done := make(chan bool)
+	go tp.run(&connection{id: 2}, func() error {
+		close(done)
+		return nil
+	})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stalled group didn't get an extra worker")
+	}
+
+	if atomic.LoadUint64(&tp.stalls) == 0 {
+		t.Error("Expecting the stall to be counted")
+	}
+}
+
+func TestThreadPoolServer(t *testing.T) {
+	cfg, _ := NewConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Address: "127.0.0.1:0"}}
+	cfg.ThreadHandling = poolOfThreads
+	cfg.ThreadPoolSize = 2
+	cfg.ThreadPoolOversubscribe = 0
+
+	s, stop := startTestServer(t, cfg)
+	defer stop()
+
+	db, err := sql.Open("mysql", testDSN(s, "testuser", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := db.Exec("SET @a = 1"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var name string
+	var threads int
+	if err := db.QueryRowContext(context.Background(), "SHOW STATUS LIKE 'Threadpool_threads'").Scan(&name, &threads); err != nil {
+		t.Fatal(err)
+	}
+
+	if threads < 2 {
+		t.Errorf("Expecting at least 2 pool threads, got %d", threads)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+// Package trace reads and writes qld protocol capture files. A capture holds every
+// MySQL packet exchanged on a single connection, in the order they were sent or
+// received, so a session can be inspected or replayed later.
+//
+// The file starts with a header:
+//
+//	8 bytes   magic "QLDTRACE"
+//	2 bytes   format version
+//	4 bytes   connection id
+//	8 bytes   capture start, unix nanoseconds
+//	2 bytes   length of remote address
+//	n bytes   remote address
+//
+// followed by one record per packet:
+//
+//	1 byte    direction
+//	8 bytes   timestamp, unix nanoseconds
+//	1 byte    packet sequence id
+//	4 bytes   payload length
+//	n bytes   payload, without the 4 byte packet header
+//
+// All integers are little endian.
+package trace
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	magic   = "QLDTRACE"
+	version = 1
+
+	// A single MySQL packet can't be larger than this
+	maxPayload = 1<<24 - 1
+)
+
+var ErrBadMagic = errors.New("trace: not a qld trace file")
+
+type Direction byte
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (this Direction) String() string {
+	switch this {
+	case ClientToServer:
+		return "C->S"
+	case ServerToClient:
+		return "S->C"
+	}
+	return fmt.Sprintf("Direction(%d)", byte(this))
+}
+
+type Header struct {
+	ConnId     uint32
+	Start      time.Time
+	RemoteAddr string
+}
+
+type Packet struct {
+	Direction Direction
+	Time      time.Time
+	Sequence  byte
+	Payload   []byte
+}
+
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the capture header to w and returns a Writer for the packets
+func NewWriter(w io.Writer, connId uint32, remoteAddr string) (*Writer, error) {
+	if len(remoteAddr) > 0xffff {
+		remoteAddr = remoteAddr[:0xffff]
+	}
+
+	buf := make([]byte, 0, len(magic)+16+len(remoteAddr))
+	buf = append(buf, magic...)
+	buf = binary.LittleEndian.AppendUint16(buf, version)
+	buf = binary.LittleEndian.AppendUint32(buf, connId)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(remoteAddr)))
+	buf = append(buf, remoteAddr...)
+
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w}, nil
+}
+
+// WritePacket records a single packet. Each record is written with one call to the
+// underlying writer, so a capture cut short by a crash only loses the last record.
+func (this *Writer) WritePacket(dir Direction, seq byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, byte(dir))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+	buf = append(buf, seq)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	_, err := this.w.Write(buf)
+	return err
+}
+
+type Reader struct {
+	r      io.Reader
+	header Header
+}
+
+// NewReader reads the capture header from r
+func NewReader(r io.Reader) (*Reader, error) {
+	var fixed [len(magic) + 16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+
+	if string(fixed[:len(magic)]) != magic {
+		return nil, ErrBadMagic
+	}
+
+	b := fixed[len(magic):]
+	if v := binary.LittleEndian.Uint16(b[0:]); v != version {
+		return nil, fmt.Errorf("trace: unsupported format version %d", v)
+	}
+
+	rd := &Reader{r: r}
+	rd.header.ConnId = binary.LittleEndian.Uint32(b[2:])
+	rd.header.Start = time.Unix(0, int64(binary.LittleEndian.Uint64(b[6:])))
+
+	addr := make([]byte, binary.LittleEndian.Uint16(b[14:]))
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+	rd.header.RemoteAddr = string(addr)
+
+	return rd, nil
+}
+
+func (this *Reader) Header() Header {
+	return this.header
+}
+
+// Next returns the next packet in the capture, or io.EOF at the end
+func (this *Reader) Next() (*Packet, error) {
+	var fixed [14]byte
+	if _, err := io.ReadFull(this.r, fixed[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("trace: truncated record")
+		}
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(fixed[10:])
+	if n > maxPayload {
+		return nil, fmt.Errorf("trace: payload length %d too large", n)
+	}
+
+	pkt := &Packet{
+		Direction: Direction(fixed[0]),
+		Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(fixed[1:]))),
+		Sequence:  fixed[9],
+		Payload:   make([]byte, n),
+	}
+
+	if _, err := io.ReadFull(this.r, pkt.Payload); err != nil {
+		return nil, fmt.Errorf("trace: truncated record")
+	}
+
+	return pkt, nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package trace
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, 42, "127.0.0.1:5555")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WritePacket(ServerToClient, 0, []byte{0x0a, 'x'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(ClientToServer, 1, []byte{0x03, 'S', 'E', 'L'}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h := r.Header(); h.ConnId != 42 || h.RemoteAddr != "127.0.0.1:5555" {
+		t.Errorf("Wrong header %#v", h)
+	}
+
+	pkt, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Direction != ServerToClient || pkt.Sequence != 0 || !bytes.Equal(pkt.Payload, []byte{0x0a, 'x'}) {
+		t.Errorf("Wrong first packet %#v", pkt)
+	}
+
+	pkt, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Direction != ClientToServer || pkt.Sequence != 1 || string(pkt.Payload[1:]) != "SEL" {
+		t.Errorf("Wrong second packet %#v", pkt)
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Expecting io.EOF, got %v", err)
+	}
+}
+
+func TestBadMagic(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader(make([]byte, 64))); err != ErrBadMagic {
+		t.Errorf("Expecting ErrBadMagic, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/reducedb/qld/trace"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// startTrace creates a capture file for this connection in dir. Every packet read
+// or written from now on is recorded until stopTrace is called.
+func (this *connection) startTrace(dir string) error {
+	// Connection ids start over with each server, so the time has to tell apart the
+	// captures of a server restarted in the same second
+	name := filepath.Join(dir, fmt.Sprintf("qld-%d-%s.trace", this.id, time.Now().Format("20060102-150405.000000000")))
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w, err := trace.NewWriter(f, this.id, this.RemoteAddr().String())
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	glog.V(3).Infof("Tracing connection #%d to %s", this.id, name)
+	this.traceFile = f
+	this.tracer = w
+
+	return nil
+}
+
+func (this *connection) stopTrace() {
+	if this.traceFile != nil {
+		this.traceFile.Close()
+		this.traceFile = nil
+		this.tracer = nil
+	}
+}
+
+// tracePacket records the packet with the current sequence id. A capture that can't
+// be written is abandoned rather than failing the connection.
+func (this *connection) tracePacket(dir trace.Direction, payload []byte) {
+	if this.tracer == nil {
+		return
+	}
+
+	if err := this.tracer.WritePacket(dir, this.sequence, payload); err != nil {
+		glog.Errorf("Connection #%d: Error writing trace, tracing stopped: %v", this.id, err)
+		this.stopTrace()
+	}
+}
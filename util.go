@@ -5,3 +5,93 @@
 // Use of this source code is governed by the Apache 2.0 license.
 
 package qld
+
+import (
+	"net"
+	"strings"
+)
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func isTimeout(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// clientHost returns the host:port of a client, or "localhost" for clients on a
+// Unix domain socket, as MySQL shows them in the process list
+func clientHost(addr net.Addr) string {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return "localhost"
+	}
+	return addr.String()
+}
+
+// clientIP returns the IP address of a client as used for account host matching,
+// or "localhost" for clients on a Unix domain socket
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		return "localhost"
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// likeMatch matches s against a SQL LIKE pattern, where % matches any number of
+// characters, _ matches exactly one and \ escapes the next character. Matching is
+// case insensitive.
+func likeMatch(pattern, s string) bool {
+	return likeMatchFold(strings.ToLower(pattern), strings.ToLower(s))
+}
+
+func likeMatchFold(p, s string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '%':
+			// Collapse runs of % and try every possible split
+			for len(p) > 0 && p[0] == '%' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if likeMatchFold(p, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '_':
+			if len(s) == 0 {
+				return false
+			}
+			p, s = p[1:], s[1:]
+
+		default:
+			if p[0] == '\\' && len(p) > 1 {
+				p = p[1:]
+			}
+			if len(s) == 0 || s[0] != p[0] {
+				return false
+			}
+			p, s = p[1:], s[1:]
+		}
+	}
+
+	return len(s) == 0
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2013 Jian Zhen <zhenjl@gmail.com>
+//
+// All rights reserved.
+//
+// Use of this source code is governed by the Apache 2.0 license.
+
+package qld
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// http://dev.mysql.com/doc/refman/5.6/en/using-system-variables.html
+type varScope int
+
+const (
+	scopeGlobal varScope = 1 << iota
+	scopeSession
+)
+
+type sysVar struct {
+	name  string
+	scope varScope
+
+	// Values outside of [min, max] are clamped, the same as MySQL does in
+	// non-strict mode.
+	min, max uint64
+
+	// Returns the compiled in or configured global default
+	def func(cfg *Config) uint64
+}
+
+const maxTimeout = 31536000
+
+var sysVars map[string]*sysVar = map[string]*sysVar{
+	"binlog_expire_logs_seconds": &sysVar{"binlog_expire_logs_seconds", scopeGlobal, 0, 1<<32 - 1,
+		func(cfg *Config) uint64 { return cfg.BinlogExpireLogsSeconds }},
+	"connect_timeout": &sysVar{"connect_timeout", scopeGlobal, 2, maxTimeout,
+		func(cfg *Config) uint64 { return cfg.ConnectTimeout }},
+	"host_cache_size": &sysVar{"host_cache_size", scopeGlobal, 0, 65536,
+		func(cfg *Config) uint64 { return cfg.HostCacheSize }},
+	"interactive_timeout": &sysVar{"interactive_timeout", scopeGlobal | scopeSession, 1, maxTimeout,
+		func(cfg *Config) uint64 { return cfg.InteractiveTimeout }},
+	"long_query_time": &sysVar{"long_query_time", scopeGlobal | scopeSession, 0, maxTimeout,
+		func(cfg *Config) uint64 { return cfg.LongQueryTime }},
+	"max_connect_errors": &sysVar{"max_connect_errors", scopeGlobal, 1, 1<<64 - 1,
+		func(cfg *Config) uint64 { return cfg.MaxConnectErrors }},
+	"max_binlog_size": &sysVar{"max_binlog_size", scopeGlobal, 4096, 1073741824,
+		func(cfg *Config) uint64 { return cfg.MaxBinlogSize }},
+	"max_connections": &sysVar{"max_connections", scopeGlobal, 1, 100000,
+		func(cfg *Config) uint64 { return cfg.MaxConnections }},
+	"max_user_connections": &sysVar{"max_user_connections", scopeGlobal, 0, 1<<32 - 1,
+		func(cfg *Config) uint64 { return cfg.MaxUserConnections }},
+	"net_read_timeout": &sysVar{"net_read_timeout", scopeGlobal | scopeSession, 1, maxTimeout,
+		func(cfg *Config) uint64 { return cfg.NetReadTimeout }},
+	"net_write_timeout": &sysVar{"net_write_timeout", scopeGlobal | scopeSession, 1, maxTimeout,
+		func(cfg *Config) uint64 { return cfg.NetWriteTimeout }},
+	"session_track_schema": &sysVar{"session_track_schema", scopeGlobal | scopeSession, 0, 1,
+		func(cfg *Config) uint64 { return 1 }},
+	"wait_timeout": &sysVar{"wait_timeout", scopeGlobal | scopeSession, 1, maxTimeout,
+		func(cfg *Config) uint64 { return cfg.WaitTimeout }},
+}
+
+// System variables that show how the server is set up, mostly for replicas. They are
+// global and can't be set.
+// http://dev.mysql.com/doc/refman/5.7/en/replication-options-binary-log.html
+var readOnlyVars map[string]func(s *Server) string = map[string]func(s *Server) string{
+	"binlog_checksum": func(s *Server) string {
+		return strings.ToUpper(s.cfg.BinlogChecksum)
+	},
+	"binlog_format": func(s *Server) string {
+		return "ROW"
+	},
+	"binlog_row_image": func(s *Server) string {
+		return "FULL"
+	},
+	"gtid_mode": func(s *Server) string {
+		return onOff(s.binlog != nil)
+	},
+	"log_bin": func(s *Server) string {
+		return onOff(s.binlog != nil)
+	},
+	"server_id": func(s *Server) string {
+		return strconv.FormatUint(uint64(s.cfg.ServerID), 10)
+	},
+	"server_uuid": func(s *Server) string {
+		sid, err := parseServerUUID(s.cfg.ServerUUID, s.cfg.ServerID)
+		if err != nil {
+			return s.cfg.ServerUUID
+		}
+		return formatUUID(sid)
+	},
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func lookupSysVar(name string) (*sysVar, error) {
+	v, ok := sysVars[strings.ToLower(name)]
+	if !ok {
+		return nil, newSQLError(1193, "Unknown system variable '%s'", name)
+	}
+
+	return v, nil
+}
+
+func (this *sysVar) clamp(n uint64) uint64 {
+	if n < this.min {
+		return this.min
+	} else if n > this.max {
+		return this.max
+	}
+
+	return n
+}
+
+// variables holds the values of the system variables for either the whole server
+// (global) or for a single session.
+type variables struct {
+	mu   sync.RWMutex
+	vals map[string]uint64
+}
+
+func newGlobalVariables(cfg *Config) *variables {
+	vars := &variables{
+		vals: make(map[string]uint64),
+	}
+
+	for name, v := range sysVars {
+		vars.vals[name] = v.clamp(v.def(cfg))
+	}
+
+	return vars
+}
+
+// sessionCopy returns the initial session variables for a new connection, which
+// are the current global values of all the variables that have a session scope.
+func (this *variables) sessionCopy() *variables {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	vars := &variables{
+		vals: make(map[string]uint64),
+	}
+
+	for name, n := range this.vals {
+		if sysVars[name].scope&scopeSession != 0 {
+			vars.vals[name] = n
+		}
+	}
+
+	return vars
+}
+
+func (this *variables) get(name string) (uint64, bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	n, ok := this.vals[name]
+	return n, ok
+}
+
+func (this *variables) set(name string, n uint64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.vals[name] = n
+}